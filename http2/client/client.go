@@ -0,0 +1,291 @@
+// Package client is a mini HTTP/2 client built directly on top of TCP.
+//
+// It speaks h2c (HTTP/2 over cleartext) for http URLs, with prior
+// knowledge or by upgrading from HTTP/1.1, and HTTP/2 over TLS, negotiated
+// with ALPN, for https URLs. A ClientConn multiplexes any number of
+// requests over one connection, and Transport implements http.RoundTripper
+// on top of it, e.g.
+//
+//	c := &http.Client{Transport: &client.Transport{}}
+//	resp, err := c.Get("http://localhost:8080/hello")
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/h2tls"
+)
+
+// Transport is an http.RoundTripper that sends every request over HTTP/2.
+// It keeps one connection per host and port and opens a new one when the
+// old one cannot take more streams.
+type Transport struct {
+	// DialContext opens the TCP connection. net.Dialer.DialContext is used
+	// if nil.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig is used for https URLs. "h2" is added to its
+	// NextProtos and TLS 1.2 is the minimum version.
+	TLSClientConfig *tls.Config
+
+	// UpgradeH2C makes the first request to an http URL ask the server to
+	// upgrade from HTTP/1.1 to h2c, for servers not known to speak HTTP/2.
+	// If the server stays with HTTP/1.1, its response is returned as is.
+	// Without it, http URLs use HTTP/2 with prior knowledge.
+	UpgradeH2C bool
+
+	// Settings are advertised to every server in the client's first
+	// SETTINGS frame. If nil, DefaultSettings is used with push disabled.
+	Settings *Settings
+
+	// Padding is how many bytes of padding (0-255) to add to every HEADERS
+	// and DATA frame. Padding hides the size of the real content.
+	// https://datatracker.ietf.org/doc/html/rfc9113#section-10.7
+	Padding uint8
+
+	// ReadIdleTimeout is how long a connection may stay silent before the
+	// client checks on the server with a PING. Zero disables keepalive.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout is how long to wait for the ACK of that PING before the
+	// connection is closed, 15 seconds if zero.
+	PingTimeout time.Duration
+
+	// Logf, if set, is told about every frame that is sent and received.
+	Logf func(format string, args ...any)
+
+	mu    sync.Mutex
+	conns map[string]*ClientConn
+	// dialing holds the connections being dialed, so that other requests
+	// to the same host wait for them without holding mu
+	dialing map[string]*dialCall
+}
+
+// dialCall is a connection being dialed. done is closed once cc or err
+// is set.
+type dialCall struct {
+	done chan struct{}
+	cc   *ClientConn
+	err  error
+}
+
+// waitDial waits for another request's dial to addr. It reports whether
+// that dial failed for reasons of its own, its request's context, in which
+// case the caller may dial itself.
+func waitDial(ctx context.Context, call *dialCall) (retry bool, err error) {
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+		return true, nil
+	}
+	return call.err == nil, call.err
+}
+
+// maxRetries bounds how often RoundTrip moves a request to a new connection
+// because the old one went away before processing it.
+const maxRetries = 3
+
+// RoundTrip sends req on a connection to its host and returns the response
+// as soon as its headers arrive. The body streams in as DATA frames do.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scheme := req.URL.Scheme
+	port := map[string]string{"http": "80", "https": "443"}[scheme]
+	if port == "" {
+		closeBody(req)
+		return nil, fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+
+	if t.UpgradeH2C && scheme == "http" {
+		if resp, ok, err := t.roundTripUpgrade(req, addr); ok {
+			return resp, err
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		cc, err := t.getConn(req.Context(), scheme, addr)
+		if err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		resp, err := cc.RoundTrip(req)
+		if !errors.Is(err, errStreamNotProcessed) || retry == maxRetries {
+			return resp, err
+		}
+		// The server never saw the request, so it is safe to send again
+		// once the body can be replayed
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// getConn returns the connection to addr, dialing a new one if there is
+// none or the old one is no longer usable. Requests that find a dial to
+// addr under way wait for it; a slow dial never holds up other hosts.
+func (t *Transport) getConn(ctx context.Context, scheme, addr string) (*ClientConn, error) {
+	key := scheme + "://" + addr
+	for {
+		t.mu.Lock()
+		if cc, ok := t.conns[key]; ok {
+			if cc.CanTakeNewRequest() {
+				t.mu.Unlock()
+				return cc, nil
+			}
+			delete(t.conns, key)
+		}
+		if call, ok := t.dialing[key]; ok {
+			t.mu.Unlock()
+			if retry, err := waitDial(ctx, call); !retry {
+				return nil, err
+			}
+			continue
+		}
+		call := t.startDial(key)
+		t.mu.Unlock()
+
+		cc, err := t.DialClientConn(ctx, scheme, addr)
+		t.finishDial(key, call, cc, err)
+		return cc, err
+	}
+}
+
+// startDial records that key is being dialed. t.mu must be held.
+func (t *Transport) startDial(key string) *dialCall {
+	if t.dialing == nil {
+		t.dialing = make(map[string]*dialCall)
+	}
+	call := &dialCall{done: make(chan struct{})}
+	t.dialing[key] = call
+	return call
+}
+
+// finishDial stores the outcome of a dial and wakes the requests waiting
+// for it. A nil cc without err leaves nothing to share.
+func (t *Transport) finishDial(key string, call *dialCall, cc *ClientConn, err error) {
+	t.mu.Lock()
+	delete(t.dialing, key)
+	if cc != nil {
+		if t.conns == nil {
+			t.conns = make(map[string]*ClientConn)
+		}
+		t.conns[key] = cc
+	}
+	t.mu.Unlock()
+	call.cc, call.err = cc, err
+	close(call.done)
+}
+
+// DialClientConn opens a new connection to addr, with TLS if scheme is
+// "https", and starts HTTP/2 on it. Unlike RoundTrip it never reuses a
+// connection.
+func (t *Transport) DialClientConn(ctx context.Context, scheme, addr string) (*ClientConn, error) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "https" {
+		if conn, err = t.handshake(ctx, conn, addr); err != nil {
+			return nil, err
+		}
+	}
+	cc, err := t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// handshake runs the TLS handshake on conn and checks that the server
+// agreed to h2 with adequate security.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-starting-http-2-for-https-u
+func (t *Transport) handshake(ctx context.Context, conn net.Conn, addr string) (*tls.Conn, error) {
+	config := h2tls.Config(t.TLSClientConfig)
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	if state.NegotiatedProtocol != h2tls.NextProto {
+		tc.Close()
+		return nil, fmt.Errorf("server did not negotiate %s through ALPN (got %q)", h2tls.NextProto, state.NegotiatedProtocol)
+	}
+	if err := h2tls.Check(state); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	t.logf("🔒 TLS %s with %s, ALPN %q", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	return tc, nil
+}
+
+// CloseIdleConnections closes the connections that have no streams open.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, cc := range t.conns {
+		if cc.idle() {
+			cc.Close()
+			delete(t.conns, addr)
+		}
+	}
+}
+
+func (t *Transport) settings() Settings {
+	if t.Settings == nil {
+		settings := DefaultSettings()
+		// There is nobody to hand a pushed response to
+		settings.EnablePush = false
+		return settings
+	}
+	return *t.Settings
+}
+
+func (t *Transport) logf(format string, args ...any) {
+	if t.Logf != nil {
+		t.Logf(format, args...)
+	}
+}
+
+func (t *Transport) pingTimeout() time.Duration {
+	if t.PingTimeout == 0 {
+		return defaultPingTimeout
+	}
+	return t.PingTimeout
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,657 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/grpc"
+	"github.com/nethish/fromscratch/http2/h2tls"
+	"github.com/nethish/fromscratch/http2/hpack"
+	"github.com/nethish/fromscratch/http2/server"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return conn, err
+}
+
+func startServer(t *testing.T, srv *server.Server) (string, *countingListener) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: ln}
+	go srv.Serve(cl)
+	t.Cleanup(func() { ln.Close() })
+	return "http://" + ln.Addr().String(), cl
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Path", r.URL.Path)
+	io.Copy(w, r.Body)
+}
+
+func TestTransportMultiplexes(t *testing.T) {
+	// Every handler waits for all the others, so the requests must really
+	// be in flight at the same time
+	const n = 20
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		echoHandler(w, r)
+	})
+	url, ln := startServer(t, &server.Server{Handler: server.HTTPHandler(mux)})
+
+	c := &http.Client{Transport: &Transport{}}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf("request %d", i)
+			resp, err := c.Post(fmt.Sprintf("%s/%d", url, i), "text/plain", bytes.NewReader([]byte(body)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || string(got) != body {
+				t.Errorf("request %d: got %q, %v", i, got, err)
+			}
+			if path := resp.Header.Get("X-Path"); path != fmt.Sprintf("/%d", i) {
+				t.Errorf("request %d: got the response for %s", i, path)
+			}
+			if resp.Proto != "HTTP/2.0" {
+				t.Errorf("request %d: Proto = %s", i, resp.Proto)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := ln.n.Load(); got != 1 {
+		t.Errorf("%d connections, want 1", got)
+	}
+}
+
+func TestTransportFlowControl(t *testing.T) {
+	url, _ := startServer(t, &server.Server{Handler: server.HTTPHandler(http.HandlerFunc(echoHandler))})
+
+	// Several bodies much bigger than the 64 KB windows, both ways at once
+	c := &http.Client{Transport: &Transport{Padding: 8}}
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 300_000+i)
+			resp, err := c.Post(url, "text/plain", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil || !bytes.Equal(got, body) {
+				t.Errorf("body %d: got %d bytes, %v; want %d bytes", i, len(got), err, len(body))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMaxConcurrentStreamsIsRespected(t *testing.T) {
+	settings := server.DefaultSettings()
+	settings.EnablePush = false
+	settings.MaxConcurrentStreams = 2
+	var active, peak atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+	url, _ := startServer(t, &server.Server{Settings: &settings, Handler: server.HTTPHandler(mux)})
+
+	// The extra requests wait for a slot instead of being refused
+	c := &http.Client{Transport: &Transport{}}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d handlers ran at once, the server allows 2", p)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	mux.HandleFunc("/fast", echoHandler)
+	url, ln := startServer(t, &server.Server{Handler: server.HTTPHandler(mux)})
+	defer close(release)
+
+	c := &http.Client{Transport: &Transport{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/slow", nil)
+	if _, err := c.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The connection is still fine for the next request
+	resp, err := c.Post(url+"/fast", "text/plain", bytes.NewReader([]byte("still here")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, _ := io.ReadAll(resp.Body); string(got) != "still here" {
+		t.Errorf("got %q", got)
+	}
+	if got := ln.n.Load(); got != 1 {
+		t.Errorf("%d connections, want 1", got)
+	}
+}
+
+func TestTransportTLS(t *testing.T) {
+	cert, err := h2tls.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server.Server{
+		Handler:   server.HTTPHandler(http.HandlerFunc(echoHandler)),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { ln.Close() })
+	url := "https://" + ln.Addr().String() + "/secure"
+
+	// The self-signed certificate is refused unless trusted
+	if _, err := (&http.Client{Transport: &Transport{}}).Get(url); err == nil {
+		t.Error("untrusted certificate was accepted")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	c := &http.Client{Transport: &Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := c.Post(url, "text/plain", bytes.NewReader([]byte("over TLS")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, _ := io.ReadAll(resp.Body); string(got) != "over TLS" || resp.Header.Get("X-Path") != "/secure" {
+		t.Errorf("got %q for %s", got, resp.Header.Get("X-Path"))
+	}
+}
+
+func TestTransportUpgrade(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		echoHandler(w, r)
+	})
+	url, ln := startServer(t, &server.Server{Handler: server.HTTPHandler(mux)})
+
+	// The first request goes out as HTTP/1.1 and is answered on stream 1,
+	// the next ones share the upgraded connection
+	c := &http.Client{Transport: &Transport{UpgradeH2C: true}}
+	for i := range 3 {
+		body := fmt.Sprintf("request %d", i)
+		resp, err := c.Post(url, "text/plain", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != body || resp.Proto != "HTTP/2.0" || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+			t.Errorf("request %d: got %q over %s, server saw %s", i, got, resp.Proto, resp.Header.Get("X-Proto"))
+		}
+	}
+	if got := ln.n.Load(); got != 1 {
+		t.Errorf("%d connections, want 1", got)
+	}
+
+	// A server that only speaks HTTP/1.1 answers the request itself
+	h1 := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer h1.Close()
+	resp, err := c.Post(h1.URL, "text/plain", bytes.NewReader([]byte("plain")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != "plain" || resp.Proto != "HTTP/1.1" {
+		t.Errorf("got %q over %s", got, resp.Proto)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Sum")
+		fmt.Fprintf(w, "%s sum=%q", body, r.Trailer.Get("X-Sum"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Sum", fmt.Sprint(len(body)))
+		w.Header().Set(http.TrailerPrefix+"X-Late", "undeclared")
+	})
+	url, _ := startServer(t, &server.Server{Handler: server.HTTPHandler(mux)})
+	c := &http.Client{Transport: &Transport{}}
+
+	for _, body := range []string{"with a body", ""} {
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		if body == "" {
+			req.Body = nil
+		}
+		req.Trailer = http.Header{"X-Sum": {"abc"}}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := body + ` sum="abc"`; string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		want := http.Header{"X-Sum": {fmt.Sprint(len(body))}, "X-Late": {"undeclared"}}
+		if fmt.Sprint(resp.Trailer) != fmt.Sprint(want) {
+			t.Errorf("got trailers %v, want %v", resp.Trailer, want)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	g := &server.GRPCServer{Fallback: server.HTTPHandler(http.HandlerFunc(echoHandler))}
+	g.Handle("/test.Echo/Echo", server.UnaryMethod(func(ctx context.Context, req []byte) ([]byte, error) {
+		if string(req) == "fail" {
+			return nil, grpc.Errorf(grpc.InvalidArgument, "100%% wrong")
+		}
+		return req, nil
+	}))
+	g.Handle("/test.Echo/Upper", func(stream *server.GRPCStream) error {
+		stream.SetTrailer(hpack.HeaderField{Name: "x-count", Value: "2"})
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(bytes.ToUpper(msg)); err != nil {
+				return err
+			}
+		}
+	})
+	g.Handle("/test.Echo/Sleep", func(stream *server.GRPCStream) error {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	})
+	url, ln := startServer(t, &server.Server{Handler: g})
+	// Without a RoundTripper the calls share the default Transport
+	c := &GRPCClient{Target: url}
+	ctx := context.Background()
+
+	if resp, err := c.Invoke(ctx, "/test.Echo/Echo", []byte("\x0a\x02hi")); err != nil || string(resp) != "\x0a\x02hi" {
+		t.Errorf("Echo: got %q, %v", resp, err)
+	}
+	// Empty messages are messages too
+	if resp, err := c.Invoke(ctx, "/test.Echo/Echo", nil); err != nil || len(resp) != 0 {
+		t.Errorf("empty Echo: got %q, %v", resp, err)
+	}
+
+	for _, tt := range []struct {
+		method, msg string
+		code        grpc.Code
+		message     string
+	}{
+		{"/test.Echo/Echo", "fail", grpc.InvalidArgument, "100% wrong"},
+		{"/test.Echo/Missing", "", grpc.Unimplemented, "unknown method /test.Echo/Missing"},
+	} {
+		_, err := c.Invoke(ctx, tt.method, []byte(tt.msg))
+		var s *grpc.Status
+		if !errors.As(err, &s) || s.Code != tt.code || s.Message != tt.message {
+			t.Errorf("%s(%q): got %v, want %s: %s", tt.method, tt.msg, err, tt.code, tt.message)
+		}
+	}
+
+	stream, err := c.NewStream(ctx, "/test.Echo/Upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stream.Send([]byte("a"))
+		stream.Send([]byte("b"))
+		stream.CloseSend()
+	}()
+	var got []string
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(msg))
+	}
+	if strings.Join(got, ",") != "A,B" || stream.Trailer().Get("X-Count") != "2" {
+		t.Errorf("Upper: got %q, trailer %v", got, stream.Trailer())
+	}
+
+	// The server ends the call at the deadline it got in grpc-timeout, if
+	// the client does not give up first
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Invoke(ctx, "/test.Echo/Sleep", nil); grpc.StatusOf(err).Code != grpc.DeadlineExceeded {
+		t.Errorf("Sleep: got %v, want DEADLINE_EXCEEDED", err)
+	}
+
+	if n := ln.n.Load(); n != 1 {
+		t.Errorf("%d connections for the calls, want 1", n)
+	}
+
+	// Everything else is left to the fallback
+	resp, err := (&http.Client{Transport: &Transport{}}).Post(url+"/plain", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hi" {
+		t.Errorf("fallback: got %q", body)
+	}
+}
+
+func TestFullDuplex(t *testing.T) {
+	// Each line is answered as soon as it arrives, while the request is
+	// still open
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			t.Error(err)
+		}
+		// RoundTrip returns once the response headers are in
+		rc.Flush()
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(bytes.ToUpper(buf[:n]))
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	g := &server.GRPCServer{Fallback: server.HTTPHandler(http.HandlerFunc(handler))}
+	g.Handle("/test.Echo/Chat", func(stream *server.GRPCStream) error {
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(append([]byte("re: "), msg...)); err != nil {
+				return err
+			}
+		}
+	})
+	url, _ := startServer(t, &server.Server{Handler: g})
+	tr := &Transport{}
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, url+"/", pr)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 64)
+	for _, line := range []string{"one", "two", "three"} {
+		pw.Write([]byte(line))
+		n, err := resp.Body.Read(buf)
+		if err != nil || string(buf[:n]) != strings.ToUpper(line) {
+			t.Fatalf("sent %q, got %q, %v", line, buf[:n], err)
+		}
+	}
+	pw.Close()
+	if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after the request ended", rest, err)
+	}
+
+	c := &GRPCClient{RoundTripper: tr, Target: url}
+	stream, err := c.NewStream(context.Background(), "/test.Echo/Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hi", "bye"} {
+		stream.Send([]byte(msg))
+		got, err := stream.Recv()
+		if err != nil || string(got) != "re: "+msg {
+			t.Fatalf("sent %q, got %q, %v", msg, got, err)
+		}
+	}
+	stream.CloseSend()
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v at the end of the call, want io.EOF", err)
+	}
+}
+
+// A Ping in flight returns when the connection dies under it.
+func TestPingClosedConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// A server that hangs up instead of answering the PING
+		c2, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c2.Close()
+		if _, err := io.ReadFull(c2, make([]byte, len(clientPreface))); err != nil {
+			return
+		}
+		fr := frame.NewFramer(c2, c2)
+		if err := fr.WriteFrame(&frame.SettingsFrame{}); err != nil {
+			return
+		}
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if ping, ok := f.(*frame.PingFrame); ok && !ping.Flags.Has(frame.FlagAck) {
+				return
+			}
+		}
+	}()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := (&Transport{}).NewClientConn(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cc.Ping(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Ping succeeded on a closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ping still waiting after the connection closed")
+	}
+}
+
+func TestTinyKeepalive(t *testing.T) {
+	url, _ := startServer(t, &server.Server{})
+	tr := &Transport{ReadIdleTimeout: 3}
+	resp, err := (&http.Client{Transport: tr}).Post(url, "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hi" {
+		t.Errorf("got %q", body)
+	}
+}
+
+// Pushed streams are refused, and whatever the server already sent on
+// them is dropped without harm to the connection.
+func TestRefusedPush(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		if err := w.(http.Pusher).Push("/style.css", nil); err != nil {
+			t.Errorf("push: %v", err)
+		}
+		// Let the pushed response go out before the client's RST_STREAM
+		// gets here
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "page")
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "css")
+	})
+	url, ln := startServer(t, &server.Server{Handler: server.HTTPHandler(mux)})
+	settings := DefaultSettings()
+	c := &http.Client{Transport: &Transport{Settings: &settings}}
+	for range 3 {
+		resp, err := c.Get(url + "/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "page" {
+			t.Errorf("got %q", body)
+		}
+	}
+	if n := ln.n.Load(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+// A dial that hangs holds up no other host, and requests to a host that
+// is being dialed share the one connection.
+func TestConcurrentDials(t *testing.T) {
+	url, ln := startServer(t, &server.Server{})
+	slowStarted, release := make(chan struct{}), make(chan struct{})
+	var dials atomic.Int32
+	tr := &Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "slow.invalid:80" {
+			close(slowStarted)
+			<-release
+			return nil, errors.New("slow host is down")
+		}
+		dials.Add(1)
+		// Let the other requests find the dial under way
+		time.Sleep(20 * time.Millisecond)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	c := &http.Client{Transport: tr}
+	slowErr := make(chan error, 1)
+	go func() {
+		_, err := c.Get("http://slow.invalid/")
+		slowErr <- err
+	}()
+	<-slowStarted
+
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Post(url, "text/plain", strings.NewReader(fmt.Sprint(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); string(body) != fmt.Sprint(i) {
+				t.Errorf("request %d got %q", i, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if d, n := dials.Load(), ln.n.Load(); d != 1 || n != 1 {
+		t.Errorf("%d dials, %d connections, want 1", d, n)
+	}
+	close(release)
+	if err := <-slowErr; err == nil {
+		t.Error("request to the slow host succeeded")
+	}
+}
+
+// HTTP/2 has no 101 Switching Protocols, so it cannot be a response.
+func TestSwitchingProtocolsStatus(t *testing.T) {
+	url, _ := startServer(t, &server.Server{Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "101"}}, false)
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, true)
+	})})
+	c := &http.Client{Transport: &Transport{}}
+	resp, err := c.Get(url)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("got %s", resp.Status)
+	}
+}
@@ -0,0 +1,533 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc9113#name-http-2-connection-preface
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const maxWindowSize = frame.MaxWindowSize
+
+var (
+	// errClientConnClosed is returned for requests on a closed connection.
+	errClientConnClosed = errors.New("client connection closed")
+	// errStreamNotProcessed means the server went away without looking at
+	// the stream, so the request can be retried on a new connection.
+	// https://datatracker.ietf.org/doc/html/rfc9113#section-6.8-6
+	errStreamNotProcessed = errors.New("stream not processed by the server")
+)
+
+// ClientConn is one HTTP/2 connection to a server. Any number of goroutines
+// can send requests on it at once; each gets its own stream.
+//
+// A single read loop owns the reading side of the connection and routes
+// every frame to the stream it belongs to. Writes come from the requests,
+// the read loop and the keepalive, so they hold wmu.
+type ClientConn struct {
+	t    *Transport
+	conn net.Conn
+	fr   *frame.Framer
+
+	// wmu serializes frame writes. HPACK encoding happens under it too,
+	// since header blocks must reach the server in the order they were
+	// encoded. Never acquire wmu while holding mu.
+	wmu     sync.Mutex
+	encoder *hpack.Encoder
+	hbuf    bytes.Buffer
+
+	// The read loop owns the decoder
+	decoder    *hpack.Decoder
+	localAcked bool
+
+	// mu guards everything below. cond is broadcast whenever a send window
+	// grows, a stream ends or the connection goes away.
+	mu   sync.Mutex
+	cond *sync.Cond
+	// local is what we advertised, peer what the server sent
+	local, peer Settings
+	// streams holds the open streams by ID; reserved counts the requests
+	// that have a slot below MAX_CONCURRENT_STREAMS but no ID yet.
+	streams      map[uint32]*clientStream
+	reserved     int
+	nextStreamID uint32
+	// maxPushID is the highest stream the server promised. Every pushed
+	// stream is refused, but frames it had in flight still arrive.
+	maxPushID uint32
+
+	// Flow control
+	// https://datatracker.ietf.org/doc/html/rfc9113#name-flow-control
+	// The connection windows start at 65535 whatever SETTINGS say.
+	connSend    int64
+	connRecv    int64
+	connUnacked int64
+
+	// After a GOAWAY no new streams are opened, and streams above
+	// lastStreamID were never processed by the server.
+	goneAway     bool
+	lastStreamID uint32
+	closed       bool
+	closeErr     error
+	// done is closed once closed is set, for waiters that cannot use cond
+	done chan struct{}
+
+	// ping is the keepalive state, see ping.go
+	ping pingState
+}
+
+// NewClientConn starts HTTP/2 on conn: it sends the preface and our
+// SETTINGS, waits for the server's SETTINGS and then starts reading.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-http-2-connection-preface
+func (t *Transport) NewClientConn(conn net.Conn) (*ClientConn, error) {
+	cc, err := t.newClientConn(conn, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := cc.start(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// newClientConn sets up a ClientConn that reads its frames from r, which
+// is conn unless something was read ahead of the frames (the 101 response
+// of an h2c upgrade). Nothing is sent yet.
+func (t *Transport) newClientConn(conn net.Conn, r io.Reader) (*ClientConn, error) {
+	local := t.settings()
+	if err := local.Validate(); err != nil {
+		return nil, err
+	}
+	cc := &ClientConn{
+		t:    t,
+		conn: conn,
+		fr:   frame.NewFramer(conn, r),
+		// Our HEADER_TABLE_SIZE only applies once the server has ACKed it
+		decoder:  hpack.NewDecoder(4096),
+		local:    local,
+		peer:     DefaultSettings(),
+		streams:  make(map[uint32]*clientStream),
+		done:     make(chan struct{}),
+		connSend: 65535,
+		connRecv: 65535,
+		// Stream 1 is the first stream a client can open
+		nextStreamID: 1,
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+	cc.fr.MaxReadFrameSize = local.MaxFrameSize
+	cc.encoder = hpack.NewEncoder(&cc.hbuf)
+	cc.ping.lastRead.Store(time.Now().UnixNano())
+	return cc, nil
+}
+
+// start sends the preface and our SETTINGS, waits for the server's
+// SETTINGS and then starts reading.
+func (cc *ClientConn) start() error {
+	if _, err := io.WriteString(cc.conn, clientPreface); err != nil {
+		return err
+	}
+	if err := cc.writeFrame(&frame.SettingsFrame{Settings: cc.local.Params()}); err != nil {
+		return err
+	}
+	cc.logf("✔ Sent preface and SETTINGS")
+	if err := cc.waitForSettings(); err != nil {
+		cc.goAway(err)
+		return err
+	}
+	cc.logf("✔ Received and acknowledged server SETTINGS")
+
+	go cc.readLoop()
+	if cc.t.ReadIdleTimeout > 0 {
+		go cc.keepalive(cc.t.ReadIdleTimeout, cc.t.pingTimeout())
+	}
+	return nil
+}
+
+func (cc *ClientConn) logf(format string, args ...any) {
+	cc.t.logf(format, args...)
+}
+
+// writeFrame sends one frame. Each frame goes out in a single conn.Write.
+func (cc *ClientConn) writeFrame(f frame.Frame) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	return cc.fr.WriteFrame(f)
+}
+
+// waitForSettings reads frames until the server's SETTINGS arrive, then
+// validates and acknowledges them. Requests sent afterwards respect them.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-settings-synchronization
+func (cc *ClientConn) waitForSettings() error {
+	for {
+		f, err := cc.fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		sf, ok := f.(*frame.SettingsFrame)
+		if !ok {
+			cc.logf("❓ Ignoring %s frame before SETTINGS", f.Header().Type)
+			continue
+		}
+		if sf.Flags.Has(frame.FlagAck) {
+			cc.handleSettingsAck()
+			continue
+		}
+
+		cc.logf("⚙️ SETTINGS frame from server:")
+		if err := cc.applySettings(&cc.peer, sf.Settings); err != nil {
+			return err
+		}
+		// Never use a bigger dynamic table than the server allows
+		cc.encoder.SetMaxDynamicTableSizeLimit(cc.peer.HeaderTableSize)
+		return cc.writeFrame(&frame.SettingsFrame{FrameHeader: frame.FrameHeader{Flags: frame.FlagAck}})
+	}
+}
+
+// CanTakeNewRequest reports whether a new request can still be sent on the
+// connection. It may have to wait for MAX_CONCURRENT_STREAMS.
+func (cc *ClientConn) CanTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return !cc.closed && !cc.goneAway && cc.nextStreamID <= maxStreamID
+}
+
+func (cc *ClientConn) idle() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.streams) == 0 && cc.reserved == 0
+}
+
+// Close sends GOAWAY and closes the connection. Requests in flight fail.
+func (cc *ClientConn) Close() error {
+	cc.writeFrame(&frame.GoAwayFrame{ErrCode: frame.ErrCodeNo})
+	return cc.conn.Close()
+}
+
+// goAway tells the server why we are giving up on the connection.
+func (cc *ClientConn) goAway(err error) {
+	var cerr frame.ConnectionError
+	if !errors.As(err, &cerr) {
+		return
+	}
+	cc.logf("❌ Error: %v, sending GOAWAY %s", err, cerr.Code)
+	cc.writeFrame(&frame.GoAwayFrame{ErrCode: cerr.Code, DebugData: []byte(cerr.Reason)})
+}
+
+// readLoop reads every frame the server sends until the connection breaks.
+// It then fails the streams still open.
+func (cc *ClientConn) readLoop() {
+	var err error
+	for {
+		var f frame.Frame
+		f, err = cc.readFrame()
+		var serr frame.StreamError
+		if errors.As(err, &serr) {
+			// Only the one stream is broken
+			if cs := cc.stream(serr.StreamID); cs != nil {
+				cs.resetStream(serr.Code, serr)
+			}
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if err = cc.handleFrame(f); err != nil {
+			break
+		}
+	}
+	cc.goAway(err)
+	if errors.Is(err, io.EOF) {
+		cc.logf("✅ Connection closed")
+		err = errClientConnClosed
+	}
+	cc.conn.Close()
+
+	cc.mu.Lock()
+	cc.closed = true
+	cc.closeErr = err
+	close(cc.done)
+	streams := make([]*clientStream, 0, len(cc.streams))
+	for _, cs := range cc.streams {
+		streams = append(streams, cs)
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	for _, cs := range streams {
+		cs.abort(err)
+	}
+}
+
+// readFrame reads the next frame. A HEADERS or PUSH_PROMISE frame without
+// END_HEADERS is joined with the CONTINUATION frames that follow it, so the
+// caller always sees a whole header block. Nothing else may arrive until
+// the block is complete.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-continuation
+func (cc *ClientConn) readFrame() (frame.Frame, error) {
+	f, err := cc.fr.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	cc.ping.lastRead.Store(time.Now().UnixNano())
+
+	var h *frame.FrameHeader
+	var block *[]byte
+	switch f := f.(type) {
+	case *frame.HeadersFrame:
+		if f.Flags.Has(frame.FlagPriority) {
+			cc.logf("📶 Priority on stream %d: %s", f.StreamID, f.Priority)
+		}
+		h, block = &f.FrameHeader, &f.BlockFragment
+	case *frame.PushPromiseFrame:
+		h, block = &f.FrameHeader, &f.BlockFragment
+	default:
+		return f, nil
+	}
+	if h.Flags.Has(frame.FlagEndHeaders) {
+		return f, nil
+	}
+
+	// The next read reuses the Framer's buffer, so keep our own copy
+	*block = bytes.Clone(*block)
+	for !h.Flags.Has(frame.FlagEndHeaders) {
+		next, err := cc.fr.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		cf, ok := next.(*frame.ContinuationFrame)
+		if !ok || cf.StreamID != h.StreamID {
+			return nil, frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: fmt.Sprintf("%s frame inside a header block", next.Header().Type)}
+		}
+		cc.logf("📎 CONTINUATION frame on stream %d (len=%d)", cf.StreamID, cf.Length)
+		*block = append(*block, cf.BlockFragment...)
+		h.Flags |= cf.Flags & frame.FlagEndHeaders
+	}
+	return f, nil
+}
+
+// handleFrame reacts to one frame from the server. An error ends the
+// connection.
+func (cc *ClientConn) handleFrame(f frame.Frame) error {
+	switch f := f.(type) {
+	case *frame.HeadersFrame:
+		return cc.handleHeaders(f)
+	case *frame.DataFrame:
+		return cc.handleData(f)
+	case *frame.RSTStreamFrame:
+		cc.logf("⛔️ RST_STREAM on stream %d: %s", f.StreamID, f.ErrCode)
+		if cs := cc.stream(f.StreamID); cs != nil {
+			cs.handleReset(f.ErrCode)
+		}
+		return nil
+	case *frame.SettingsFrame:
+		return cc.handleSettings(f)
+	case *frame.PushPromiseFrame:
+		return cc.handlePushPromise(f)
+	case *frame.PingFrame:
+		return cc.handlePing(f)
+	case *frame.GoAwayFrame:
+		cc.handleGoAway(f)
+		return nil
+	case *frame.WindowUpdateFrame:
+		return cc.handleWindowUpdate(f)
+	case *frame.ContinuationFrame:
+		// readFrame consumes every CONTINUATION that follows a header block
+		return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: "CONTINUATION outside a header block"}
+	default:
+		// PRIORITY and unknown frames are ignored
+		cc.logf("❓ %s", f.Header())
+		return nil
+	}
+}
+
+// stream returns the open stream with the given ID, or nil.
+func (cc *ClientConn) stream(id uint32) *clientStream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.streams[id]
+}
+
+// checkStreamID rejects frames on streams that are still idle. Frames on
+// streams that ended a moment ago, or pushed streams we refused, are fine
+// and get ignored.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-5.4.2-2
+func (cc *ClientConn) checkStreamID(h frame.FrameHeader) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	idle := h.StreamID >= cc.nextStreamID
+	if h.StreamID%2 == 0 {
+		idle = h.StreamID > cc.maxPushID
+	}
+	if idle {
+		return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: fmt.Sprintf("%s on idle stream %d", h.Type, h.StreamID)}
+	}
+	return nil
+}
+
+func (cc *ClientConn) handleSettings(f *frame.SettingsFrame) error {
+	if f.Flags.Has(frame.FlagAck) {
+		cc.handleSettingsAck()
+		return nil
+	}
+
+	cc.logf("⚙️ SETTINGS frame from server:")
+	cc.mu.Lock()
+	oldWindow := int64(cc.peer.InitialWindowSize)
+	err := cc.applySettings(&cc.peer, f.Settings)
+	// A new INITIAL_WINDOW_SIZE shifts the window of every open stream
+	// https://datatracker.ietf.org/doc/html/rfc9113#section-6.9.2-3
+	delta := int64(cc.peer.InitialWindowSize) - oldWindow
+	for _, cs := range cc.streams {
+		cs.sendWindow += delta
+		if cs.sendWindow > maxWindowSize {
+			err = frame.ConnectionError{Code: frame.ErrCodeFlowControl, Reason: "stream window overflow"}
+		}
+	}
+	tableSize := cc.peer.HeaderTableSize
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	cc.wmu.Lock()
+	cc.encoder.SetMaxDynamicTableSizeLimit(tableSize)
+	cc.wmu.Unlock()
+	return cc.writeFrame(&frame.SettingsFrame{FrameHeader: frame.FrameHeader{Flags: frame.FlagAck}})
+}
+
+// handleSettingsAck lets the server's encoder use our HEADER_TABLE_SIZE.
+func (cc *ClientConn) handleSettingsAck() {
+	cc.logf("⚙️ SETTINGS ACK")
+	if !cc.localAcked {
+		cc.localAcked = true
+		cc.decoder.SetAllowedMaxDynamicTableSize(cc.local.HeaderTableSize)
+	}
+}
+
+// handlePushPromise refuses pushed streams. The header block is decoded
+// all the same to keep the HPACK tables in sync. With push disabled a
+// PUSH_PROMISE is a connection error.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-6.6-9
+func (cc *ClientConn) handlePushPromise(f *frame.PushPromiseFrame) error {
+	if !cc.local.EnablePush {
+		return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: "PUSH_PROMISE with push disabled"}
+	}
+	if err := cc.checkStreamID(f.FrameHeader); err != nil {
+		return err
+	}
+	// Promised streams must be new server streams
+	// https://datatracker.ietf.org/doc/html/rfc9113#section-6.6-4
+	cc.mu.Lock()
+	valid := f.PromisedStreamID%2 == 0 && f.PromisedStreamID > cc.maxPushID
+	if valid {
+		cc.maxPushID = f.PromisedStreamID
+	}
+	cc.mu.Unlock()
+	if !valid {
+		return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: fmt.Sprintf("PUSH_PROMISE for stream %d", f.PromisedStreamID)}
+	}
+	fields, err := cc.decodeHeaders(f.BlockFragment)
+	if err != nil {
+		return err
+	}
+	cc.logf("📬 PUSH_PROMISE on stream %d promises stream %d: %v, refusing it", f.StreamID, f.PromisedStreamID, fields)
+	return cc.writeFrame(&frame.RSTStreamFrame{
+		FrameHeader: frame.FrameHeader{StreamID: f.PromisedStreamID},
+		ErrCode:     frame.ErrCodeCancel,
+	})
+}
+
+func (cc *ClientConn) handleGoAway(f *frame.GoAwayFrame) {
+	cc.logf("👋 GOAWAY: last stream %d, %s, debug data %q", f.LastStreamID, f.ErrCode, f.DebugData)
+	cc.mu.Lock()
+	cc.goneAway = true
+	cc.lastStreamID = f.LastStreamID
+	var unprocessed []*clientStream
+	for id, cs := range cc.streams {
+		if id > f.LastStreamID {
+			unprocessed = append(unprocessed, cs)
+		}
+	}
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	// The server never looked at these requests
+	for _, cs := range unprocessed {
+		cc.logf("🔁 Stream %d was not processed and can be retried on a new connection", cs.id)
+		cs.abort(errStreamNotProcessed)
+	}
+}
+
+func (cc *ClientConn) handleWindowUpdate(f *frame.WindowUpdateFrame) error {
+	cc.logf("🪟 WINDOW_UPDATE on stream %d: +%d", f.StreamID, f.Increment)
+	if f.Increment == 0 {
+		if f.StreamID == 0 {
+			return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: "WINDOW_UPDATE with 0 increment"}
+		}
+		if cs := cc.stream(f.StreamID); cs != nil {
+			cs.resetStream(frame.ErrCodeProtocol, errors.New("WINDOW_UPDATE with 0 increment"))
+		}
+		return nil
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	window := &cc.connSend
+	if f.StreamID != 0 {
+		cs := cc.streams[f.StreamID]
+		if cs == nil {
+			return nil
+		}
+		window = &cs.sendWindow
+	}
+	*window += int64(f.Increment)
+	if *window > maxWindowSize {
+		return frame.ConnectionError{Code: frame.ErrCodeFlowControl, Reason: "window overflow"}
+	}
+	cc.cond.Broadcast()
+	return nil
+}
+
+// encodeHeaders HPACK encodes fields with the connection's encoder. The
+// caller holds wmu.
+func (cc *ClientConn) encodeHeaders(fields []hpack.HeaderField) []byte {
+	cc.hbuf.Reset()
+	for _, f := range fields {
+		cc.encoder.WriteField(f)
+	}
+	return cc.hbuf.Bytes()
+}
+
+// decodeHeaders decodes a header block with the connection's decoder. Any
+// failure leaves the dynamic table out of sync, so it is fatal.
+func (cc *ClientConn) decodeHeaders(block []byte) ([]hpack.HeaderField, error) {
+	fields, err := cc.decoder.DecodeFull(block)
+	if err != nil {
+		return nil, frame.ConnectionError{Code: frame.ErrCodeCompression, Reason: err.Error()}
+	}
+	return fields, nil
+}
+
+// returnConnWindow gives n received bytes back to the server with a
+// connection WINDOW_UPDATE once half the window has been consumed.
+func (cc *ClientConn) returnConnWindow(n int64) error {
+	cc.mu.Lock()
+	cc.connUnacked += n
+	increment := cc.connUnacked
+	if increment < 65535/2 {
+		cc.mu.Unlock()
+		return nil
+	}
+	cc.connRecv += increment
+	cc.connUnacked = 0
+	cc.mu.Unlock()
+	return cc.writeFrame(&frame.WindowUpdateFrame{Increment: uint32(increment)})
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/grpc"
+)
+
+// GRPCClient calls gRPC methods on one server with the raw message bytes,
+// usually encoded protobufs, instead of generated stubs.
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+//
+//	c := &client.GRPCClient{RoundTripper: &client.Transport{}, Target: "http://localhost:8080"}
+//	resp, err := c.Invoke(ctx, "/helloworld.Greeter/SayHello", req)
+type GRPCClient struct {
+	// RoundTripper carries the calls, a Transport or a ClientConn. If nil,
+	// defaultTransport is used.
+	RoundTripper http.RoundTripper
+
+	// Target is the URL of the server, e.g. "http://localhost:8080". The
+	// method name is appended to it.
+	Target string
+
+	// MaxMessageSize is the largest response message accepted,
+	// grpc.DefaultMaxMessageSize if zero.
+	MaxMessageSize int
+}
+
+// defaultTransport carries the calls of every GRPCClient without a
+// RoundTripper, so that they share its connections.
+var defaultTransport = &Transport{}
+
+// Invoke calls a unary method: it sends req as the only request message
+// and returns the only response message. A call that does not end with OK
+// returns a *grpc.Status error.
+func (c *GRPCClient) Invoke(ctx context.Context, method string, req []byte) ([]byte, error) {
+	stream, err := c.NewStream(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.cancel()
+	// If the call ended early, Recv says why
+	stream.Send(req)
+	stream.CloseSend()
+	resp, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return nil, grpc.Errorf(grpc.Internal, "no response message")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		if err == nil {
+			err = grpc.Errorf(grpc.Internal, "more than one response message for a unary method")
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// NewStream starts a call to a streaming method, or any other. ctx bounds
+// the whole call: its deadline is sent as grpc-timeout and the stream is
+// reset when it ends. Read until Recv fails, or cancel ctx, to release the
+// stream.
+func (c *GRPCClient) NewStream(ctx context.Context, method string) (*GRPCStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.Target, "/")+method, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", grpc.ContentType)
+	// gRPC cannot do without trailers, which intermediaries must keep
+	req.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", grpc.EncodeTimeout(time.Until(deadline)))
+	}
+
+	s := &GRPCStream{
+		ctx:     ctx,
+		cancel:  cancel,
+		pw:      pw,
+		maxSize: c.MaxMessageSize,
+		ready:   make(chan struct{}),
+	}
+	rt := c.RoundTripper
+	if rt == nil {
+		rt = defaultTransport
+	}
+	// RoundTrip returns once the response headers arrive, which may take
+	// until the request messages have all been sent
+	go func() {
+		s.resp, s.err = rt.RoundTrip(req)
+		close(s.ready)
+	}()
+	return s, nil
+}
+
+// GRPCStream is one call from the client's side. Send and Recv may be
+// used from different goroutines.
+type GRPCStream struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pw      *io.PipeWriter
+	maxSize int
+
+	// ready is closed once RoundTrip has returned resp or err
+	ready chan struct{}
+	resp  *http.Response
+	err   error
+	// status is set once Recv has seen the end of the call
+	status *grpc.Status
+}
+
+// Send sends one request message. It returns io.EOF if the call is
+// already over; Recv then returns its status.
+func (s *GRPCStream) Send(msg []byte) error {
+	if _, err := s.pw.Write(grpc.AppendMessage(nil, msg)); err != nil {
+		return io.EOF
+	}
+	return nil
+}
+
+// CloseSend ends the request after the messages sent so far.
+func (s *GRPCStream) CloseSend() error {
+	return s.pw.Close()
+}
+
+// Header waits for the response headers and returns them.
+func (s *GRPCStream) Header() (http.Header, error) {
+	<-s.ready
+	if s.err != nil {
+		return nil, s.end(s.transportStatus(s.err))
+	}
+	return s.resp.Header, nil
+}
+
+// Trailer returns the trailers of the call once Recv has returned an
+// error.
+func (s *GRPCStream) Trailer() http.Header {
+	if s.status == nil || s.resp == nil {
+		return nil
+	}
+	return s.resp.Trailer
+}
+
+// Recv returns the next response message. After the last one it returns
+// io.EOF if the call ended with OK, and a *grpc.Status error otherwise.
+func (s *GRPCStream) Recv() ([]byte, error) {
+	if s.status != nil {
+		return nil, s.result()
+	}
+	header, err := s.Header()
+	if err != nil {
+		return nil, err
+	}
+	if s.resp.StatusCode != http.StatusOK {
+		if status, ok := statusFrom(header); ok {
+			return nil, s.end(status)
+		}
+		return nil, s.end(&grpc.Status{Code: grpc.HTTPStatusCode(s.resp.StatusCode), Message: "HTTP status " + s.resp.Status})
+	}
+	if status, ok := statusFrom(header); ok {
+		// Trailers-Only
+		return nil, s.end(status)
+	}
+	if ct := header.Get("Content-Type"); !grpc.IsContentType(ct) {
+		return nil, s.end(&grpc.Status{Code: grpc.Unknown, Message: fmt.Sprintf("unexpected content-type %q", ct)})
+	}
+
+	msg, err := grpc.ReadMessage(s.resp.Body, s.maxSize)
+	switch {
+	case err == nil:
+		return msg, nil
+	case errors.Is(err, io.EOF):
+		status, ok := statusFrom(s.resp.Trailer)
+		if !ok {
+			status = &grpc.Status{Code: grpc.Internal, Message: "response ended without grpc-status"}
+		}
+		return nil, s.end(status)
+	}
+	var status *grpc.Status
+	if !errors.As(err, &status) {
+		status = s.transportStatus(err)
+	}
+	return nil, s.end(status)
+}
+
+// end records how the call ended and releases the stream.
+func (s *GRPCStream) end(status *grpc.Status) error {
+	if s.status == nil {
+		s.status = status
+		if s.resp != nil {
+			s.resp.Body.Close()
+		}
+		s.pw.CloseWithError(io.EOF)
+		s.cancel()
+	}
+	return s.result()
+}
+
+func (s *GRPCStream) result() error {
+	if s.status.Code == grpc.OK {
+		return io.EOF
+	}
+	return s.status
+}
+
+// transportStatus is the status of a call that failed below gRPC. An
+// ended context says best what happened.
+func (s *GRPCStream) transportStatus(err error) *grpc.Status {
+	if ctxErr := s.ctx.Err(); ctxErr != nil && s.status == nil {
+		return grpc.StatusOf(ctxErr)
+	}
+	return &grpc.Status{Code: grpc.Unavailable, Message: err.Error()}
+}
+
+// statusFrom reads grpc-status and grpc-message.
+func statusFrom(h http.Header) (*grpc.Status, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		return nil, false
+	}
+	code, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return &grpc.Status{Code: grpc.Internal, Message: "malformed grpc-status " + strconv.Quote(v)}, true
+	}
+	return &grpc.Status{Code: grpc.Code(code), Message: grpc.DecodeMessage(h.Get("Grpc-Message"))}, true
+}
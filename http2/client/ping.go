@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// PING
+// https://datatracker.ietf.org/doc/html/rfc9113#name-ping
+//
+// The receiver of a PING sends its 8 bytes of opaque data straight back
+// with the ACK flag, so a PING measures the round-trip time and shows the
+// peer is still alive.
+
+// defaultPingTimeout is used when Transport.PingTimeout is zero.
+const defaultPingTimeout = 15 * time.Second
+
+// minKeepaliveTick keeps the keepalive ticker from spinning, or panicking
+// on a zero interval, when the timeout is tiny.
+const minKeepaliveTick = time.Millisecond
+
+// pingState is shared between the goroutines that send PINGs and the read
+// loop, which sees the ACKs.
+type pingState struct {
+	// lastRead is the time the last frame arrived in Unix nanoseconds
+	lastRead atomic.Int64
+
+	mu sync.Mutex
+	// waiting maps the data of every PING in flight to a channel that is
+	// closed when its ACK arrives
+	waiting map[[8]byte]chan struct{}
+}
+
+// Ping sends a PING and waits for its ACK. It returns the round-trip time,
+// or the connection's error if it closes first.
+func (cc *ClientConn) Ping(ctx context.Context) (time.Duration, error) {
+	var data [8]byte
+	rand.Read(data[:])
+	acked := make(chan struct{})
+
+	p := &cc.ping
+	p.mu.Lock()
+	if p.waiting == nil {
+		p.waiting = make(map[[8]byte]chan struct{})
+	}
+	p.waiting[data] = acked
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, data)
+		p.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := cc.writeFrame(&frame.PingFrame{Data: data}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-acked:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-cc.done:
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return 0, cc.closeErr
+	}
+}
+
+// handlePing answers a PING from the server, or hands the ACK of one of
+// ours to the Ping waiting for it.
+func (cc *ClientConn) handlePing(f *frame.PingFrame) error {
+	if !f.Flags.Has(frame.FlagAck) {
+		cc.logf("🏓 PING %x, sending ACK", f.Data)
+		return cc.writeFrame(&frame.PingFrame{FrameHeader: frame.FrameHeader{Flags: frame.FlagAck}, Data: f.Data})
+	}
+
+	p := &cc.ping
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if acked, ok := p.waiting[f.Data]; ok {
+		close(acked)
+		delete(p.waiting, f.Data)
+	}
+	return nil
+}
+
+// keepalive sends a PING whenever nothing has been read for idleTimeout
+// and closes the connection if the ACK is not back within pingTimeout.
+// It returns once the connection is closed.
+func (cc *ClientConn) keepalive(idleTimeout, pingTimeout time.Duration) {
+	ticker := time.NewTicker(max(idleTimeout/4, minKeepaliveTick))
+	defer ticker.Stop()
+	for range ticker.C {
+		cc.mu.Lock()
+		closed := cc.closed
+		cc.mu.Unlock()
+		if closed {
+			return
+		}
+		if time.Since(time.Unix(0, cc.ping.lastRead.Load())) < idleTimeout {
+			continue
+		}
+
+		cc.logf("🏓 Connection idle, sending keepalive PING")
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		rtt, err := cc.Ping(ctx)
+		cancel()
+		if err != nil {
+			cc.logf("💀 No PING ACK within %v, closing the connection", pingTimeout)
+			cc.conn.Close()
+			return
+		}
+		cc.logf("🏓 Keepalive PING ACK after %v", rtt)
+	}
+}
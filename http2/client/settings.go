@@ -0,0 +1,28 @@
+package client
+
+import "github.com/nethish/fromscratch/http2/frame"
+
+// Settings holds the value of every SETTINGS parameter for one side of a
+// connection.
+type Settings = frame.Settings
+
+// DefaultSettings returns the initial values every endpoint assumes until
+// its peer's SETTINGS frame says otherwise.
+func DefaultSettings() Settings {
+	return frame.DefaultSettings()
+}
+
+// applySettings validates the server's SETTINGS and stores them in peer.
+// Only clients may enable push.
+func (cc *ClientConn) applySettings(peer *Settings, params []frame.Setting) error {
+	for _, p := range params {
+		cc.logf("  %s", p)
+		if p.ID == frame.SettingEnablePush && p.Val == 1 {
+			return frame.ConnectionError{Code: frame.ErrCodeProtocol, Reason: "server sent ENABLE_PUSH 1"}
+		}
+		if err := peer.Set(p.ID, p.Val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
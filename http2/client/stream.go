@@ -0,0 +1,738 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+	"github.com/nethish/fromscratch/http2/internal/pipe"
+)
+
+// maxStreamID is the largest stream ID. A connection that used it up has
+// to be replaced.
+const maxStreamID = 1<<31 - 1
+
+// bodyChunkSize is how much of a request body is read at a time.
+const bodyChunkSize = frame.MinMaxFrameSize
+
+var (
+	errClosedBody      = errors.New("read on closed response body")
+	errRequestCanceled = errors.New("response body closed before the end")
+)
+
+// clientStream is one request and its response.
+type clientStream struct {
+	cc  *ClientConn
+	id  uint32
+	req *http.Request
+
+	// respc receives the response once its HEADERS arrive. done is closed
+	// when the stream is over; err then says why, nil if all went well.
+	respc chan *http.Response
+	done  chan struct{}
+	body  *pipe.Pipe
+	// stopCtx stops resetting the stream when the request's context ends
+	stopCtx func() bool
+
+	// The read loop owns resp once it has been handed out; trailers are
+	// added to resp.Trailer before the body reports io.EOF
+	resp *http.Response
+
+	// Guarded by cc.mu
+	err         error
+	finished    bool
+	sentEnd     bool
+	recvEnd     bool
+	sendWindow  int64
+	recvWindow  int64
+	recvUnacked int64
+}
+
+// RoundTrip sends req on a new stream and returns the response as soon as
+// its headers arrive. The request body is sent in the background, so the
+// server can answer before it has read all of it.
+func (cc *ClientConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	cs, err := cc.newStream(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if hasBody(req) || hasTrailers(req) {
+		go cs.writeBody()
+	}
+	return cs.awaitResponse()
+}
+
+// awaitResponse waits for the response HEADERS, or for the stream to fail
+// before they arrive.
+func (cs *clientStream) awaitResponse() (*http.Response, error) {
+	select {
+	case resp := <-cs.respc:
+		return resp, nil
+	case <-cs.done:
+		// A response without a body ends the stream right away
+		select {
+		case resp := <-cs.respc:
+			return resp, nil
+		default:
+		}
+		return nil, cs.err
+	}
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// hasTrailers reports whether a HEADERS frame with req.Trailer follows the
+// body.
+func hasTrailers(req *http.Request) bool {
+	return len(req.Trailer) > 0
+}
+
+// newStream waits until MAX_CONCURRENT_STREAMS allows another stream, then
+// opens one with the request's HEADERS. IDs are handed out under wmu, so
+// the streams are opened in increasing order as RFC 9113 requires.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-5.1.1-2
+func (cc *ClientConn) newStream(req *http.Request) (*clientStream, error) {
+	fields, err := requestHeaders(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := req.Context()
+	wake := context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+	})
+	defer wake()
+
+	cc.mu.Lock()
+	for {
+		if cc.closed || cc.goneAway || cc.nextStreamID > maxStreamID {
+			cc.mu.Unlock()
+			return nil, errStreamNotProcessed
+		}
+		if err := ctx.Err(); err != nil {
+			cc.mu.Unlock()
+			return nil, err
+		}
+		if uint32(len(cc.streams)+cc.reserved) < cc.peer.MaxConcurrentStreams {
+			break
+		}
+		cc.cond.Wait()
+	}
+	cc.reserved++
+	cc.mu.Unlock()
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.mu.Lock()
+	cc.reserved--
+	if cc.closed || cc.goneAway {
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+		return nil, errStreamNotProcessed
+	}
+	cs := &clientStream{
+		cc:         cc,
+		id:         cc.nextStreamID,
+		req:        req,
+		respc:      make(chan *http.Response, 1),
+		done:       make(chan struct{}),
+		body:       pipe.New(),
+		sentEnd:    !hasBody(req) && !hasTrailers(req),
+		sendWindow: int64(cc.peer.InitialWindowSize),
+		recvWindow: int64(cc.local.InitialWindowSize),
+	}
+	cc.nextStreamID += 2
+	cc.streams[cs.id] = cs
+	maxFrameSize := int(cc.peer.MaxFrameSize)
+	// Set under cc.mu, which finish holds to stop it
+	cs.stopCtx = context.AfterFunc(ctx, func() {
+		cs.resetStream(frame.ErrCodeCancel, ctx.Err())
+	})
+	cc.mu.Unlock()
+
+	cc.logf("➡️ Stream %d: %s %s", cs.id, req.Method, req.URL)
+	if err := cc.writeHeaders(cs.id, fields, cs.sentEnd, maxFrameSize); err != nil {
+		cs.abort(err)
+		return nil, err
+	}
+	return cs, nil
+}
+
+// requestHeaders turns req into header fields: the pseudo-header fields
+// that replace the HTTP/1.1 request line, then the regular fields in
+// lowercase. Connection-specific fields have no meaning in HTTP/2.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-request-pseudo-header-field
+// https://datatracker.ietf.org/doc/html/rfc9113#name-connection-specific-header-
+func requestHeaders(req *http.Request) ([]hpack.HeaderField, error) {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	authority := req.Host
+	if authority == "" {
+		authority = req.URL.Host
+	}
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	fields := []hpack.HeaderField{{Name: ":method", Value: method}}
+	if method == http.MethodConnect {
+		// CONNECT only names the host to tunnel to
+		fields = append(fields, hpack.HeaderField{Name: ":authority", Value: authority})
+	} else {
+		fields = append(fields,
+			hpack.HeaderField{Name: ":scheme", Value: scheme},
+			hpack.HeaderField{Name: ":authority", Value: authority},
+			hpack.HeaderField{Name: ":path", Value: req.URL.RequestURI()},
+		)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		lower := strings.ToLower(name)
+		switch lower {
+		case "host", "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "content-length":
+			continue
+		}
+		for _, v := range req.Header[name] {
+			if strings.ContainsAny(v, "\r\n\x00") {
+				return nil, fmt.Errorf("invalid value for header %s", name)
+			}
+			// TE may only say that trailers are welcome
+			if lower == "te" && v != "trailers" {
+				continue
+			}
+			fields = append(fields, hpack.HeaderField{Name: lower, Value: v})
+		}
+	}
+	if req.ContentLength > 0 {
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.FormatInt(req.ContentLength, 10)})
+	}
+	if hasTrailers(req) {
+		// Announce the trailers, as HTTP/1.1 does
+		names := slices.Sorted(maps.Keys(req.Trailer))
+		fields = append(fields, hpack.HeaderField{Name: "trailer", Value: strings.Join(names, ", ")})
+	}
+	return fields, nil
+}
+
+// trailerFields turns req.Trailer into header fields. Its values are only
+// final once the body has been read.
+func trailerFields(trailer http.Header) ([]hpack.HeaderField, error) {
+	var fields []hpack.HeaderField
+	for _, name := range slices.Sorted(maps.Keys(trailer)) {
+		for _, v := range trailer[name] {
+			if strings.ContainsAny(v, "\r\n\x00") {
+				return nil, fmt.Errorf("invalid value for trailer %s", name)
+			}
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	return fields, nil
+}
+
+// writeHeaders encodes fields and writes them as one HEADERS frame, split
+// into CONTINUATION frames when the block is bigger than the server's
+// MAX_FRAME_SIZE; only the last one carries END_HEADERS. The caller holds
+// wmu, so nothing can come between the frames of a block.
+func (cc *ClientConn) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool, maxFrameSize int) error {
+	headerBlock := cc.encodeHeaders(fields)
+
+	// Only the HEADERS frame can be padded
+	flags, padLength := cc.padding()
+	if endStream {
+		flags |= frame.FlagEndStream
+	}
+	n := min(len(headerBlock), maxFrameSize-cc.padOverhead())
+	fragment, headerBlock := headerBlock[:n], headerBlock[n:]
+	if len(headerBlock) == 0 {
+		flags |= frame.FlagEndHeaders
+	}
+	err := cc.fr.WriteFrame(&frame.HeadersFrame{
+		FrameHeader:   frame.FrameHeader{Flags: flags, StreamID: streamID},
+		PadLength:     padLength,
+		BlockFragment: fragment,
+	})
+	for err == nil && len(headerBlock) > 0 {
+		n := min(len(headerBlock), maxFrameSize)
+		fragment, headerBlock = headerBlock[:n], headerBlock[n:]
+		var flags frame.Flags
+		if len(headerBlock) == 0 {
+			flags = frame.FlagEndHeaders
+		}
+		err = cc.fr.WriteFrame(&frame.ContinuationFrame{
+			FrameHeader:   frame.FrameHeader{Flags: flags, StreamID: streamID},
+			BlockFragment: fragment,
+		})
+	}
+	return err
+}
+
+// padding returns the PADDED flag and Pad Length for Transport.Padding.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-10.7
+func (cc *ClientConn) padding() (frame.Flags, uint8) {
+	if cc.t.Padding == 0 {
+		return 0, 0
+	}
+	return frame.FlagPadded, cc.t.Padding
+}
+
+// padOverhead is how many bytes padding adds to a frame.
+func (cc *ClientConn) padOverhead() int {
+	if cc.t.Padding == 0 {
+		return 0
+	}
+	return 1 + int(cc.t.Padding)
+}
+
+// writeBody sends the request body as DATA frames, the last one with
+// END_STREAM. If the body cannot be read the stream is cancelled.
+func (cs *clientStream) writeBody() {
+	err := cs.writeBodyFrames()
+	closeBody(cs.req)
+	if err != nil {
+		cs.resetStream(frame.ErrCodeCancel, err)
+	}
+}
+
+func (cs *clientStream) writeBodyFrames() error {
+	cc := cs.cc
+	body := cs.req.Body
+	if body == nil {
+		// Only trailers to send
+		body = http.NoBody
+	}
+	buf := make([]byte, bodyChunkSize)
+	for {
+		n, err := body.Read(buf)
+		eof := errors.Is(err, io.EOF)
+		if err != nil && !eof {
+			return err
+		}
+		data := buf[:n]
+		for len(data) > 0 || eof {
+			chunk, err := cs.awaitSendWindow(len(data))
+			if err != nil {
+				return err
+			}
+			last := eof && chunk == len(data)
+			// With trailers it is their HEADERS frame that ends the stream
+			end := last && !hasTrailers(cs.req)
+			if chunk > 0 || end {
+				if err := cc.writeFrame(cs.dataFrame(data[:chunk], end)); err != nil {
+					return err
+				}
+			}
+			data = data[chunk:]
+			if last {
+				if !end {
+					if err := cs.writeTrailers(); err != nil {
+						return err
+					}
+				}
+				cs.endSide(true)
+				return nil
+			}
+		}
+	}
+}
+
+// writeTrailers ends the request with a HEADERS frame carrying
+// req.Trailer.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-2.4
+func (cs *clientStream) writeTrailers() error {
+	fields, err := trailerFields(cs.req.Trailer)
+	if err != nil {
+		return err
+	}
+	cc := cs.cc
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.mu.Lock()
+	maxFrameSize := int(cc.peer.MaxFrameSize)
+	cc.mu.Unlock()
+	cc.logf("➡️ Stream %d: sending %d trailers", cs.id, len(fields))
+	return cc.writeHeaders(cs.id, fields, true, maxFrameSize)
+}
+
+// dataFrame builds a DATA frame. Empty frames are never padded, so they
+// need no window.
+func (cs *clientStream) dataFrame(data []byte, endStream bool) *frame.DataFrame {
+	var flags frame.Flags
+	var padLength uint8
+	if len(data) > 0 {
+		flags, padLength = cs.cc.padding()
+	}
+	if endStream {
+		flags |= frame.FlagEndStream
+	}
+	return &frame.DataFrame{
+		FrameHeader: frame.FrameHeader{Flags: flags, StreamID: cs.id},
+		PadLength:   padLength,
+		Data:        data,
+	}
+}
+
+// awaitSendWindow blocks until the connection and stream send windows have
+// room for some of want bytes, takes it and returns how many bytes to send.
+// Padding uses up window like the data itself.
+func (cs *clientStream) awaitSendWindow(want int) (int, error) {
+	cc := cs.cc
+	pad := int64(cc.padOverhead())
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for {
+		if cs.finished {
+			// The server answered and reset the stream, or it failed
+			return 0, errors.New("stream ended before the request body was sent")
+		}
+		if cc.closed {
+			return 0, cc.closeErr
+		}
+		if want == 0 {
+			return 0, nil
+		}
+		n := min(int64(want), min(int64(cc.peer.MaxFrameSize), cc.connSend, cs.sendWindow)-pad)
+		if n > 0 {
+			cc.connSend -= n + pad
+			cs.sendWindow -= n + pad
+			return int(n), nil
+		}
+		cc.logf("⏳ Stream %d: flow-control window exhausted (connection=%d, stream=%d), waiting for WINDOW_UPDATE", cs.id, cc.connSend, cs.sendWindow)
+		cc.cond.Wait()
+	}
+}
+
+// handleHeaders reads the response's HEADERS. Informational 1xx responses
+// are skipped; a block after the response is only allowed as trailers
+// ending the stream.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-http-message-framing
+func (cc *ClientConn) handleHeaders(f *frame.HeadersFrame) error {
+	if err := cc.checkStreamID(f.FrameHeader); err != nil {
+		return err
+	}
+	// Decode even for a stream that is gone, to keep HPACK in sync
+	fields, err := cc.decodeHeaders(f.BlockFragment)
+	if err != nil {
+		return err
+	}
+	cc.logf("📦 HEADERS frame on stream %d:", f.StreamID)
+	for _, hf := range fields {
+		cc.logf("  %s: %s", hf.Name, hf.Value)
+	}
+	cs := cc.stream(f.StreamID)
+	if cs == nil {
+		return nil
+	}
+	endStream := f.Flags.Has(frame.FlagEndStream)
+
+	if cs.resp != nil {
+		if !endStream {
+			cs.resetStream(frame.ErrCodeProtocol, errors.New("HEADERS in the middle of the response body"))
+			return nil
+		}
+		// Trailers, visible in resp.Trailer once the body is read to the end
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-14
+		for _, hf := range fields {
+			if strings.HasPrefix(hf.Name, ":") {
+				cs.resetStream(frame.ErrCodeProtocol, fmt.Errorf("pseudo-header %s in trailers", hf.Name))
+				return nil
+			}
+		}
+		if len(fields) > 0 && cs.resp.Trailer == nil {
+			cs.resp.Trailer = make(http.Header)
+		}
+		for _, hf := range fields {
+			cs.resp.Trailer.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+		}
+		cs.endResponse()
+		return nil
+	}
+	resp, err := cs.newResponse(fields)
+	if err != nil {
+		cs.resetStream(frame.ErrCodeProtocol, err)
+		return nil
+	}
+	if resp == nil {
+		if endStream {
+			cs.resetStream(frame.ErrCodeProtocol, errors.New("END_STREAM on an informational response"))
+		}
+		return nil
+	}
+	cs.resp = resp
+	if endStream {
+		resp.ContentLength = 0
+	}
+	cs.respc <- resp
+	if endStream {
+		cs.endResponse()
+	}
+	return nil
+}
+
+// newResponse builds the http.Response from its header fields, or returns
+// nil for an informational 1xx response.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-response-pseudo-header-fie
+func (cs *clientStream) newResponse(fields []hpack.HeaderField) (*http.Response, error) {
+	status := ""
+	header := make(http.Header)
+	for _, hf := range fields {
+		if strings.HasPrefix(hf.Name, ":") {
+			if hf.Name != ":status" || status != "" || len(header) > 0 {
+				return nil, fmt.Errorf("unexpected pseudo-header %s", hf.Name)
+			}
+			status = hf.Value
+			continue
+		}
+		header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 100 || code > 999 {
+		return nil, fmt.Errorf("invalid :status %q", status)
+	}
+	if code == http.StatusSwitchingProtocols {
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-8.6
+		return nil, errors.New("101 Switching Protocols in HTTP/2")
+	}
+	if code < 200 {
+		return nil, nil
+	}
+
+	// Announced trailers are there from the start, without a value until
+	// they arrive
+	var trailer http.Header
+	for _, v := range header.Values("Trailer") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if trailer == nil {
+					trailer = make(http.Header)
+				}
+				trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+
+	contentLength := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		if contentLength, err = strconv.ParseInt(cl, 10, 64); err != nil || contentLength < 0 {
+			return nil, fmt.Errorf("invalid content-length %q", cl)
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		Trailer:       trailer,
+		Body:          &responseBody{cs: cs},
+		ContentLength: contentLength,
+		Request:       cs.req,
+	}, nil
+}
+
+// handleData passes the body bytes of a DATA frame to the response body.
+// The connection window is charged even when the stream is gone.
+func (cc *ClientConn) handleData(f *frame.DataFrame) error {
+	if err := cc.checkStreamID(f.FrameHeader); err != nil {
+		return err
+	}
+	cc.logf("📦 DATA frame on stream %d (len=%d)", f.StreamID, f.Length)
+	n := int64(f.Length)
+	cc.mu.Lock()
+	cc.connRecv -= n
+	if cc.connRecv < 0 {
+		cc.mu.Unlock()
+		return frame.ConnectionError{Code: frame.ErrCodeFlowControl, Reason: "server overran the connection flow-control window"}
+	}
+	cs := cc.streams[f.StreamID]
+	cc.mu.Unlock()
+	if cs == nil {
+		// Nobody is going to read it, so give the window back
+		return cc.returnConnWindow(n)
+	}
+
+	if cs.resp == nil {
+		cs.resetStream(frame.ErrCodeProtocol, errors.New("DATA before the response HEADERS"))
+		return cc.returnConnWindow(n)
+	}
+	cc.mu.Lock()
+	ended := cs.recvEnd
+	cs.recvWindow -= n
+	overrun := cs.recvWindow < 0
+	cc.mu.Unlock()
+	if ended {
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-5.1-2.20.1
+		cs.resetStream(frame.ErrCodeStreamClosed, errors.New("DATA after END_STREAM"))
+		return cc.returnConnWindow(n)
+	}
+	if overrun {
+		cs.resetStream(frame.ErrCodeFlowControl, errors.New("server overran the stream flow-control window"))
+		return cc.returnConnWindow(n)
+	}
+
+	cs.body.Write(f.Data)
+	// Padding is given back right away, the data once it has been read
+	if pad := n - int64(len(f.Data)); pad > 0 {
+		cs.returnWindow(pad)
+	}
+	if f.Flags.Has(frame.FlagEndStream) {
+		cs.endResponse()
+	}
+	return nil
+}
+
+// returnWindow gives n consumed bytes back to the server, with a stream
+// WINDOW_UPDATE once half the stream window has been consumed. A stream
+// the server has ended needs no more window.
+func (cs *clientStream) returnWindow(n int64) {
+	cc := cs.cc
+	cc.returnConnWindow(n)
+
+	cc.mu.Lock()
+	if cs.recvEnd || cs.finished {
+		cc.mu.Unlock()
+		return
+	}
+	cs.recvUnacked += n
+	increment := cs.recvUnacked
+	if increment == 0 || increment < int64(cc.local.InitialWindowSize)/2 {
+		cc.mu.Unlock()
+		return
+	}
+	cs.recvWindow += increment
+	cs.recvUnacked = 0
+	cc.mu.Unlock()
+	cc.writeFrame(&frame.WindowUpdateFrame{
+		FrameHeader: frame.FrameHeader{StreamID: cs.id},
+		Increment:   uint32(increment),
+	})
+}
+
+// handleReset ends the stream after the server's RST_STREAM. NO_ERROR
+// after a complete response only asks us to stop sending the body.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-14
+func (cs *clientStream) handleReset(code frame.ErrCode) {
+	cc := cs.cc
+	cc.mu.Lock()
+	complete := cs.recvEnd
+	cc.mu.Unlock()
+	if code == frame.ErrCodeNo && complete {
+		cs.finish(nil)
+		return
+	}
+	cs.abort(frame.StreamError{StreamID: cs.id, Code: code, Reason: "stream reset by server"})
+}
+
+// endResponse marks the response as complete.
+func (cs *clientStream) endResponse() {
+	cs.cc.logf("🚪 Stream %d: END_STREAM received", cs.id)
+	cs.body.CloseWithError(io.EOF)
+	cs.endSide(false)
+}
+
+// endSide records END_STREAM sent (local) or received. The stream is
+// closed once both have happened.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-stream-states
+func (cs *clientStream) endSide(local bool) {
+	cc := cs.cc
+	cc.mu.Lock()
+	if local {
+		cs.sentEnd = true
+	} else {
+		cs.recvEnd = true
+	}
+	closed := cs.sentEnd && cs.recvEnd
+	cc.mu.Unlock()
+	if closed {
+		cs.finish(nil)
+	}
+}
+
+// resetStream ends the stream with RST_STREAM, unless it is over already.
+func (cs *clientStream) resetStream(code frame.ErrCode, err error) {
+	if cs.abort(err) {
+		cs.cc.logf("⛔️ Stream %d: sending RST_STREAM %s: %v", cs.id, code, err)
+		cs.cc.writeFrame(&frame.RSTStreamFrame{
+			FrameHeader: frame.FrameHeader{StreamID: cs.id},
+			ErrCode:     code,
+		})
+	}
+}
+
+// abort fails the stream with err. Body bytes that were received but not
+// read yet go back to the connection window. It reports whether the
+// stream was still open.
+func (cs *clientStream) abort(err error) bool {
+	if n := cs.body.CloseWithError(err); n > 0 {
+		cs.cc.returnConnWindow(int64(n))
+	}
+	return cs.finish(err)
+}
+
+// finish removes the stream from the connection, freeing its slot below
+// MAX_CONCURRENT_STREAMS. It reports whether the stream was still open.
+func (cs *clientStream) finish(err error) bool {
+	cc := cs.cc
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cs.finished {
+		return false
+	}
+	cs.finished = true
+	cs.err = err
+	delete(cc.streams, cs.id)
+	close(cs.done)
+	if cs.stopCtx != nil {
+		cs.stopCtx()
+	}
+	cc.cond.Broadcast()
+	return true
+}
+
+// responseBody is the http.Response.Body. Bytes that have been read are
+// given back to the server's flow-control windows.
+type responseBody struct {
+	cs     *clientStream
+	closed bool
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errClosedBody
+	}
+	n, err := b.cs.body.Read(p)
+	if n > 0 {
+		b.cs.returnWindow(int64(n))
+	}
+	return n, err
+}
+
+// Close cancels the stream with RST_STREAM CANCEL if the response is not
+// complete yet.
+func (b *responseBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.cs.resetStream(frame.ErrCodeCancel, errRequestCanceled)
+	// Unread bytes of a complete response still hold connection window
+	if n := b.cs.body.Discard(); n > 0 {
+		b.cs.cc.returnConnWindow(int64(n))
+	}
+	return nil
+}
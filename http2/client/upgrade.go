@@ -0,0 +1,183 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/internal/pipe"
+)
+
+// h2c upgrade
+// https://datatracker.ietf.org/doc/html/rfc7540#section-3.2
+//
+// Without prior knowledge the first request goes out as HTTP/1.1 with
+// Upgrade: h2c and our SETTINGS in the HTTP2-Settings header. A server that
+// speaks h2c answers 101 Switching Protocols and sends the response on
+// stream 1 over HTTP/2; the connection then takes further requests like any
+// other. A server that does not just answers over HTTP/1.1.
+
+// roundTripUpgrade sends req over a new connection to addr that asks to be
+// upgraded, unless there already is a usable connection to addr; ok is
+// false then and the caller should use it. The upgrade counts as a dial
+// of addr until the server has switched protocols, so concurrent requests
+// wait for it rather than upgrading a connection each.
+func (t *Transport) roundTripUpgrade(req *http.Request, addr string) (resp *http.Response, ok bool, err error) {
+	key := "http://" + addr
+	for {
+		t.mu.Lock()
+		if cc, found := t.conns[key]; found && cc.CanTakeNewRequest() {
+			t.mu.Unlock()
+			return nil, false, nil
+		}
+		call, dialing := t.dialing[key]
+		if !dialing {
+			break
+		}
+		t.mu.Unlock()
+		// Whatever happened to the other upgrade, this request goes on
+		// with its own if there is still no connection
+		waitDial(req.Context(), call)
+		if err := req.Context().Err(); err != nil {
+			closeBody(req)
+			return nil, true, err
+		}
+	}
+	call := t.startDial(key)
+	t.mu.Unlock()
+
+	cs, resp, err := t.upgrade(req, addr)
+	var cc *ClientConn
+	if cs != nil {
+		cc = cs.cc
+	}
+	t.finishDial(key, call, cc, err)
+
+	if cs != nil {
+		resp, err = cs.awaitResponse()
+	}
+	return resp, true, err
+}
+
+// upgrade dials addr and sends req as an HTTP/1.1 request asking to switch
+// to h2c. If the server switches, the response arrives on the returned
+// stream 1. Otherwise the server's HTTP/1.1 response is returned, and
+// closing its body closes the connection.
+func (t *Transport) upgrade(req *http.Request, addr string) (*clientStream, *http.Response, error) {
+	ctx := req.Context()
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		closeBody(req)
+		return nil, nil, err
+	}
+	// Until the switch the request's context closes the connection
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	cs, resp, err := t.upgradeConn(conn, req)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return cs, resp, nil
+}
+
+func (t *Transport) upgradeConn(conn net.Conn, req *http.Request) (*clientStream, *http.Response, error) {
+	// The server may send its SETTINGS right behind the 101, so frames are
+	// read from the same buffer as the response
+	br := bufio.NewReader(conn)
+	cc, err := t.newClientConn(conn, br)
+	if err != nil {
+		closeBody(req)
+		return nil, nil, err
+	}
+	up := req.Clone(req.Context())
+	up.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	up.Header.Set("Upgrade", "h2c")
+	up.Header.Set("HTTP2-Settings", base64.RawURLEncoding.EncodeToString(frame.AppendSettings(nil, cc.local.Params())))
+	t.logf("➡️ %s %s over HTTP/1.1 with Upgrade: h2c", req.Method, req.URL)
+	// Write sends the whole body, which RFC 7540 asks for before the
+	// client may speak HTTP/2
+	if err := up.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		resp, err := http.ReadResponse(br, up)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if !strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") {
+				return nil, nil, fmt.Errorf("server switched to %q instead of h2c", resp.Header.Get("Upgrade"))
+			}
+			break
+		}
+		if resp.StatusCode >= 200 {
+			t.logf("⚠️ Server stayed with HTTP/1.1: %s", resp.Status)
+			resp.Body = http1Body{resp.Body, conn}
+			return nil, resp, nil
+		}
+		// e.g. 100 Continue
+	}
+	t.logf("✔ Switched to h2c, the response comes on stream 1")
+
+	cs := cc.upgradeStream(req)
+	if err := cc.start(); err != nil {
+		return nil, nil, err
+	}
+	ctx := req.Context()
+	cc.mu.Lock()
+	if !cs.finished {
+		cs.stopCtx = context.AfterFunc(ctx, func() {
+			cs.resetStream(frame.ErrCodeCancel, ctx.Err())
+		})
+	}
+	cc.mu.Unlock()
+	return cs, nil, nil
+}
+
+// upgradeStream registers stream 1 for the request that was upgraded. The
+// request already went out over HTTP/1.1, so the stream is half-closed
+// (local) from the start.
+func (cc *ClientConn) upgradeStream(req *http.Request) *clientStream {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cs := &clientStream{
+		cc:         cc,
+		id:         1,
+		req:        req,
+		respc:      make(chan *http.Response, 1),
+		done:       make(chan struct{}),
+		body:       pipe.New(),
+		sentEnd:    true,
+		sendWindow: int64(cc.peer.InitialWindowSize),
+		recvWindow: int64(cc.local.InitialWindowSize),
+	}
+	cc.streams[1] = cs
+	cc.nextStreamID = 3
+	return cs
+}
+
+// http1Body closes the connection along with the body of a response that
+// came over HTTP/1.1, since the connection cannot be used for HTTP/2.
+type http1Body struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b http1Body) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
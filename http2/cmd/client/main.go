@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/client"
+)
+
+var (
+	urlFlag      = flag.String("url", "http://localhost:8080/", "URL to send the request to; https://localhost:8443/ speaks TLS")
+	insecureFlag = flag.Bool("insecure", false, "accept any TLS certificate, e.g. the server's self-signed one")
+	upgradeFlag  = flag.Bool("upgrade", false, "start with an HTTP/1.1 request that asks to upgrade to h2c, instead of prior knowledge")
+	methodFlag   = flag.String("method", "POST", "request method")
+	bodyFlag     = flag.String("body", "Hello Serverrrr!", "request body to send")
+	bodySizeFlag = flag.Int("body-size", 0, "send a body of this many bytes instead of -body")
+	nFlag        = flag.Int("n", 1, "send this many requests at once, multiplexed over one connection")
+	padFlag      = flag.Int("pad", 0, "pad HEADERS and DATA frames with this many bytes (0-255)")
+
+	grpcFlag        = flag.String("grpc", "", "make a unary gRPC call to this method, e.g. /fromscratch.Echo/Echo, with -body as the message")
+	grpcTimeoutFlag = flag.Duration("grpc-timeout", 0, "deadline of the -grpc call (0 for none)")
+
+	pingFlag        = flag.Bool("ping", false, "PING the server before the request and print the round-trip time")
+	keepaliveFlag   = flag.Duration("keepalive", 0, "send a PING when the connection has been idle this long (0 disables)")
+	pingTimeoutFlag = flag.Duration("ping-timeout", 15*time.Second, "close the connection when a keepalive PING is not answered in time")
+)
+
+// extraHeaders are sent after the pseudo-headers, e.g.
+// -header "cookie: $(head -c 40000 /dev/zero | tr '\0' x)" needs CONTINUATION
+// frames.
+var extraHeaders = make(http.Header)
+
+// localSettings are what the client advertises; they can be changed with flags.
+var localSettings = client.DefaultSettings()
+
+func init() {
+	flag.Func("header", "extra request header as \"name: value\" (repeatable)", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return errors.New("want name: value")
+		}
+		extraHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+
+	// Nobody would read pushed responses
+	localSettings.EnablePush = false
+	flag.Func("header-table-size", "SETTINGS_HEADER_TABLE_SIZE to advertise", uint32Flag(&localSettings.HeaderTableSize))
+	flag.BoolFunc("enable-push", "advertise SETTINGS_ENABLE_PUSH = 1 (pushed streams are refused)", func(s string) error {
+		localSettings.EnablePush = s == "true"
+		return nil
+	})
+	flag.Func("max-concurrent-streams", "SETTINGS_MAX_CONCURRENT_STREAMS to advertise", uint32Flag(&localSettings.MaxConcurrentStreams))
+	flag.Func("initial-window-size", "SETTINGS_INITIAL_WINDOW_SIZE to advertise", uint32Flag(&localSettings.InitialWindowSize))
+	flag.Func("max-frame-size", "SETTINGS_MAX_FRAME_SIZE to advertise", uint32Flag(&localSettings.MaxFrameSize))
+	flag.Func("max-header-list-size", "SETTINGS_MAX_HEADER_LIST_SIZE to advertise", uint32Flag(&localSettings.MaxHeaderListSize))
+}
+
+func uint32Flag(v *uint32) func(string) error {
+	return func(s string) error {
+		_, err := fmt.Sscan(s, v)
+		return err
+	}
+}
+
+func main() {
+	flag.Parse()
+	checkErr(localSettings.Validate())
+	if *padFlag < 0 || *padFlag > 255 {
+		checkErr(fmt.Errorf("-pad %d is not between 0 and 255", *padFlag))
+	}
+	u, err := url.Parse(*urlFlag)
+	checkErr(err)
+
+	tr := &client.Transport{
+		// The server's -tls certificate signs itself
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecureFlag},
+		UpgradeH2C:      *upgradeFlag,
+		Settings:        &localSettings,
+		Padding:         uint8(*padFlag),
+		ReadIdleTimeout: *keepaliveFlag,
+		PingTimeout:     *pingTimeoutFlag,
+		// Show every frame as it goes by
+		Logf: func(format string, args ...any) {
+			fmt.Printf(format+"\n", args...)
+		},
+	}
+
+	// With -upgrade the Transport connects on the first request, which
+	// goes out as HTTP/1.1 and comes back on stream 1 after the switch
+	var rt http.RoundTripper = tr
+	if *upgradeFlag {
+		if *pingFlag {
+			checkErr(errors.New("-ping needs prior knowledge, it cannot be used with -upgrade"))
+		}
+		defer tr.CloseIdleConnections()
+	} else {
+		// Step 1: Connect (and negotiate h2 through ALPN for https), send
+		// the preface and SETTINGS and wait for the server's SETTINGS
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+		}
+		cc, err := tr.DialClientConn(context.Background(), u.Scheme, addr)
+		checkErr(err)
+		defer cc.Close()
+		rt = cc
+
+		if *pingFlag {
+			ctx, cancel := context.WithTimeout(context.Background(), *pingTimeoutFlag)
+			rtt, err := cc.Ping(ctx)
+			cancel()
+			checkErr(err)
+			fmt.Printf("✔ PING round-trip time: %v\n", rtt)
+		}
+	}
+
+	// Step 2: Send the requests, each on its own stream. The ClientConn and
+	// the Transport are http.RoundTrippers, so a plain http.Client can use
+	// them.
+	c := &http.Client{Transport: rt}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	for i := range *nFlag {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out string
+			var err error
+			if *grpcFlag != "" {
+				out, err = doGRPC(rt, u, i)
+			} else {
+				out, err = do(c, u, i)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Print(out)
+			if err != nil {
+				fmt.Println("❌ Error:", err)
+				failed = true
+			}
+		}()
+	}
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// do sends one request and returns the response as text.
+func do(c *http.Client, u *url.URL, i int) (string, error) {
+	req, err := http.NewRequest(*methodFlag, u.String(), bytes.NewReader(requestBody()))
+	if err != nil {
+		return "", err
+	}
+	for name, values := range extraHeaders {
+		req.Header[name] = values
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "\n✅ Response %d: %s\n", i+1, resp.Status)
+	for name, values := range resp.Header {
+		for _, v := range values {
+			fmt.Fprintf(&out, "  %s: %s\n", name, v)
+		}
+	}
+	if len(body) > 200 {
+		fmt.Fprintf(&out, "   %q... (%d bytes)\n", body[:200], len(body))
+	} else {
+		fmt.Fprintf(&out, "   %s\n", body)
+	}
+	return out.String(), err
+}
+
+// doGRPC calls the -grpc method with the request body as the only message
+// and returns the response message as text.
+func doGRPC(rt http.RoundTripper, u *url.URL, i int) (string, error) {
+	g := &client.GRPCClient{RoundTripper: rt, Target: u.Scheme + "://" + u.Host}
+	ctx := context.Background()
+	if *grpcTimeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *grpcTimeoutFlag)
+		defer cancel()
+	}
+	resp, err := g.Invoke(ctx, *grpcFlag, requestBody())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("\n✅ Response %d: grpc-status OK\n   %q\n", i+1, resp), nil
+}
+
+func requestBody() []byte {
+	if *bodySizeFlag > 0 {
+		return bytes.Repeat([]byte("x"), *bodySizeFlag)
+	}
+	return []byte(*bodyFlag)
+}
+
+func checkErr(err error) {
+	if err != nil {
+		fmt.Println("❌ Error:", err)
+		os.Exit(1)
+	}
+}
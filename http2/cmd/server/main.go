@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/h2tls"
+	"github.com/nethish/fromscratch/http2/server"
+)
+
+var (
+	tlsFlag     = flag.Bool("tls", false, "also serve h2 over TLS on :8443 with a self-signed certificate")
+	tlsAddrFlag = flag.String("tls-addr", ":8443", "address for -tls")
+)
+
+func main() {
+	flag.Parse()
+
+	// Plain net/http handlers, served over the from-scratch frame layer
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Echo every piece of the body as soon as it arrives, e.g. each
+		// line of curl --http2-prior-knowledge -T - http://localhost:8080/
+		w.Header().Set("Content-Type", "text/plain")
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, world!")
+	})
+	mux.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+		// Promise /hello before answering, if the client allows push
+		if p, ok := w.(http.Pusher); ok {
+			if err := p.Push("/hello", nil); err != nil {
+				log.Println("Push:", err)
+			}
+		}
+		fmt.Fprintln(w, "This response came with /hello pushed")
+	})
+
+	// gRPC calls go to the methods below, anything else to mux. Messages
+	// are raw bytes, so any protobuf comes back as it was sent.
+	g := &server.GRPCServer{Fallback: server.HTTPHandler(mux)}
+	g.Handle("/fromscratch.Echo/Echo", server.UnaryMethod(func(ctx context.Context, req []byte) ([]byte, error) {
+		return req, nil
+	}))
+	g.Handle("/fromscratch.Echo/EchoStream", func(stream *server.GRPCStream) error {
+		for {
+			msg, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	})
+
+	srv := &server.Server{
+		Addr:    ":8080",
+		Handler: g,
+		// Serve urgent responses first, as the clients' priority header
+		// and PRIORITY_UPDATE frames ask
+		NewWriteScheduler: server.NewPriorityScheduler,
+	}
+
+	// Ctrl-C sends GOAWAY to every client and waits up to 10 seconds for
+	// the requests in flight.
+	idle := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Shutdown:", err)
+		}
+		close(idle)
+	}()
+
+	// With -tls the same server also speaks h2 over TLS. The certificate is
+	// made up at startup, so clients have to skip verification (curl -k,
+	// client -insecure).
+	if *tlsFlag {
+		cert, err := h2tls.SelfSigned("localhost", "127.0.0.1", "::1")
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		ln, err := net.Listen("tcp", *tlsAddrFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := srv.ServeTLS(ln, "", ""); !errors.Is(err, server.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		log.Println("Listening for h2 over TLS on https://localhost" + *tlsAddrFlag)
+	}
+
+	log.Println("Listening for h2c (HTTP/2 over TCP) on http://localhost:8080")
+	if err := srv.ListenAndServe(); !errors.Is(err, server.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-idle
+}
@@ -0,0 +1,235 @@
+// Package frame reads and writes HTTP/2 frames. It is the one place where
+// the wire format lives, and both the server and the client use it.
+//
+// Every frame starts with the same 9 byte header, followed by a payload
+// whose layout depends on the frame type.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-frame-format
+//
+//	+-----------------------------------------------+
+//	|                 Length (24)                   |
+//	+---------------+---------------+---------------+
+//	|   Type (8)    |   Flags (8)   |
+//	+-+-------------+---------------+-------------------------------+
+//	|R|                 Stream Identifier (31)                      |
+//	+=+=============================================================+
+//	|                   Frame Payload (0...)                      ...
+//	+---------------------------------------------------------------+
+package frame
+
+import "fmt"
+
+// HeaderLen is the size of the frame header.
+const HeaderLen = 9
+
+// Bounds of SETTINGS_MAX_FRAME_SIZE. Every endpoint accepts frames of
+// MinMaxFrameSize until its peer says otherwise.
+const (
+	MinMaxFrameSize = 1 << 14
+	MaxMaxFrameSize = 1<<24 - 1
+)
+
+// Type is the frame type.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-frame-definitions
+type Type uint8
+
+const (
+	TypeData         Type = 0x0
+	TypeHeaders      Type = 0x1
+	TypePriority     Type = 0x2
+	TypeRSTStream    Type = 0x3
+	TypeSettings     Type = 0x4
+	TypePushPromise  Type = 0x5
+	TypePing         Type = 0x6
+	TypeGoAway       Type = 0x7
+	TypeWindowUpdate Type = 0x8
+	TypeContinuation Type = 0x9
+	// TypePriorityUpdate is defined by RFC 9218.
+	TypePriorityUpdate Type = 0x10
+)
+
+var typeNames = map[Type]string{
+	TypeData:           "DATA",
+	TypeHeaders:        "HEADERS",
+	TypePriority:       "PRIORITY",
+	TypeRSTStream:      "RST_STREAM",
+	TypeSettings:       "SETTINGS",
+	TypePushPromise:    "PUSH_PROMISE",
+	TypePing:           "PING",
+	TypeGoAway:         "GOAWAY",
+	TypeWindowUpdate:   "WINDOW_UPDATE",
+	TypeContinuation:   "CONTINUATION",
+	TypePriorityUpdate: "PRIORITY_UPDATE",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_0x%x", uint8(t))
+}
+
+// Flags are the frame type specific flags of the frame header. The same
+// bit means different things for different types.
+type Flags uint8
+
+const (
+	// DATA and HEADERS
+	FlagEndStream Flags = 0x1
+	// SETTINGS and PING
+	FlagAck Flags = 0x1
+	// HEADERS, PUSH_PROMISE and CONTINUATION
+	FlagEndHeaders Flags = 0x4
+	// DATA, HEADERS and PUSH_PROMISE
+	FlagPadded Flags = 0x8
+	// HEADERS
+	FlagPriority Flags = 0x20
+)
+
+// Has reports whether all of v is set.
+func (f Flags) Has(v Flags) bool {
+	return f&v == v
+}
+
+// FrameHeader is the 9 byte header every frame starts with.
+type FrameHeader struct {
+	Type  Type
+	Flags Flags
+	// Length is the length of the payload as read, padding included.
+	// WriteFrame works it out itself.
+	Length   uint32
+	StreamID uint32
+}
+
+// Header returns the frame header; it makes every frame type a Frame.
+func (h FrameHeader) Header() FrameHeader {
+	return h
+}
+
+func (h FrameHeader) String() string {
+	return fmt.Sprintf("%s stream=%d flags=0x%x len=%d", h.Type, h.StreamID, uint8(h.Flags), h.Length)
+}
+
+// Frame is one of the frame types below. The Type in the header of a frame
+// passed to WriteFrame is ignored; the Go type decides.
+type Frame interface {
+	Header() FrameHeader
+}
+
+// DataFrame carries request or response body bytes.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-data
+type DataFrame struct {
+	FrameHeader
+	// PadLength is how many bytes of padding follow the data, if the
+	// FlagPadded flag is set. Padding still counts against flow control,
+	// so Length and not len(Data) is what a DATA frame costs.
+	PadLength uint8
+	Data      []byte
+}
+
+// PriorityParam is the deprecated RFC 7540 priority signal that HEADERS
+// and PRIORITY frames may carry.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-priority
+type PriorityParam struct {
+	Exclusive bool
+	StreamDep uint32
+	// Weight is the wire value; the actual weight is one more (1-256).
+	Weight uint8
+}
+
+func (p PriorityParam) String() string {
+	return fmt.Sprintf("depends on %d (exclusive=%t) weight %d", p.StreamDep, p.Exclusive, int(p.Weight)+1)
+}
+
+// HeadersFrame opens a stream and carries the first piece of a header
+// block. Without FlagEndHeaders the block continues in CONTINUATION frames.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-headers
+type HeadersFrame struct {
+	FrameHeader
+	PadLength uint8
+	// Priority is only present with FlagPriority.
+	Priority      PriorityParam
+	BlockFragment []byte
+}
+
+// PriorityFrame changes the RFC 7540 priority of a stream.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-priority
+type PriorityFrame struct {
+	FrameHeader
+	PriorityParam
+}
+
+// RSTStreamFrame ends a stream right away.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-rst_stream
+type RSTStreamFrame struct {
+	FrameHeader
+	ErrCode ErrCode
+}
+
+// SettingsFrame carries SETTINGS parameters, or acknowledges the peer's
+// with FlagAck and no parameters.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-settings
+type SettingsFrame struct {
+	FrameHeader
+	Settings []Setting
+}
+
+// PushPromiseFrame reserves a stream for a response the server is going
+// to push, together with the header block of the request it answers.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-push_promise
+type PushPromiseFrame struct {
+	FrameHeader
+	PadLength        uint8
+	PromisedStreamID uint32
+	BlockFragment    []byte
+}
+
+// PingFrame carries 8 opaque bytes, which the receiver sends back with
+// FlagAck.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-ping
+type PingFrame struct {
+	FrameHeader
+	Data [8]byte
+}
+
+// GoAwayFrame tells the peer that no more streams will be accepted and
+// which ones may have been processed.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-goaway
+type GoAwayFrame struct {
+	FrameHeader
+	LastStreamID uint32
+	ErrCode      ErrCode
+	DebugData    []byte
+}
+
+// WindowUpdateFrame grows a flow-control window, the connection's on
+// stream 0.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-window_update
+type WindowUpdateFrame struct {
+	FrameHeader
+	Increment uint32
+}
+
+// ContinuationFrame carries the rest of a header block.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-continuation
+type ContinuationFrame struct {
+	FrameHeader
+	BlockFragment []byte
+}
+
+// PriorityUpdateFrame changes the RFC 9218 priority of a stream. It is sent
+// on stream 0 and names the stream it is about.
+// https://datatracker.ietf.org/doc/html/rfc9218#name-the-priority_update-frame
+type PriorityUpdateFrame struct {
+	FrameHeader
+	PrioritizedStreamID uint32
+	// FieldValue is a priority field value such as "u=1, i".
+	FieldValue string
+}
+
+// UnknownFrame is a frame of a type this package does not know. Receivers
+// must ignore those.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-4.1-4.4.1
+type UnknownFrame struct {
+	FrameHeader
+	Payload []byte
+}
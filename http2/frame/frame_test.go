@@ -0,0 +1,138 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	frames := []Frame{
+		&DataFrame{FrameHeader: FrameHeader{Flags: FlagEndStream, StreamID: 1}, Data: []byte("hello")},
+		&DataFrame{FrameHeader: FrameHeader{Flags: FlagPadded, StreamID: 3}, PadLength: 4, Data: []byte("padded")},
+		&HeadersFrame{
+			FrameHeader:   FrameHeader{Flags: FlagEndHeaders | FlagPadded | FlagPriority, StreamID: 5},
+			PadLength:     2,
+			Priority:      PriorityParam{Exclusive: true, StreamDep: 3, Weight: 200},
+			BlockFragment: []byte{0x82, 0x86},
+		},
+		&PriorityFrame{FrameHeader{StreamID: 7}, PriorityParam{StreamDep: 5, Weight: 15}},
+		&RSTStreamFrame{FrameHeader{StreamID: 1}, ErrCodeCancel},
+		&SettingsFrame{Settings: []Setting{{ID: SettingMaxFrameSize, Val: 1 << 20}, {ID: SettingEnablePush, Val: 0}}},
+		&SettingsFrame{FrameHeader: FrameHeader{Flags: FlagAck}},
+		&PushPromiseFrame{FrameHeader: FrameHeader{Flags: FlagEndHeaders, StreamID: 1}, PromisedStreamID: 2, BlockFragment: []byte{0x82}},
+		&PingFrame{FrameHeader{Flags: FlagAck}, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		&GoAwayFrame{LastStreamID: 9, ErrCode: ErrCodeEnhanceYourCalm, DebugData: []byte("slow down")},
+		&WindowUpdateFrame{FrameHeader{StreamID: 3}, 1 << 30},
+		&ContinuationFrame{FrameHeader{Flags: FlagEndHeaders, StreamID: 1}, []byte{0x84}},
+		&PriorityUpdateFrame{PrioritizedStreamID: 5, FieldValue: "u=1, i"},
+		&UnknownFrame{FrameHeader{Type: 0xfa, Flags: 0x3, StreamID: 1}, []byte("extension")},
+	}
+	for _, want := range frames {
+		var buf bytes.Buffer
+		fr := NewFramer(&buf, &buf)
+		if err := fr.WriteFrame(want); err != nil {
+			t.Fatalf("WriteFrame(%T): %v", want, err)
+		}
+		length := uint32(buf.Len() - HeaderLen)
+		got, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame(%T): %v", want, err)
+		}
+		if h := got.Header(); h.Length != length {
+			t.Errorf("%s: Length = %d, want %d", h.Type, h.Length, length)
+		}
+
+		// The Type and Length are filled in on the way
+		h := reflect.ValueOf(want).Elem().FieldByName("FrameHeader")
+		h.FieldByName("Type").Set(reflect.ValueOf(got.Header().Type))
+		h.FieldByName("Length").SetUint(uint64(length))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+		// want is a ConnectionError or StreamError
+		want error
+	}{
+		{"too large", "004001 00 00 00000001", ConnectionError{Code: ErrCodeFrameSize}},
+		{"DATA on stream 0", "000001 00 00 00000000 00", ConnectionError{Code: ErrCodeProtocol}},
+		{"SETTINGS on a stream", "000000 04 00 00000001", ConnectionError{Code: ErrCodeProtocol}},
+		{"SETTINGS ACK with payload", "000006 04 01 00000000 000100001000", ConnectionError{Code: ErrCodeFrameSize}},
+		{"SETTINGS not multiple of 6", "000005 04 00 00000000 0001000010", ConnectionError{Code: ErrCodeFrameSize}},
+		{"padding too long", "000003 00 08 00000001 056869", ConnectionError{Code: ErrCodeProtocol}},
+		{"padded without pad length", "000000 00 08 00000001", ConnectionError{Code: ErrCodeFrameSize}},
+		{"HEADERS short priority", "000003 01 24 00000001 000000", ConnectionError{Code: ErrCodeFrameSize}},
+		{"PRIORITY wrong size", "000004 02 00 00000003 00000001", StreamError{StreamID: 3, Code: ErrCodeFrameSize}},
+		{"RST_STREAM wrong size", "000003 03 00 00000001 000008", ConnectionError{Code: ErrCodeFrameSize}},
+		{"PUSH_PROMISE too short", "000002 05 04 00000001 0002", ConnectionError{Code: ErrCodeFrameSize}},
+		{"PING wrong size", "000004 06 00 00000000 01020304", ConnectionError{Code: ErrCodeFrameSize}},
+		{"GOAWAY too short", "000004 07 00 00000000 00000001", ConnectionError{Code: ErrCodeFrameSize}},
+		{"WINDOW_UPDATE wrong size", "000003 08 00 00000000 000001", ConnectionError{Code: ErrCodeFrameSize}},
+		{"PRIORITY_UPDATE too short", "000002 10 00 00000000 0001", ConnectionError{Code: ErrCodeFrameSize}},
+	}
+	for _, tt := range tests {
+		fr := NewFramer(nil, bytes.NewReader(mustHex(t, tt.wire)))
+		_, err := fr.ReadFrame()
+		switch want := tt.want.(type) {
+		case ConnectionError:
+			var got ConnectionError
+			if !errors.As(err, &got) || got.Code != want.Code {
+				t.Errorf("%s: got %v, want a connection error %s", tt.name, err, want.Code)
+			}
+		case StreamError:
+			var got StreamError
+			if !errors.As(err, &got) || got.Code != want.Code || got.StreamID != want.StreamID {
+				t.Errorf("%s: got %v, want a stream error %s on stream %d", tt.name, err, want.Code, want.StreamID)
+			}
+		}
+	}
+}
+
+func TestReadFrameReusesBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	fr := NewFramer(&buf, &buf)
+	fr.MaxReadFrameSize = MaxMaxFrameSize
+	fr.WriteFrame(&DataFrame{FrameHeader: FrameHeader{StreamID: 1}, Data: make([]byte, 1<<15)})
+	fr.WriteFrame(&DataFrame{FrameHeader: FrameHeader{StreamID: 1}, Data: []byte("short")})
+
+	first, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := first.(*DataFrame).Data, second.(*DataFrame).Data
+	if &a[0] != &b[0] {
+		t.Error("second ReadFrame allocated a new buffer")
+	}
+	if string(b) != "short" {
+		t.Errorf("second frame = %q", b)
+	}
+
+	// A payload cut short is an unexpected EOF, not a clean one
+	fr = NewFramer(nil, bytes.NewReader(mustHex(t, "000008 06 00 00000000 0102")))
+	if _, err := fr.ReadFrame(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated frame: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
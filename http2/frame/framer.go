@@ -0,0 +1,337 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Framer reads frames from an io.Reader and writes them to an io.Writer.
+// Its buffers are reused from frame to frame: the byte slices of a frame
+// returned by ReadFrame are only valid until the next call to ReadFrame.
+//
+// A Framer may be used by one reader and one writer at the same time, but
+// not by two readers or two writers.
+type Framer struct {
+	r io.Reader
+	w io.Writer
+
+	// MaxReadFrameSize is the largest payload ReadFrame accepts, our
+	// SETTINGS_MAX_FRAME_SIZE. MinMaxFrameSize is used if it is zero.
+	MaxReadFrameSize uint32
+
+	header [HeaderLen]byte
+	rbuf   []byte
+	wbuf   []byte
+}
+
+// NewFramer returns a Framer that writes to w and reads from r. Either may
+// be nil if the Framer is only used in one direction.
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{w: w, r: r}
+}
+
+// ReadFrame reads the next frame and checks its length and stream ID
+// against its type. A frame that breaks those rules yields a
+// ConnectionError, or a StreamError where RFC 9113 allows the connection
+// to carry on. Errors of the underlying reader are returned as they are.
+func (fr *Framer) ReadFrame() (Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, err
+	}
+	h := readHeader(fr.header[:])
+
+	// A frame bigger than our SETTINGS_MAX_FRAME_SIZE is fatal
+	// https://datatracker.ietf.org/doc/html/rfc9113#name-frame-size
+	maxSize := fr.MaxReadFrameSize
+	if maxSize == 0 {
+		maxSize = MinMaxFrameSize
+	}
+	if h.Length > maxSize {
+		return nil, ConnectionError{ErrCodeFrameSize, fmt.Sprintf("%s frame of %d bytes exceeds MAX_FRAME_SIZE", h.Type, h.Length)}
+	}
+
+	if cap(fr.rbuf) < int(h.Length) {
+		fr.rbuf = make([]byte, h.Length)
+	}
+	payload := fr.rbuf[:h.Length]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if err := checkStreamID(h); err != nil {
+		return nil, err
+	}
+	return parseFrame(h, payload)
+}
+
+func readHeader(b []byte) FrameHeader {
+	return FrameHeader{
+		Length:   uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]),
+		Type:     Type(b[3]),
+		Flags:    Flags(b[4]),
+		StreamID: binary.BigEndian.Uint32(b[5:]) & 0x7FFFFFFF,
+	}
+}
+
+// checkStreamID rejects frames sent on the wrong kind of stream: SETTINGS,
+// PING, GOAWAY and PRIORITY_UPDATE belong to the connection (stream 0),
+// everything that carries a request or response belongs to a stream.
+// WINDOW_UPDATE may be either.
+func checkStreamID(h FrameHeader) error {
+	switch h.Type {
+	case TypeSettings, TypePing, TypeGoAway, TypePriorityUpdate:
+		if h.StreamID != 0 {
+			return ConnectionError{ErrCodeProtocol, fmt.Sprintf("%s on stream %d", h.Type, h.StreamID)}
+		}
+	case TypeData, TypeHeaders, TypePriority, TypeRSTStream, TypePushPromise, TypeContinuation:
+		if h.StreamID == 0 {
+			return ConnectionError{ErrCodeProtocol, fmt.Sprintf("%s on stream 0", h.Type)}
+		}
+	}
+	return nil
+}
+
+func parseFrame(h FrameHeader, p []byte) (Frame, error) {
+	switch h.Type {
+	case TypeData:
+		data, padLength, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		return &DataFrame{h, padLength, data}, nil
+
+	case TypeHeaders:
+		// https://datatracker.ietf.org/doc/html/rfc9113#name-headers
+		//
+		//	+---------------+
+		//	|Pad Length? (8)|
+		//	+-+-------------+-----------------------------------------------+
+		//	|E|                 Stream Dependency? (31)                     |
+		//	+-+-------------+-----------------------------------------------+
+		//	|  Weight? (8)  |
+		//	+-+-------------+-----------------------------------------------+
+		//	|                   Field Block Fragment (*)                    |
+		//	+---------------------------------------------------------------+
+		//	|                           Padding (*)                         |
+		//	+---------------------------------------------------------------+
+		fragment, padLength, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		f := &HeadersFrame{FrameHeader: h, PadLength: padLength}
+		if h.Flags.Has(FlagPriority) {
+			if len(fragment) < 5 {
+				return nil, ConnectionError{ErrCodeFrameSize, "HEADERS too short for its priority fields"}
+			}
+			f.Priority = parsePriority(fragment)
+			fragment = fragment[5:]
+		}
+		f.BlockFragment = fragment
+		return f, nil
+
+	case TypePriority:
+		if len(p) != 5 {
+			return nil, StreamError{h.StreamID, ErrCodeFrameSize, "PRIORITY must be 5 bytes"}
+		}
+		return &PriorityFrame{h, parsePriority(p)}, nil
+
+	case TypeRSTStream:
+		if len(p) != 4 {
+			return nil, ConnectionError{ErrCodeFrameSize, "RST_STREAM must be 4 bytes"}
+		}
+		return &RSTStreamFrame{h, ErrCode(binary.BigEndian.Uint32(p))}, nil
+
+	case TypeSettings:
+		if h.Flags.Has(FlagAck) && len(p) != 0 {
+			return nil, ConnectionError{ErrCodeFrameSize, "SETTINGS ACK with a payload"}
+		}
+		settings, err := ParseSettings(p)
+		if err != nil {
+			return nil, err
+		}
+		return &SettingsFrame{h, settings}, nil
+
+	case TypePushPromise:
+		fragment, padLength, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		if len(fragment) < 4 {
+			return nil, ConnectionError{ErrCodeFrameSize, "PUSH_PROMISE shorter than 4 bytes"}
+		}
+		return &PushPromiseFrame{
+			FrameHeader:      h,
+			PadLength:        padLength,
+			PromisedStreamID: binary.BigEndian.Uint32(fragment) & 0x7FFFFFFF,
+			BlockFragment:    fragment[4:],
+		}, nil
+
+	case TypePing:
+		if len(p) != 8 {
+			return nil, ConnectionError{ErrCodeFrameSize, "PING must be 8 bytes"}
+		}
+		return &PingFrame{h, [8]byte(p)}, nil
+
+	case TypeGoAway:
+		if len(p) < 8 {
+			return nil, ConnectionError{ErrCodeFrameSize, "GOAWAY shorter than 8 bytes"}
+		}
+		return &GoAwayFrame{
+			FrameHeader:  h,
+			LastStreamID: binary.BigEndian.Uint32(p) & 0x7FFFFFFF,
+			ErrCode:      ErrCode(binary.BigEndian.Uint32(p[4:])),
+			DebugData:    p[8:],
+		}, nil
+
+	case TypeWindowUpdate:
+		if len(p) != 4 {
+			return nil, ConnectionError{ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes"}
+		}
+		return &WindowUpdateFrame{h, binary.BigEndian.Uint32(p) & 0x7FFFFFFF}, nil
+
+	case TypeContinuation:
+		return &ContinuationFrame{h, p}, nil
+
+	case TypePriorityUpdate:
+		if len(p) < 4 {
+			return nil, ConnectionError{ErrCodeFrameSize, "PRIORITY_UPDATE shorter than 4 bytes"}
+		}
+		return &PriorityUpdateFrame{h, binary.BigEndian.Uint32(p) & 0x7FFFFFFF, string(p[4:])}, nil
+	}
+	return &UnknownFrame{h, p}, nil
+}
+
+// stripPadding removes the Pad Length field and the padding of a frame
+// with the PADDED flag. Padding as long as the rest of the frame or longer
+// is a PROTOCOL_ERROR.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-data
+func stripPadding(h FrameHeader, p []byte) ([]byte, uint8, error) {
+	if !h.Flags.Has(FlagPadded) {
+		return p, 0, nil
+	}
+	if len(p) == 0 {
+		return nil, 0, ConnectionError{ErrCodeFrameSize, "PADDED frame without Pad Length"}
+	}
+	padLength := p[0]
+	p = p[1:]
+	if int(padLength) > len(p) {
+		return nil, 0, ConnectionError{ErrCodeProtocol, fmt.Sprintf("padding of %d bytes in a %d byte frame", padLength, len(p)+1)}
+	}
+	return p[:len(p)-int(padLength)], padLength, nil
+}
+
+// parsePriority decodes the 5 byte priority fields at the start of p.
+func parsePriority(p []byte) PriorityParam {
+	dep := binary.BigEndian.Uint32(p)
+	return PriorityParam{
+		Exclusive: dep&0x80000000 != 0,
+		StreamDep: dep & 0x7FFFFFFF,
+		Weight:    p[4],
+	}
+}
+
+// WriteFrame encodes f and writes it with a single Write, so frames written
+// to a connection from one goroutine at a time never interleave. The
+// Length in f's header is ignored. Checking the payload against the peer's
+// SETTINGS_MAX_FRAME_SIZE is up to the caller.
+func (fr *Framer) WriteFrame(f Frame) error {
+	h := f.Header()
+	b := append(fr.wbuf[:0], make([]byte, HeaderLen)...)
+
+	switch f := f.(type) {
+	case *DataFrame:
+		h.Type = TypeData
+		b = appendPadded(b, h, f.PadLength, f.Data)
+	case *HeadersFrame:
+		h.Type = TypeHeaders
+		if h.Flags.Has(FlagPadded) {
+			b = append(b, f.PadLength)
+		}
+		if h.Flags.Has(FlagPriority) {
+			b = appendPriority(b, f.Priority)
+		}
+		b = append(b, f.BlockFragment...)
+		if h.Flags.Has(FlagPadded) {
+			b = append(b, make([]byte, f.PadLength)...)
+		}
+	case *PriorityFrame:
+		h.Type = TypePriority
+		b = appendPriority(b, f.PriorityParam)
+	case *RSTStreamFrame:
+		h.Type = TypeRSTStream
+		b = binary.BigEndian.AppendUint32(b, uint32(f.ErrCode))
+	case *SettingsFrame:
+		h.Type = TypeSettings
+		b = AppendSettings(b, f.Settings)
+	case *PushPromiseFrame:
+		h.Type = TypePushPromise
+		if h.Flags.Has(FlagPadded) {
+			b = append(b, f.PadLength)
+		}
+		b = binary.BigEndian.AppendUint32(b, f.PromisedStreamID&0x7FFFFFFF)
+		b = append(b, f.BlockFragment...)
+		if h.Flags.Has(FlagPadded) {
+			b = append(b, make([]byte, f.PadLength)...)
+		}
+	case *PingFrame:
+		h.Type = TypePing
+		b = append(b, f.Data[:]...)
+	case *GoAwayFrame:
+		h.Type = TypeGoAway
+		b = binary.BigEndian.AppendUint32(b, f.LastStreamID&0x7FFFFFFF)
+		b = binary.BigEndian.AppendUint32(b, uint32(f.ErrCode))
+		b = append(b, f.DebugData...)
+	case *WindowUpdateFrame:
+		h.Type = TypeWindowUpdate
+		b = binary.BigEndian.AppendUint32(b, f.Increment&0x7FFFFFFF)
+	case *ContinuationFrame:
+		h.Type = TypeContinuation
+		b = append(b, f.BlockFragment...)
+	case *PriorityUpdateFrame:
+		h.Type = TypePriorityUpdate
+		b = binary.BigEndian.AppendUint32(b, f.PrioritizedStreamID&0x7FFFFFFF)
+		b = append(b, f.FieldValue...)
+	case *UnknownFrame:
+		b = append(b, f.Payload...)
+	default:
+		return fmt.Errorf("frame: cannot write %T", f)
+	}
+
+	length := len(b) - HeaderLen
+	if length > MaxMaxFrameSize {
+		return fmt.Errorf("frame: %s payload of %d bytes is too large", h.Type, length)
+	}
+	b[0], b[1], b[2] = byte(length>>16), byte(length>>8), byte(length)
+	b[3] = byte(h.Type)
+	b[4] = byte(h.Flags)
+	binary.BigEndian.PutUint32(b[5:], h.StreamID&0x7FFFFFFF)
+
+	fr.wbuf = b
+	_, err := fr.w.Write(b)
+	return err
+}
+
+// appendPadded appends data with the Pad Length field in front and the zero
+// padding behind if the PADDED flag is set.
+func appendPadded(b []byte, h FrameHeader, padLength uint8, data []byte) []byte {
+	if !h.Flags.Has(FlagPadded) {
+		return append(b, data...)
+	}
+	b = append(b, padLength)
+	b = append(b, data...)
+	return append(b, make([]byte, padLength)...)
+}
+
+func appendPriority(b []byte, p PriorityParam) []byte {
+	dep := p.StreamDep & 0x7FFFFFFF
+	if p.Exclusive {
+		dep |= 0x80000000
+	}
+	b = binary.BigEndian.AppendUint32(b, dep)
+	return append(b, p.Weight)
+}
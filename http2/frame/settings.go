@@ -0,0 +1,180 @@
+package frame
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// SettingID identifies a SETTINGS parameter.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-defined-settings
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+	// SettingNoRFC7540Priorities is defined by RFC 9218.
+	// https://datatracker.ietf.org/doc/html/rfc9218#name-disabling-rfc-7540-priorit
+	SettingNoRFC7540Priorities SettingID = 0x9
+)
+
+var settingNames = map[SettingID]string{
+	SettingHeaderTableSize:      "HEADER_TABLE_SIZE",
+	SettingEnablePush:           "ENABLE_PUSH",
+	SettingMaxConcurrentStreams: "MAX_CONCURRENT_STREAMS",
+	SettingInitialWindowSize:    "INITIAL_WINDOW_SIZE",
+	SettingMaxFrameSize:         "MAX_FRAME_SIZE",
+	SettingMaxHeaderListSize:    "MAX_HEADER_LIST_SIZE",
+	SettingNoRFC7540Priorities:  "NO_RFC7540_PRIORITIES",
+}
+
+func (id SettingID) String() string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_SETTING_0x%x", uint16(id))
+}
+
+// Setting is one parameter of a SETTINGS frame: a 16 bit identifier and a
+// 32 bit value.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-settings-format
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("%s = %d", s.ID, s.Val)
+}
+
+// ParseSettings parses the payload of a SETTINGS frame, which is also the
+// value of the HTTP2-Settings header of an h2c upgrade (base64url encoded).
+// https://datatracker.ietf.org/doc/html/rfc7540#section-3.2.1
+func ParseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, ConnectionError{ErrCodeFrameSize, fmt.Sprintf("SETTINGS length %d is not a multiple of 6", len(p))}
+	}
+	var settings []Setting
+	for i := 0; i < len(p); i += 6 {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p[i:])),
+			Val: binary.BigEndian.Uint32(p[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+// AppendSettings appends settings to b in the SETTINGS payload format.
+func AppendSettings(b []byte, settings []Setting) []byte {
+	for _, s := range settings {
+		b = binary.BigEndian.AppendUint16(b, uint16(s.ID))
+		b = binary.BigEndian.AppendUint32(b, s.Val)
+	}
+	return b
+}
+
+// MaxWindowSize is the largest a flow-control window may grow.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-the-window_update-frame
+const MaxWindowSize = 1<<31 - 1
+
+// Settings holds the value of every SETTINGS parameter for one side of a
+// connection.
+type Settings struct {
+	HeaderTableSize uint32
+	EnablePush      bool
+	// MaxConcurrentStreams is math.MaxUint32 when there is no limit.
+	MaxConcurrentStreams uint32
+	InitialWindowSize    uint32
+	MaxFrameSize         uint32
+	// MaxHeaderListSize is math.MaxUint32 when there is no limit.
+	MaxHeaderListSize uint32
+	// NoRFC7540Priorities tells the peer that the RFC 7540 priority
+	// signals are ignored, so it can stop sending them.
+	NoRFC7540Priorities bool
+}
+
+// DefaultSettings returns the initial values every endpoint assumes until
+// its peer's SETTINGS frame says otherwise.
+func DefaultSettings() Settings {
+	return Settings{
+		HeaderTableSize:      4096,
+		EnablePush:           true,
+		MaxConcurrentStreams: math.MaxUint32,
+		InitialWindowSize:    65535,
+		MaxFrameSize:         MinMaxFrameSize,
+		MaxHeaderListSize:    math.MaxUint32,
+	}
+}
+
+// Set validates val and stores it in the parameter identified by id.
+// Unknown parameters are ignored as RFC 9113 requires.
+func (s *Settings) Set(id SettingID, val uint32) error {
+	switch id {
+	case SettingHeaderTableSize:
+		s.HeaderTableSize = val
+	case SettingEnablePush:
+		if val > 1 {
+			return ConnectionError{ErrCodeProtocol, fmt.Sprintf("invalid ENABLE_PUSH %d", val)}
+		}
+		s.EnablePush = val == 1
+	case SettingMaxConcurrentStreams:
+		s.MaxConcurrentStreams = val
+	case SettingInitialWindowSize:
+		if val > MaxWindowSize {
+			return ConnectionError{ErrCodeFlowControl, fmt.Sprintf("invalid INITIAL_WINDOW_SIZE %d", val)}
+		}
+		s.InitialWindowSize = val
+	case SettingMaxFrameSize:
+		if val < MinMaxFrameSize || val > MaxMaxFrameSize {
+			return ConnectionError{ErrCodeProtocol, fmt.Sprintf("invalid MAX_FRAME_SIZE %d", val)}
+		}
+		s.MaxFrameSize = val
+	case SettingMaxHeaderListSize:
+		s.MaxHeaderListSize = val
+	case SettingNoRFC7540Priorities:
+		if val > 1 {
+			return ConnectionError{ErrCodeProtocol, fmt.Sprintf("invalid NO_RFC7540_PRIORITIES %d", val)}
+		}
+		s.NoRFC7540Priorities = val == 1
+	}
+	return nil
+}
+
+// Validate checks every parameter against the ranges allowed by RFC 9113.
+func (s Settings) Validate() error {
+	check := DefaultSettings()
+	for _, p := range s.Params() {
+		if err := check.Set(p.ID, p.Val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Params lists the parameters worth advertising. Values that are the
+// protocol default anyway, push enabled and no limit, are left out; a
+// server must not send ENABLE_PUSH 1 in any case.
+func (s Settings) Params() []Setting {
+	params := []Setting{
+		{ID: SettingHeaderTableSize, Val: s.HeaderTableSize},
+		{ID: SettingInitialWindowSize, Val: s.InitialWindowSize},
+		{ID: SettingMaxFrameSize, Val: s.MaxFrameSize},
+	}
+	if !s.EnablePush {
+		params = append(params, Setting{ID: SettingEnablePush, Val: 0})
+	}
+	if s.MaxConcurrentStreams != math.MaxUint32 {
+		params = append(params, Setting{ID: SettingMaxConcurrentStreams, Val: s.MaxConcurrentStreams})
+	}
+	if s.MaxHeaderListSize != math.MaxUint32 {
+		params = append(params, Setting{ID: SettingMaxHeaderListSize, Val: s.MaxHeaderListSize})
+	}
+	if s.NoRFC7540Priorities {
+		params = append(params, Setting{ID: SettingNoRFC7540Priorities, Val: 1})
+	}
+	return params
+}
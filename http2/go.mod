@@ -1,5 +1,3 @@
 module github.com/nethish/fromscratch/http2
 
 go 1.24.0
-
-require golang.org/x/net v0.39.0
@@ -0,0 +1,169 @@
+// Package grpc holds the gRPC over HTTP/2 wire format, shared by the server
+// and the client.
+//
+// A gRPC call is a POST to "/package.Service/Method" with content-type
+// application/grpc. Both bodies are a sequence of messages, each with a
+// 5-byte prefix: a compressed flag and a 4-byte big-endian length. The
+// response ends with grpc-status and grpc-message in the trailers, or in
+// the headers if there is nothing else to send ("Trailers-Only").
+// Messages are opaque bytes here, usually encoded protobufs.
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content-type of gRPC requests and responses.
+const ContentType = "application/grpc"
+
+// IsContentType reports whether a content-type header names gRPC, with or
+// without a message format such as "+proto".
+func IsContentType(ct string) bool {
+	rest, ok := strings.CutPrefix(ct, ContentType)
+	return ok && (rest == "" || rest[0] == '+' || rest[0] == ';')
+}
+
+// Code is the status code of a call, sent as grpc-status.
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+type Code uint32
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = map[Code]string{
+	OK:                 "OK",
+	Canceled:           "CANCELLED",
+	Unknown:            "UNKNOWN",
+	InvalidArgument:    "INVALID_ARGUMENT",
+	DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	NotFound:           "NOT_FOUND",
+	AlreadyExists:      "ALREADY_EXISTS",
+	PermissionDenied:   "PERMISSION_DENIED",
+	ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	FailedPrecondition: "FAILED_PRECONDITION",
+	Aborted:            "ABORTED",
+	OutOfRange:         "OUT_OF_RANGE",
+	Unimplemented:      "UNIMPLEMENTED",
+	Internal:           "INTERNAL",
+	Unavailable:        "UNAVAILABLE",
+	DataLoss:           "DATA_LOSS",
+	Unauthenticated:    "UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("CODE_%d", uint32(c))
+}
+
+// Status is how a call ended. A *Status with a code other than OK is also
+// the error of a failed call.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	if s.Message == "" {
+		return "grpc: " + s.Code.String()
+	}
+	return fmt.Sprintf("grpc: %s: %s", s.Code, s.Message)
+}
+
+// Errorf returns a *Status error with the given code and message.
+func Errorf(code Code, format string, args ...any) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// StatusOf returns the status a call ends with when its handler returns
+// err: OK for nil, the status itself for a *Status, CANCELLED or
+// DEADLINE_EXCEEDED for context errors and UNKNOWN for anything else.
+func StatusOf(err error) *Status {
+	var s *Status
+	switch {
+	case err == nil:
+		return &Status{Code: OK}
+	case errors.As(err, &s):
+		return s
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// HTTPStatusCode is the code of a call whose response is not gRPC at all,
+// only an HTTP status, e.g. from a proxy in between.
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func HTTPStatusCode(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	}
+	return Unknown
+}
+
+// EncodeMessage percent-encodes a status message for grpc-message, which
+// only carries printable ASCII.
+func EncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeMessage undoes EncodeMessage. Malformed escapes are kept as they
+// are.
+func DecodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package grpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	var b []byte
+	b = AppendMessage(b, []byte("hello"))
+	b = AppendMessage(b, nil)
+	if want := "\x00\x00\x00\x00\x05hello\x00\x00\x00\x00\x00"; string(b) != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+
+	r := bytes.NewReader(b)
+	for _, want := range []string{"hello", ""} {
+		msg, err := ReadMessage(r, 0)
+		if err != nil || string(msg) != want {
+			t.Fatalf("got %q, %v, want %q", msg, err, want)
+		}
+	}
+	if _, err := ReadMessage(r, 0); err != io.EOF {
+		t.Fatalf("got %v at the end, want io.EOF", err)
+	}
+
+	for _, tt := range []struct {
+		body string
+		code Code
+	}{
+		{"\x00\x00\x00", Internal},
+		{"\x00\x00\x00\x00\x03he", Internal},
+		{"\x01\x00\x00\x00\x01x", Internal},
+		{"\x00\x00\x00\x00\x05hello", ResourceExhausted},
+	} {
+		_, err := ReadMessage(bytes.NewReader([]byte(tt.body)), 4)
+		var s *Status
+		if !errors.As(err, &s) || s.Code != tt.code {
+			t.Errorf("%q: got %v, want %s", tt.body, err, tt.code)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0n"},
+		{1500 * time.Microsecond, "1500000n"},
+		{2 * time.Second, "2000000u"},
+		{time.Hour, "3600000m"},
+		{1000 * time.Hour, "3600000S"},
+	} {
+		if got := EncodeTimeout(tt.d); got != tt.want {
+			t.Errorf("EncodeTimeout(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+		if got, err := ParseTimeout(EncodeTimeout(tt.d)); err != nil || got != tt.d {
+			t.Errorf("ParseTimeout(EncodeTimeout(%v)) = %v, %v", tt.d, got, err)
+		}
+	}
+	for _, s := range []string{"", "1", "1x", "-1S", "123456789S"} {
+		if _, err := ParseTimeout(s); err == nil {
+			t.Errorf("ParseTimeout(%q) passed", s)
+		}
+	}
+}
+
+func TestStatusMessage(t *testing.T) {
+	msg := "100% sure\nwith ünïcode"
+	encoded := EncodeMessage(msg)
+	if encoded != "100%25 sure%0Awith %C3%BCn%C3%AFcode" {
+		t.Errorf("EncodeMessage = %q", encoded)
+	}
+	if got := DecodeMessage(encoded); got != msg {
+		t.Errorf("DecodeMessage = %q", got)
+	}
+	if got := DecodeMessage("50%"); got != "50%" {
+		t.Errorf("DecodeMessage kept %q", got)
+	}
+}
@@ -0,0 +1,121 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Length-Prefixed-Message
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
+//
+// +---------------+-----------------------------------------------+
+// | Compressed (8)|               Message Length (32)             |
+// +---------------+-----------------------------------------------+
+// |                        Message (*)                          ...
+// +---------------------------------------------------------------+
+
+// prefixLen is the size of the prefix before every message.
+const prefixLen = 5
+
+// DefaultMaxMessageSize is the largest message ReadMessage accepts when
+// given no limit, as in other gRPC implementations.
+const DefaultMaxMessageSize = 4 << 20
+
+// AppendMessage appends msg with its prefix to b. Messages are never
+// compressed here.
+func AppendMessage(b, msg []byte) []byte {
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// ReadMessage reads the next message from r. It returns io.EOF if the
+// body ends between messages, and a *Status error for a truncated or
+// compressed message or one bigger than maxSize (DefaultMaxMessageSize if
+// zero).
+func ReadMessage(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	var prefix [prefixLen]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, Errorf(Internal, "body ends inside a message prefix")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		// Nothing here offers a grpc-encoding, so nothing may be compressed
+		return nil, Errorf(Internal, "compressed message without grpc-encoding")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if uint64(n) > uint64(maxSize) {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes is larger than %d", n, maxSize)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, Errorf(Internal, "body ends inside a message of %d bytes", n)
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Timeout units of grpc-timeout, largest first. The value is at most 8
+// digits long.
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md#requests
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'H', time.Hour},
+	{'M', time.Minute},
+	{'S', time.Second},
+	{'m', time.Millisecond},
+	{'u', time.Microsecond},
+	{'n', time.Nanosecond},
+}
+
+const maxTimeoutValue = 99999999
+
+// EncodeTimeout formats d for grpc-timeout in the finest unit that fits
+// into 8 digits.
+func EncodeTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for i := len(timeoutUnits) - 1; i >= 0; i-- {
+		u := timeoutUnits[i]
+		// Round up, so that the deadline is never earlier than asked
+		v := (d + u.d - 1) / u.d
+		if v <= maxTimeoutValue {
+			return strconv.FormatInt(int64(v), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(maxTimeoutValue) + "H"
+}
+
+// ParseTimeout parses a grpc-timeout value.
+func ParseTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, Errorf(Internal, "malformed grpc-timeout %q", s)
+	}
+	v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, Errorf(Internal, "malformed grpc-timeout %q", s)
+	}
+	for _, u := range timeoutUnits {
+		if u.unit == s[len(s)-1] {
+			if time.Duration(v) > (1<<63-1)/u.d {
+				// More than 292 years is as good as no deadline
+				return 1<<63 - 1, nil
+			}
+			return time.Duration(v) * u.d, nil
+		}
+	}
+	return 0, Errorf(Internal, "malformed grpc-timeout %q", s)
+}
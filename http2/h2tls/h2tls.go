@@ -0,0 +1,129 @@
+// Package h2tls holds the TLS rules RFC 9113 sets for HTTP/2, shared by the
+// server and the client.
+//
+// Over TLS the protocol is chosen with ALPN: both sides offer "h2" and the
+// connection only speaks HTTP/2 if the handshake settles on it. HTTP/2 also
+// needs TLS 1.2 or later, and with TLS 1.2 an ephemeral key exchange and an
+// AEAD cipher; anything else is INADEQUATE_SECURITY.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-use-of-tls-features
+package h2tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// NextProto is the ALPN protocol ID of HTTP/2 over TLS.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-3.2-2
+const NextProto = "h2"
+
+// Config returns a copy of base (which may be nil) that offers "h2" first
+// through ALPN, refuses anything older than TLS 1.2 and, unless base picks
+// its own, only enables the TLS 1.2 cipher suites HTTP/2 allows.
+func Config(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base == nil {
+		config = &tls.Config{}
+	} else {
+		config = base.Clone()
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if !slices.Contains(config.NextProtos, NextProto) {
+		config.NextProtos = append([]string{NextProto}, config.NextProtos...)
+	}
+	if config.CipherSuites == nil {
+		for _, cs := range tls.CipherSuites() {
+			if !BadCipherSuite(cs.ID) {
+				config.CipherSuites = append(config.CipherSuites, cs.ID)
+			}
+		}
+	}
+	return config
+}
+
+// BadCipherSuite reports whether a TLS 1.2 cipher suite is on the RFC 9113
+// block list. The list is every suite without an ephemeral key exchange
+// (ECDHE or DHE) or without an AEAD cipher (GCM, CCM or ChaCha20-Poly1305),
+// which is how this checks it. TLS 1.3 suites are always fine.
+// https://datatracker.ietf.org/doc/html/rfc9113#appendix-A
+func BadCipherSuite(id uint16) bool {
+	name := tls.CipherSuiteName(id)
+	if !strings.HasPrefix(name, "TLS_") {
+		// Unknown to crypto/tls
+		return true
+	}
+	if !strings.Contains(name, "_WITH_") {
+		// TLS 1.3 suites name no key exchange
+		return false
+	}
+	ephemeral := strings.HasPrefix(name, "TLS_ECDHE_") || strings.HasPrefix(name, "TLS_DHE_")
+	aead := strings.Contains(name, "_GCM_") || strings.Contains(name, "_CCM") || strings.Contains(name, "_CHACHA20_POLY1305")
+	return !ephemeral || !aead
+}
+
+// Check returns an INADEQUATE_SECURITY connection error if a completed
+// handshake does not meet RFC 9113's requirements.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-9.2.1
+func Check(state tls.ConnectionState) error {
+	if state.Version < tls.VersionTLS12 {
+		return frame.ConnectionError{Code: frame.ErrCodeInadequateSecurity, Reason: fmt.Sprintf("TLS version 0x%x is older than 1.2", state.Version)}
+	}
+	if state.Version == tls.VersionTLS12 && BadCipherSuite(state.CipherSuite) {
+		return frame.ConnectionError{Code: frame.ErrCodeInadequateSecurity, Reason: "prohibited cipher suite " + tls.CipherSuiteName(state.CipherSuite)}
+	}
+	return nil
+}
+
+// SelfSigned returns a certificate for hosts (names or IP addresses) that
+// signs itself. Clients only accept it when told to skip verification or
+// to trust it explicitly, so it is meant for local testing.
+func SelfSigned(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fromscratch http2"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,38 @@
+package h2tls
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestBadCipherSuite(t *testing.T) {
+	for _, tt := range []struct {
+		id  uint16
+		bad bool
+	}{
+		{tls.TLS_AES_128_GCM_SHA256, false},
+		{tls.TLS_CHACHA20_POLY1305_SHA256, false},
+		{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, true},
+		{tls.TLS_RSA_WITH_AES_128_GCM_SHA256, true},
+		{tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA, true},
+		{0xffff, true},
+	} {
+		if got := BadCipherSuite(tt.id); got != tt.bad {
+			t.Errorf("BadCipherSuite(%s) = %v, want %v", tls.CipherSuiteName(tt.id), got, tt.bad)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if err := Check(tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}); err != nil {
+		t.Errorf("TLS 1.3: %v", err)
+	}
+	if err := Check(tls.ConnectionState{Version: tls.VersionTLS11, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}); err == nil {
+		t.Error("TLS 1.1 passed")
+	}
+	if err := Check(tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}); err == nil {
+		t.Error("CBC under TLS 1.2 passed")
+	}
+}
@@ -0,0 +1,166 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Decoder turns header blocks back into header fields. Like the Encoder on
+// the other end it keeps its dynamic table across blocks.
+type Decoder struct {
+	table dynamicTable
+
+	// allowedMaxSize is our SETTINGS_HEADER_TABLE_SIZE: the largest table
+	// the peer's encoder may ask for with a dynamic table size update.
+	allowedMaxSize uint32
+
+	// maxStringLength limits every decoded name and value, 0 means no limit.
+	maxStringLength int
+	// maxListSize limits the size of a decoded block, 0 means no limit.
+	maxListSize uint32
+}
+
+// NewDecoder returns a Decoder whose dynamic table may grow up to
+// maxDynamicTableSize bytes.
+func NewDecoder(maxDynamicTableSize uint32) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxDynamicTableSize},
+		allowedMaxSize: maxDynamicTableSize,
+	}
+}
+
+// SetAllowedMaxDynamicTableSize sets the largest table size the encoder may
+// switch to, normally our advertised SETTINGS_HEADER_TABLE_SIZE.
+func (d *Decoder) SetAllowedMaxDynamicTableSize(v uint32) {
+	d.allowedMaxSize = v
+}
+
+// SetMaxDynamicTableSize resizes the dynamic table directly.
+func (d *Decoder) SetMaxDynamicTableSize(v uint32) {
+	d.table.setMaxSize(v)
+}
+
+// SetMaxStringLength rejects names and values longer than n bytes.
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLength = n
+}
+
+// SetMaxHeaderListSize makes DecodeFull give up on a block whose fields
+// add up to more than n bytes, counted as in SETTINGS_MAX_HEADER_LIST_SIZE.
+// A few bytes of indexed fields can refer to the same big table entry over
+// and over, so without a limit a small block may decode into gigabytes.
+func (d *Decoder) SetMaxHeaderListSize(n uint32) {
+	d.maxListSize = n
+}
+
+// ErrHeaderListTooLarge is returned by DecodeFull for a block bigger than
+// the limit set with SetMaxHeaderListSize. Unlike other errors it leaves
+// the dynamic table intact: the rest of the block is still decoded, but
+// its fields are dropped.
+var ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+
+// DecodeFull decodes a complete header block.
+//
+// Any error other than ErrHeaderListTooLarge leaves the dynamic table in
+// an unknown state, which HTTP/2 treats as a COMPRESSION_ERROR for the
+// whole connection.
+func (d *Decoder) DecodeFull(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var size uint64
+	tooLarge := false
+	p := block
+	// Size updates are only allowed before the first field of a block
+	sawField := false
+	for len(p) > 0 {
+		var (
+			hf  HeaderField
+			err error
+		)
+		b := p[0]
+		switch {
+		case b&0x80 != 0:
+			// Indexed Header Field
+			// https://datatracker.ietf.org/doc/html/rfc7541#section-6.1
+			var idx uint64
+			idx, p, err = readInteger(p, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if hf, ok = d.table.at(idx); !ok {
+				return nil, fmt.Errorf("%w %d", errInvalidIndex, idx)
+			}
+		case b&0xc0 == 0x40:
+			// Literal Header Field with Incremental Indexing
+			// https://datatracker.ietf.org/doc/html/rfc7541#section-6.2.1
+			if hf, p, err = d.readLiteral(p, 6); err != nil {
+				return nil, err
+			}
+			d.table.add(hf)
+		case b&0xe0 == 0x20:
+			// Dynamic Table Size Update
+			// https://datatracker.ietf.org/doc/html/rfc7541#section-6.3
+			var size uint64
+			size, p, err = readInteger(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if sawField || size > uint64(d.allowedMaxSize) {
+				return nil, errTableSizeUpdate
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		case b&0xf0 == 0x10:
+			// Literal Header Field Never Indexed
+			// https://datatracker.ietf.org/doc/html/rfc7541#section-6.2.3
+			if hf, p, err = d.readLiteral(p, 4); err != nil {
+				return nil, err
+			}
+			hf.Sensitive = true
+		default:
+			// Literal Header Field without Indexing
+			// https://datatracker.ietf.org/doc/html/rfc7541#section-6.2.2
+			if hf, p, err = d.readLiteral(p, 4); err != nil {
+				return nil, err
+			}
+		}
+		sawField = true
+		size += uint64(hf.Size())
+		if d.maxListSize > 0 && size > uint64(d.maxListSize) {
+			tooLarge = true
+			fields = nil
+		}
+		if !tooLarge {
+			fields = append(fields, hf)
+		}
+	}
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// readLiteral decodes a literal representation whose name index has an
+// n-bit prefix. Index 0 means the name follows as a string literal.
+func (d *Decoder) readLiteral(p []byte, n uint8) (HeaderField, []byte, error) {
+	var hf HeaderField
+	nameIdx, p, err := readInteger(p, n)
+	if err != nil {
+		return hf, nil, err
+	}
+	if nameIdx == 0 {
+		if hf.Name, p, err = readString(p, d.maxStringLength); err != nil {
+			return hf, nil, err
+		}
+	} else {
+		e, ok := d.table.at(nameIdx)
+		if !ok {
+			return hf, nil, fmt.Errorf("%w %d", errInvalidIndex, nameIdx)
+		}
+		hf.Name = e.Name
+	}
+	if hf.Value, p, err = readString(p, d.maxStringLength); err != nil {
+		return hf, nil, err
+	}
+	return hf, p, nil
+}
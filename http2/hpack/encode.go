@@ -0,0 +1,100 @@
+package hpack
+
+import "io"
+
+const initialTableSize = 4096
+
+// Encoder compresses header fields into header blocks. It keeps its dynamic
+// table for as long as it is used, so one Encoder belongs to one connection.
+type Encoder struct {
+	w     io.Writer
+	buf   []byte
+	table dynamicTable
+
+	// maxSizeLimit is the peer decoder's SETTINGS_HEADER_TABLE_SIZE
+	maxSizeLimit uint32
+	// A size change must be announced at the start of the next block.
+	// minSize is the smallest size since the last announcement, which must
+	// be announced too if the table shrank and grew again.
+	// https://datatracker.ietf.org/doc/html/rfc7541#section-4.2
+	sizeUpdate bool
+	minSize    uint32
+}
+
+// NewEncoder returns an Encoder that writes header blocks to w. Its table
+// starts at the default size of 4096 bytes.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:            w,
+		table:        dynamicTable{maxSize: initialTableSize},
+		maxSizeLimit: initialTableSize,
+	}
+}
+
+// WriteField encodes hf and writes it to the Encoder's writer. Fields are
+// indexed whenever possible; sensitive fields are never indexed.
+func (e *Encoder) WriteField(hf HeaderField) error {
+	e.buf = e.buf[:0]
+
+	if e.sizeUpdate {
+		e.sizeUpdate = false
+		if e.minSize < e.table.maxSize {
+			e.buf = appendInteger(e.buf, 0x20, 5, uint64(e.minSize))
+		}
+		e.buf = appendInteger(e.buf, 0x20, 5, uint64(e.table.maxSize))
+	}
+
+	idx, exact := e.table.search(hf)
+	switch {
+	case exact && !hf.Sensitive:
+		// Indexed Header Field
+		e.buf = appendInteger(e.buf, 0x80, 7, idx)
+	case hf.Sensitive:
+		// Literal Header Field Never Indexed
+		e.buf = e.appendLiteral(e.buf, 0x10, 4, idx, hf)
+	case hf.Size() <= e.table.maxSize:
+		// Literal Header Field with Incremental Indexing
+		e.buf = e.appendLiteral(e.buf, 0x40, 6, idx, hf)
+		e.table.add(hf)
+	default:
+		// Literal Header Field without Indexing: it would not fit anyway
+		e.buf = e.appendLiteral(e.buf, 0x00, 4, idx, hf)
+	}
+
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// appendLiteral encodes a literal representation. The name is taken from
+// the table when nameIdx is not 0.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-6.2
+func (e *Encoder) appendLiteral(dst []byte, first byte, n uint8, nameIdx uint64, hf HeaderField) []byte {
+	dst = appendInteger(dst, first, n, nameIdx)
+	if nameIdx == 0 {
+		dst = appendString(dst, hf.Name)
+	}
+	return appendString(dst, hf.Value)
+}
+
+// SetMaxDynamicTableSize changes the size of the dynamic table, capped by
+// the limit set with SetMaxDynamicTableSizeLimit. The change is announced
+// at the start of the next header block.
+func (e *Encoder) SetMaxDynamicTableSize(v uint32) {
+	v = min(v, e.maxSizeLimit)
+	if !e.sizeUpdate {
+		e.sizeUpdate = true
+		e.minSize = v
+	}
+	e.minSize = min(e.minSize, v)
+	e.table.setMaxSize(v)
+}
+
+// SetMaxDynamicTableSizeLimit sets the largest table the peer's decoder
+// accepts, i.e. its SETTINGS_HEADER_TABLE_SIZE. The table shrinks if it is
+// currently bigger.
+func (e *Encoder) SetMaxDynamicTableSizeLimit(v uint32) {
+	e.maxSizeLimit = v
+	if e.table.maxSize > v {
+		e.SetMaxDynamicTableSize(v)
+	}
+}
@@ -0,0 +1,141 @@
+// Package hpack implements HPACK, the header compression of HTTP/2.
+// https://datatracker.ietf.org/doc/html/rfc7541
+//
+// A header block is a sequence of representations. Each one either points
+// at an entry of the static or dynamic table, or carries a literal name
+// and/or value that may be added to the dynamic table:
+//
+//	1xxxxxxx  Indexed Header Field               (7 bit index)
+//	01xxxxxx  Literal with Incremental Indexing  (6 bit name index)
+//	001xxxxx  Dynamic Table Size Update          (5 bit size)
+//	0001xxxx  Literal Never Indexed              (4 bit name index)
+//	0000xxxx  Literal without Indexing           (4 bit name index)
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single header name/value pair.
+type HeaderField struct {
+	Name, Value string
+
+	// Sensitive fields are sent as "never indexed" literals so that no
+	// intermediary ever puts them in a compression table.
+	// https://datatracker.ietf.org/doc/html/rfc7541#section-7.1.3
+	Sensitive bool
+}
+
+// Size is the size of the field in the dynamic table: the length of the
+// name and value plus 32 bytes of overhead.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-4.1
+func (hf HeaderField) Size() uint32 {
+	return uint32(len(hf.Name) + len(hf.Value) + 32)
+}
+
+func (hf HeaderField) String() string {
+	var suffix string
+	if hf.Sensitive {
+		suffix = " (sensitive)"
+	}
+	return fmt.Sprintf("%s: %s%s", hf.Name, hf.Value, suffix)
+}
+
+var (
+	errNeedMore        = errors.New("hpack: truncated header block")
+	errIntegerOverflow = errors.New("hpack: integer overflow")
+	errInvalidIndex    = errors.New("hpack: invalid table index")
+	errInvalidHuffman  = errors.New("hpack: invalid Huffman-encoded string")
+	errTableSizeUpdate = errors.New("hpack: invalid dynamic table size update")
+	errStringLength    = errors.New("hpack: string literal too long")
+)
+
+// appendInteger encodes i with an n-bit prefix. The high bits of first are
+// the representation's pattern and are kept as they are.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-5.1
+func appendInteger(dst []byte, first byte, n uint8, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i%128)|0x80)
+		i /= 128
+	}
+	return append(dst, byte(i))
+}
+
+// readInteger decodes an integer with an n-bit prefix from the start of p
+// and returns it with the rest of p.
+func readInteger(p []byte, n uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errNeedMore
+	}
+	max := uint64(1)<<n - 1
+	i := uint64(p[0]) & max
+	p = p[1:]
+	if i < max {
+		return i, p, nil
+	}
+
+	var m uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		i += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return i, p, nil
+		}
+		m += 7
+		// Nothing in HTTP/2 comes close to needing more than 32 bits
+		if m >= 63 || i > 1<<32 {
+			return 0, nil, errIntegerOverflow
+		}
+	}
+	return 0, nil, errNeedMore
+}
+
+// appendString encodes s as a string literal, Huffman coded whenever that
+// is no longer.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-5.2
+func appendString(dst []byte, s string) []byte {
+	if n := HuffmanEncodeLength(s); n <= uint64(len(s)) {
+		dst = appendInteger(dst, 0x80, 7, n)
+		return AppendHuffmanString(dst, s)
+	}
+	dst = appendInteger(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readString decodes a string literal from the start of p. Strings longer
+// than maxLen are rejected before they are decoded.
+func readString(p []byte, maxLen int) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errNeedMore
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInteger(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, errNeedMore
+	}
+	raw := p[:n]
+	p = p[n:]
+
+	if !huffman {
+		if maxLen > 0 && len(raw) > maxLen {
+			return "", nil, errStringLength
+		}
+		return string(raw), p, nil
+	}
+	s, err := HuffmanDecodeToString(raw, maxLen)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, p, nil
+}
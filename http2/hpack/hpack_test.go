@@ -0,0 +1,275 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.1
+func TestIntegerRepresentation(t *testing.T) {
+	tests := []struct {
+		i      uint64
+		prefix uint8
+		want   []byte
+	}{
+		{10, 5, []byte{0x0a}},
+		{1337, 5, []byte{0x1f, 0x9a, 0x0a}},
+		{42, 8, []byte{0x2a}},
+	}
+	for _, tt := range tests {
+		got := appendInteger(nil, 0, tt.prefix, tt.i)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendInteger(%d, %d) = %x, want %x", tt.i, tt.prefix, got, tt.want)
+		}
+		i, rest, err := readInteger(tt.want, tt.prefix)
+		if err != nil || i != tt.i || len(rest) != 0 {
+			t.Errorf("readInteger(%x, %d) = %d, %x, %v", tt.want, tt.prefix, i, rest, err)
+		}
+	}
+}
+
+type exampleBlock struct {
+	wire      string
+	fields    []HeaderField
+	tableSize uint32
+}
+
+func checkDecode(t *testing.T, d *Decoder, blocks []exampleBlock) {
+	t.Helper()
+	for i, b := range blocks {
+		got, err := d.DecodeFull(mustHex(t, b.wire))
+		if err != nil {
+			t.Fatalf("block %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(got, b.fields) {
+			t.Errorf("block %d: got %v, want %v", i+1, got, b.fields)
+		}
+		if d.table.size != b.tableSize {
+			t.Errorf("block %d: table size %d, want %d", i+1, d.table.size, b.tableSize)
+		}
+	}
+}
+
+func checkEncode(t *testing.T, tableSize uint32, blocks []exampleBlock) {
+	t.Helper()
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.table.setMaxSize(tableSize)
+	for i, b := range blocks {
+		buf.Reset()
+		for _, hf := range b.fields {
+			if err := e.WriteField(hf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if want := mustHex(t, b.wire); !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("block %d: got %x, want %x", i+1, buf.Bytes(), want)
+		}
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.2
+func TestHeaderFieldRepresentation(t *testing.T) {
+	tests := []struct {
+		name string
+		exampleBlock
+	}{
+		{"C.2.1 literal with indexing", exampleBlock{
+			"400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			[]HeaderField{{Name: "custom-key", Value: "custom-header"}}, 55}},
+		{"C.2.2 literal without indexing", exampleBlock{
+			"040c 2f73 616d 706c 652f 7061 7468",
+			[]HeaderField{{Name: ":path", Value: "/sample/path"}}, 0}},
+		{"C.2.3 literal never indexed", exampleBlock{
+			"1008 7061 7373 776f 7264 0673 6563 7265 74",
+			[]HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, 0}},
+		{"C.2.4 indexed", exampleBlock{
+			"82",
+			[]HeaderField{{Name: ":method", Value: "GET"}}, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkDecode(t, NewDecoder(4096), []exampleBlock{tt.exampleBlock})
+		})
+	}
+}
+
+var (
+	request1 = []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}
+	request2 = append(request1[:4:4], HeaderField{Name: "cache-control", Value: "no-cache"})
+	request3 = []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+
+	response1 = []HeaderField{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}
+	response2 = []HeaderField{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}
+	response3 = []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.3
+func TestRequestsWithoutHuffman(t *testing.T) {
+	checkDecode(t, NewDecoder(4096), []exampleBlock{
+		{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", request1, 57},
+		{"8286 84be 5808 6e6f 2d63 6163 6865", request2, 110},
+		{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", request3, 164},
+	})
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.4
+func TestRequestsWithHuffman(t *testing.T) {
+	blocks := []exampleBlock{
+		{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", request1, 57},
+		{"8286 84be 5886 a8eb 1064 9cbf", request2, 110},
+		{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", request3, 164},
+	}
+	checkDecode(t, NewDecoder(4096), blocks)
+	checkEncode(t, 4096, blocks)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.5
+func TestResponsesWithoutHuffman(t *testing.T) {
+	checkDecode(t, NewDecoder(256), []exampleBlock{
+		{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", response1, 222},
+		{"4803 3330 37c1 c0bf", response2, 222},
+		{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", response3, 215},
+	})
+}
+
+// https://datatracker.ietf.org/doc/html/rfc7541#appendix-C.6
+func TestResponsesWithHuffman(t *testing.T) {
+	blocks := []exampleBlock{
+		{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", response1, 222},
+		{"4883 640e ffc1 c0bf", response2, 222},
+		{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", response3, 215},
+	}
+	checkDecode(t, NewDecoder(256), blocks)
+	checkEncode(t, 256, blocks)
+}
+
+func TestDynamicTableSizeUpdate(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	d := NewDecoder(4096)
+
+	// Shrinking then growing again must announce both sizes
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(1024)
+	e.WriteField(HeaderField{Name: "x-a", Value: "1"})
+	if want := []byte{0x20, 0x3f, 0xe1, 0x07}; !bytes.HasPrefix(buf.Bytes(), want) {
+		t.Fatalf("got %x, want prefix %x", buf.Bytes(), want)
+	}
+	if _, err := d.DecodeFull(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if d.table.maxSize != 1024 {
+		t.Errorf("decoder table size %d, want 1024", d.table.maxSize)
+	}
+
+	// An update above our SETTINGS_HEADER_TABLE_SIZE is an error
+	d.SetAllowedMaxDynamicTableSize(512)
+	if _, err := d.DecodeFull([]byte{0x3f, 0xe1, 0x07}); err == nil {
+		t.Error("size update above the allowed maximum was accepted")
+	}
+	// So is an update after the first field of a block
+	if _, err := NewDecoder(4096).DecodeFull([]byte{0x82, 0x20}); err == nil {
+		t.Error("size update after a field was accepted")
+	}
+}
+
+func TestInvalidHuffman(t *testing.T) {
+	tests := map[string][]byte{
+		"padding longer than 7 bits": {0xff, 0xff},
+		"padding with a zero bit":    {0x1e}, // "a" (00011) padded with 110
+		"EOS in the string":          {0xff, 0xff, 0xff, 0xff},
+	}
+	for name, p := range tests {
+		if s, err := HuffmanDecodeToString(p, 0); err == nil {
+			t.Errorf("%s: decoded %q", name, s)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	d := NewDecoder(4096)
+	fields := []HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: "authorization", Value: "Bearer s3cr3t", Sensitive: true},
+		{Name: "x-binary", Value: "\x00\xff\x7f\x80 all bytes"},
+		{Name: "x-big", Value: strings.Repeat("v", 5000)},
+	}
+	for i := 0; i < 3; i++ {
+		buf.Reset()
+		for _, hf := range fields {
+			e.WriteField(hf)
+		}
+		got, err := d.DecodeFull(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, fields) {
+			t.Fatalf("round %d: got %v, want %v", i, got, fields)
+		}
+	}
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	d := NewDecoder(4096)
+	d.SetMaxHeaderListSize(64 << 10)
+	e.WriteField(HeaderField{Name: "x-big", Value: strings.Repeat("v", 1000)})
+	if _, err := d.DecodeFull(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1000 bytes that each refer to the 1 KB entry would decode to 1 MB
+	bomb := bytes.Repeat([]byte{0xbe}, 1000)
+	if _, err := d.DecodeFull(bomb); err != ErrHeaderListTooLarge {
+		t.Fatalf("got %v, want ErrHeaderListTooLarge", err)
+	}
+	// The table is still in step with the encoder
+	got, err := d.DecodeFull([]byte{0xbe})
+	if err != nil || len(got) != 1 || got[0].Name != "x-big" {
+		t.Errorf("got %v, %v after the oversized block", got, err)
+	}
+}
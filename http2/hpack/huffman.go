@@ -0,0 +1,115 @@
+package hpack
+
+import (
+	"strings"
+	"sync"
+)
+
+// Huffman coding of string literals
+// https://datatracker.ietf.org/doc/html/rfc7541#section-5.2
+//
+// Codes are 5 to 30 bits long and packed most significant bit first. The
+// last byte is padded with the high bits of EOS (all ones), and padding
+// longer than 7 bits or containing a zero is a decoding error.
+
+// HuffmanEncodeLength returns the number of bytes s takes once Huffman coded.
+func HuffmanEncodeLength(s string) uint64 {
+	var bits uint64
+	for i := 0; i < len(s); i++ {
+		bits += uint64(huffmanCodes[s[i]].bits)
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffmanString appends the Huffman coding of s to dst.
+func AppendHuffmanString(dst []byte, s string) []byte {
+	var (
+		acc   uint64 // pending bits, right aligned
+		nbits uint8  // number of pending bits
+	)
+	for i := 0; i < len(s); i++ {
+		c := huffmanCodes[s[i]]
+		acc = acc<<c.bits | uint64(c.code)
+		nbits += c.bits
+		for nbits >= 8 {
+			nbits -= 8
+			dst = append(dst, byte(acc>>nbits))
+		}
+	}
+	if nbits > 0 {
+		// Pad with the most significant bits of EOS
+		pad := 8 - nbits
+		dst = append(dst, byte(acc<<pad|(1<<pad-1)))
+	}
+	return dst
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int // valid for leaves only
+}
+
+func (n *huffmanNode) leaf() bool {
+	return n.children[0] == nil && n.children[1] == nil
+}
+
+var (
+	huffmanRootOnce sync.Once
+	huffmanRoot     *huffmanNode
+)
+
+// buildHuffmanTree turns the code table into a binary tree: 0 goes left,
+// 1 goes right and every symbol ends up at a leaf.
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{}
+	for sym, c := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(c.bits) - 1; i >= 0; i-- {
+			bit := c.code >> uint(i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+}
+
+// HuffmanDecodeToString decodes a Huffman coded string. A maxLen above 0
+// limits the length of the decoded string.
+func HuffmanDecodeToString(p []byte, maxLen int) (string, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+
+	var sb strings.Builder
+	n := huffmanRoot
+	// Bits read since the last complete symbol, and whether they were all 1
+	padBits, padOnes := 0, true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := b >> uint(i) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", errInvalidHuffman
+			}
+			padBits++
+			padOnes = padOnes && bit == 1
+			if !n.leaf() {
+				continue
+			}
+			if n.sym == 256 {
+				// EOS must never appear in the string itself
+				return "", errInvalidHuffman
+			}
+			if maxLen > 0 && sb.Len() >= maxLen {
+				return "", errStringLength
+			}
+			sb.WriteByte(byte(n.sym))
+			n = huffmanRoot
+			padBits, padOnes = 0, true
+		}
+	}
+	if padBits > 7 || !padOnes {
+		return "", errInvalidHuffman
+	}
+	return sb.String(), nil
+}
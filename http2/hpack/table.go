@@ -0,0 +1,101 @@
+package hpack
+
+// dynamicTable is the FIFO of recently used fields that both ends of a
+// connection maintain in lockstep. The newest entry has the lowest index,
+// and the oldest entries are evicted once the table outgrows maxSize.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-2.3.2
+type dynamicTable struct {
+	// entries holds the oldest entry first, so new entries are appended
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) len() int {
+	return len(t.entries)
+}
+
+// add inserts hf as the newest entry, evicting old entries to make room.
+// A field bigger than the whole table just empties it.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-4.4
+func (t *dynamicTable) add(hf HeaderField) {
+	hf.Sensitive = false
+	size := hf.Size()
+	if size > t.maxSize {
+		t.evict(0)
+		return
+	}
+	t.evict(t.maxSize - size)
+	t.entries = append(t.entries, hf)
+	t.size += size
+}
+
+// setMaxSize changes the table capacity, evicting entries that no longer fit.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-4.3
+func (t *dynamicTable) setMaxSize(maxSize uint32) {
+	t.maxSize = maxSize
+	t.evict(maxSize)
+}
+
+// evict drops the oldest entries until the table is no bigger than size.
+func (t *dynamicTable) evict(size uint32) {
+	n := 0
+	for t.size > size {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	copy(t.entries, t.entries[n:])
+	clear(t.entries[len(t.entries)-n:])
+	t.entries = t.entries[:len(t.entries)-n]
+}
+
+// at returns the field at index i of the combined index space: 1 to 61 is
+// the static table and 62 onwards the dynamic table, newest first.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-2.3.3
+func (t *dynamicTable) at(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-int(i)], true
+}
+
+// search looks for hf in both tables. It returns the index of an exact
+// match if there is one, otherwise the index of an entry with the same
+// name, or 0 if the name is unknown.
+func (t *dynamicTable) search(hf HeaderField) (i uint64, nameValueMatch bool) {
+	for j, e := range staticTable {
+		if e.Name != hf.Name {
+			continue
+		}
+		if i == 0 {
+			i = uint64(j + 1)
+		}
+		if e.Value == hf.Value {
+			return uint64(j + 1), true
+		}
+	}
+	for j := len(t.entries) - 1; j >= 0; j-- {
+		e := t.entries[j]
+		if e.Name != hf.Name {
+			continue
+		}
+		idx := uint64(len(staticTable) + len(t.entries) - j)
+		if i == 0 {
+			i = idx
+		}
+		if e.Value == hf.Value {
+			return idx, true
+		}
+	}
+	return i, false
+}
@@ -0,0 +1,81 @@
+// Package pipe buffers the body of a request or response between the read
+// loop, which writes what DATA frames carry, and whoever reads the body.
+// Writes never block: flow control already bounds how much the peer can
+// send.
+package pipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// A Pipe is safe for one writer and one reader at a time.
+type Pipe struct {
+	mu  sync.Mutex
+	c   *sync.Cond
+	b   bytes.Buffer
+	err error
+}
+
+func New() *Pipe {
+	p := &Pipe{}
+	p.c = sync.NewCond(&p.mu)
+	return p
+}
+
+// Write adds data to the buffer. After CloseWithError it is dropped, and
+// Write reports false.
+func (p *Pipe) Write(data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return false
+	}
+	p.b.Write(data)
+	p.c.Broadcast()
+	return true
+}
+
+// Read blocks until there is data or the pipe is closed. Buffered data is
+// read before the close error is returned.
+func (p *Pipe) Read(d []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.b.Len() == 0 && p.err == nil {
+		p.c.Wait()
+	}
+	if p.b.Len() > 0 {
+		return p.b.Read(d)
+	}
+	return 0, p.err
+}
+
+// CloseWithError makes Read return err once the buffer is drained; io.EOF
+// ends the body normally. Any other error throws the buffer away. It
+// returns how many bytes were thrown away; the first close wins.
+func (p *Pipe) CloseWithError(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0
+	}
+	p.err = err
+	p.c.Broadcast()
+	if errors.Is(err, io.EOF) {
+		return 0
+	}
+	n := p.b.Len()
+	p.b.Reset()
+	return n
+}
+
+// Discard throws the buffer away and returns its size.
+func (p *Pipe) Discard() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.b.Len()
+	p.b.Reset()
+	return n
+}
@@ -0,0 +1,683 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/h2tls"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+const (
+
+	// https://datatracker.ietf.org/doc/html/rfc9113#name-http-2-connection-preface
+	// This is how the connection must start for HTTP2
+	clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+)
+
+// serverConn is the state of a single client connection. Stream IDs are
+// only unique within a connection, so every connection owns its streams.
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+
+	mu      sync.Mutex
+	streams map[int]*streamState
+	// Highest stream IDs opened so far; anything above is still idle.
+	maxClientStreamID int
+	maxPushStreamID   int
+	// lastStreamID is the highest client stream we accepted rather than
+	// refused, the Last-Stream-ID of our GOAWAY.
+	lastStreamID int
+	// resetStreams remembers the streams we reset, so that frames the
+	// client sent before it saw our RST_STREAM are quietly dropped. Only
+	// the latest maxResetStreams are kept.
+	resetStreams map[int]bool
+
+	// local is what we advertised, peer is what the client asked for.
+	local Settings
+	peer  Settings
+	// localAcked is set once the client has acknowledged our SETTINGS.
+	localAcked bool
+
+	// Graceful shutdown. GOAWAY may only follow our SETTINGS, so a
+	// shutdown that starts earlier sends it once settingsSent is set.
+	settingsSent bool
+	shuttingDown bool
+	goAwaySent   bool
+	// http1Busy is set while an HTTP/1.x request is being served, see
+	// http1.go.
+	http1Busy bool
+
+	// Connection-level flow control, see flow.go. cond is signalled
+	// whenever a send window grows or the connection closes.
+	cond        *sync.Cond
+	sendWindow  int64
+	recvWindow  int64
+	recvUnacked int64
+	closed      bool
+
+	// HPACK state lives as long as the connection: both sides keep a
+	// dynamic table that every header block may refer to.
+	// https://datatracker.ietf.org/doc/html/rfc7541#section-2.3.2
+	// The decoder is only used by the read loop, the encoder and hbuf only
+	// by the writer, because header blocks must hit the wire in the order
+	// they were encoded.
+	decoder *hpack.Decoder
+	encoder *hpack.Encoder
+	hbuf    bytes.Buffer
+
+	// pendingPriorities holds PRIORITY_UPDATEs for streams that are still
+	// idle, see extpriority.go. Guarded by mu.
+	pendingPriorities map[int]Priority
+
+	// framer reads the client's frames; only used by the read loop. The
+	// writer has a framer of its own.
+	framer *frame.Framer
+	// limit sits between the connection and the reads, to bound HTTP/1.x
+	// header sections, see readHTTP1Request. Only used by the read loop.
+	limit *io.LimitedReader
+
+	// continuing holds a header block whose HEADERS frame came without
+	// END_HEADERS. Until its last CONTINUATION arrives no other frame may
+	// be sent on the connection. Only used by the read loop.
+	continuing *headerBlock
+
+	// limits and buckets keep the client in check, see dos.go. Only used
+	// by the read loop.
+	limits  Limits
+	buckets [numAbuses]tokenBucket
+	// handlers counts the handlers still running for client streams,
+	// even those the client has already reset. Guarded by mu.
+	handlers uint32
+
+	// Keepalive, see ping.go. lastRead is the time the last frame arrived
+	// in Unix nanoseconds; the PING fields are guarded by mu.
+	lastRead    atomic.Int64
+	pingPending bool
+	pingSent    time.Time
+	pingData    [8]byte
+
+	// writeCh feeds the writer goroutine, see writer.go, and sched is the
+	// writer's queue. doneServing is closed when the connection is done
+	// and the writer stops.
+	writeCh     chan FrameWrite
+	sched       WriteScheduler
+	doneServing chan struct{}
+}
+
+// headerBlock is a header block being reassembled from a HEADERS frame and
+// the CONTINUATION frames that follow it.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-field-section-compression-a
+type headerBlock struct {
+	streamID int
+	flags    frame.Flags
+	priority *frame.PriorityParam
+	fragment []byte
+	// continuations counts the CONTINUATION frames so far
+	continuations int
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tc); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		streams:           make(map[int]*streamState),
+		resetStreams:      make(map[int]bool),
+		pendingPriorities: make(map[int]Priority),
+		local:             s.settings(),
+		limits:            s.limits(),
+		peer:              DefaultSettings(),
+		sendWindow:        initialConnWindow,
+		recvWindow:        initialConnWindow,
+		writeCh:           make(chan FrameWrite, 8),
+		sched:             s.newWriteScheduler(),
+		doneServing:       make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	// Reads go through br, so the server can look at the first bytes
+	// before deciding how to speak
+	sc.limit = &io.LimitedReader{R: conn, N: math.MaxInt64}
+	br := bufio.NewReader(sc.limit)
+	sc.framer = frame.NewFramer(nil, br)
+	sc.framer.MaxReadFrameSize = sc.local.MaxFrameSize
+	// Until the client acknowledges our SETTINGS both tables have the
+	// default size of 4096.
+	sc.decoder = hpack.NewDecoder(4096)
+	sc.encoder = hpack.NewEncoder(&sc.hbuf)
+	defer sc.close()
+	go sc.writeLoop()
+	s.trackConn(sc, true)
+	defer s.trackConn(sc, false)
+
+	// Step 0: A client that does not speak HTTP/2 is served HTTP/1.x.
+	// Over cleartext an HTTP/1.1 request may ask to upgrade to h2c; it
+	// then becomes stream 1.
+	var upgraded *streamState
+	if tc, ok := conn.(*tls.Conn); ok {
+		if tc.ConnectionState().NegotiatedProtocol != h2tls.NextProto {
+			sc.serveHTTP1(br, nil)
+			return
+		}
+	} else if !hasPreface(br) {
+		req, err := sc.readHTTP1Request(br)
+		if err != nil {
+			log.Println("Invalid client preface:", err)
+			sc.rejectHTTP1(err)
+			return
+		}
+		settings, err := upgradeSettings(req)
+		if err != nil {
+			if !errors.Is(err, errNoUpgrade) {
+				log.Println("Not upgrading to h2c:", err)
+			}
+			sc.serveHTTP1(br, req)
+			return
+		}
+		upgraded, err = sc.upgrade(req, settings)
+		if errors.Is(err, errBodyTooLarge) {
+			log.Println("Not upgrading to h2c:", err)
+			sc.serveHTTP1(br, req)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	// Step 1: Read client preface
+	preface := make([]byte, len(clientPreface))
+	if _, err := io.ReadFull(br, preface); err != nil {
+		log.Println("Failed to read client preface:", err)
+		return
+	}
+	if string(preface) != clientPreface {
+		log.Printf("Invalid client preface: %q\n", preface)
+		return
+	}
+	log.Println("Received valid HTTP/2 client preface")
+
+	// Step 2: Send our SETTINGS frame
+	if err := sc.writeFrame(&frame.SettingsFrame{Settings: sc.local.Params()}); err != nil {
+		log.Println("Failed to send SETTINGS frame:", err)
+		return
+	}
+	log.Println("Sent SETTINGS frame")
+	sc.mu.Lock()
+	sc.settingsSent = true
+	sc.recvWindow += connRecvWindow - initialConnWindow
+	sc.mu.Unlock()
+	if err := sc.sendWindowUpdate(0, connRecvWindow-initialConnWindow); err != nil {
+		log.Println("Failed to send WINDOW_UPDATE frame:", err)
+		return
+	}
+	if s.inShutdown.Load() {
+		sc.startGracefulShutdown()
+	}
+	sc.lastRead.Store(time.Now().UnixNano())
+	if s.ReadIdleTimeout > 0 {
+		go sc.keepalive(s.ReadIdleTimeout, s.pingTimeout())
+	}
+	if upgraded != nil {
+		// The response may only follow our SETTINGS
+		go sc.serveStream(upgraded)
+	}
+
+	for {
+		err := sc.readFrame()
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			log.Println(streamErr)
+			err = sc.count(AbuseStreamErrors)
+			if err == nil {
+				err = sc.resetStream(int(streamErr.StreamID), streamErr.Code)
+			}
+		}
+		if err != nil {
+			log.Println("Connection closed or error:", err)
+			var connErr ConnectionError
+			if errors.As(err, &connErr) {
+				sc.goAway(connErr.Code, connErr.Reason)
+			}
+			return
+		}
+	}
+}
+
+func (sc *serverConn) readFrame() error {
+	f, err := sc.framer.ReadFrame()
+	var connErr frame.ConnectionError
+	var streamErr frame.StreamError
+	switch {
+	case errors.As(err, &connErr):
+		return connErr
+	case errors.As(err, &streamErr):
+		return sc.streamFrameError(streamErr)
+	case err != nil:
+		return fmt.Errorf("error reading frame: %w", err)
+	}
+	sc.lastRead.Store(time.Now().UnixNano())
+
+	// A header block must be finished before anything else
+	if sc.continuing != nil || f.Header().Type == frame.TypeContinuation {
+		return sc.handleContinuation(f)
+	}
+
+	switch f := f.(type) {
+	case *frame.SettingsFrame:
+		return sc.handleSettings(f)
+	case *frame.PingFrame:
+		return sc.handlePing(f)
+	case *frame.DataFrame:
+		return sc.handleData(f)
+	case *frame.HeadersFrame:
+		var prio *frame.PriorityParam
+		if f.Flags.Has(frame.FlagPriority) {
+			prio = &f.Priority
+		}
+		if !f.Flags.Has(frame.FlagEndHeaders) {
+			// The framer reuses its buffer for the next frame
+			sc.continuing = &headerBlock{streamID: int(f.StreamID), flags: f.Flags, priority: prio, fragment: bytes.Clone(f.BlockFragment)}
+			return nil
+		}
+		return sc.handleHeaders(f.Flags, int(f.StreamID), f.BlockFragment, prio)
+	case *frame.PriorityFrame:
+		return sc.handlePriority(f)
+	case *frame.RSTStreamFrame:
+		return sc.handleRSTStream(f)
+	case *frame.PushPromiseFrame:
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "clients cannot push"}
+	case *frame.GoAwayFrame:
+		return sc.handleGoAway(f)
+	case *frame.WindowUpdateFrame:
+		return sc.handleWindowUpdate(f)
+	case *frame.PriorityUpdateFrame:
+		return sc.handlePriorityUpdate(f)
+	default:
+		log.Printf("Received unknown frame: %s", f.Header())
+	}
+
+	return nil
+}
+
+// streamFrameError turns a malformed frame that only concerns its stream
+// into a StreamError. That is only a PRIORITY frame of the wrong size,
+// which may arrive for an idle stream too; idle streams cannot be reset,
+// so the frame is dropped.
+func (sc *serverConn) streamFrameError(err frame.StreamError) error {
+	if sc.continuing != nil {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("frame on stream %d inside the header block of stream %d", err.StreamID, sc.continuing.streamID)}
+	}
+	sc.mu.Lock()
+	idle := sc.isIdle(int(err.StreamID))
+	sc.mu.Unlock()
+	if idle {
+		return nil
+	}
+	return err
+}
+
+// handleContinuation appends a CONTINUATION frame to the header block being
+// received and handles the block once END_HEADERS arrives. Any other frame,
+// or a CONTINUATION for a different stream, is a PROTOCOL_ERROR.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-continuation
+func (sc *serverConn) handleContinuation(f frame.Frame) error {
+	block := sc.continuing
+	if block == nil {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "CONTINUATION without a preceding HEADERS"}
+	}
+	cont, ok := f.(*frame.ContinuationFrame)
+	if !ok || int(cont.StreamID) != block.streamID {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("%s on stream %d inside the header block of stream %d", f.Header().Type, f.Header().StreamID, block.streamID)}
+	}
+	log.Printf("Stream %d: Received CONTINUATION (len=%d)", block.streamID, len(cont.BlockFragment))
+	// Nothing can be done with a block until it ends, so an endless one
+	// would only eat memory. Empty frames do not grow it, hence the count.
+	block.continuations++
+	if max := sc.limits.MaxContinuations; max > 0 && block.continuations > max {
+		return sc.calm(AbuseContinuationFlood, fmt.Sprintf("more than %d CONTINUATION frames", max))
+	}
+	block.fragment = append(block.fragment, cont.BlockFragment...)
+	// An honest encoder never makes a block bigger than the list it
+	// decodes to, which still gets a 431 between one and two times the
+	// limit.
+	sc.mu.Lock()
+	maxListSize := sc.local.MaxHeaderListSize
+	sc.mu.Unlock()
+	if uint64(len(block.fragment)) > 2*uint64(maxListSize) {
+		return sc.calm(AbuseContinuationFlood, fmt.Sprintf("header block of more than %d bytes", 2*uint64(maxListSize)))
+	}
+	if !cont.Flags.Has(frame.FlagEndHeaders) {
+		return nil
+	}
+	sc.continuing = nil
+	return sc.handleHeaders(block.flags|frame.FlagEndHeaders, block.streamID, block.fragment, block.priority)
+}
+
+// serveStream hands a stream to the server's handler as soon as its
+// HEADERS are in; the body follows through Request.Body. A handler that
+// returns without ending its response has it ended for it.
+func (sc *serverConn) serveStream(stream *streamState) {
+	req := &Request{
+		StreamID:   stream.id,
+		Headers:    stream.headers,
+		Body:       http.NoBody,
+		Proto:      "HTTP/2.0",
+		RemoteAddr: sc.conn.RemoteAddr().String(),
+	}
+	if stream.body != nil {
+		req.Body = &requestBody{sc: sc, stream: stream, req: req}
+	}
+	if tc, ok := sc.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+	w := sc.responseWriter(stream)
+	if stream.id%2 == 1 {
+		// Pushed streams are bounded by the client's limit instead
+		defer func() {
+			sc.mu.Lock()
+			sc.handlers--
+			sc.mu.Unlock()
+		}()
+	}
+	panicked := sc.runHandler(w, req)
+
+	sc.mu.Lock()
+	unfinished := stream.localOpen()
+	sc.mu.Unlock()
+	switch {
+	case !unfinished:
+	case w.wroteHeaders && !panicked:
+		w.WriteData(nil, true)
+	default:
+		sc.resetStream(stream.id, ErrCodeInternal)
+	}
+
+	if stream.body == nil {
+		return
+	}
+	// What the handler left unread is given back to the connection
+	n := stream.body.CloseWithError(errBodyClosed) + stream.body.Discard()
+	if n > 0 && !stream.upgraded {
+		sc.consumed(nil, n)
+	}
+	sc.mu.Lock()
+	stillSending := stream.remoteOpen()
+	sc.mu.Unlock()
+	if stillSending {
+		// The response is complete, so the rest of the request is of no
+		// use; NO_ERROR tells the client to stop sending it.
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-7
+		sc.resetStream(stream.id, ErrCodeNo)
+	}
+}
+
+// runHandler calls the server's handler and reports whether it panicked.
+// As with net/http, a panic only costs the request it happened in; it is
+// logged unless it is http.ErrAbortHandler.
+func (sc *serverConn) runHandler(w ResponseWriter, req *Request) (panicked bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			panicked = true
+			if e == http.ErrAbortHandler {
+				return
+			}
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("Panic serving %s: %v\n%s", req.RemoteAddr, e, buf)
+		}
+	}()
+	sc.srv.handler().ServeHTTP2(w, req)
+	return false
+}
+
+// requestBody is the Body of a Request that came over HTTP/2. Reading it
+// gives the bytes back to the client's flow-control windows, so a client
+// can get no further ahead of the handler than the windows allow.
+type requestBody struct {
+	sc     *serverConn
+	stream *streamState
+	req    *Request
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.stream.body.Read(p)
+	if n > 0 && !b.stream.upgraded {
+		b.sc.consumed(b.stream, n)
+	}
+	if errors.Is(err, io.EOF) {
+		b.sc.mu.Lock()
+		b.req.Trailers = b.stream.trailers
+		b.sc.mu.Unlock()
+	}
+	return n, err
+}
+
+// handleSettings applies the client's SETTINGS and acknowledges them, or
+// notes that the client has acknowledged ours.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-settings-synchronization
+func (sc *serverConn) handleSettings(f *frame.SettingsFrame) error {
+	if f.Flags.Has(frame.FlagAck) {
+		log.Printf("Received SETTINGS ACK")
+		sc.mu.Lock()
+		if !sc.localAcked {
+			// The client may now grow or shrink its encoder's table up to
+			// our HEADER_TABLE_SIZE.
+			sc.decoder.SetAllowedMaxDynamicTableSize(sc.local.HeaderTableSize)
+		}
+		sc.localAcked = true
+		sc.mu.Unlock()
+		return nil
+	}
+
+	if err := sc.count(AbuseSettingsFlood); err != nil {
+		return err
+	}
+	if err := sc.applySettings(f.Settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(&frame.SettingsFrame{FrameHeader: frame.FrameHeader{Flags: frame.FlagAck}})
+}
+
+// applySettings records the client's SETTINGS parameters, from a SETTINGS
+// frame or the HTTP2-Settings header of an h2c upgrade.
+func (sc *serverConn) applySettings(params []frame.Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, p := range params {
+		log.Printf("Received SETTINGS %s", p)
+		oldWindow := int64(sc.peer.InitialWindowSize)
+		if err := sc.peer.Set(p.ID, p.Val); err != nil {
+			return err
+		}
+		switch p.ID {
+		case SettingInitialWindowSize:
+			if err := sc.adjustSendWindows(int64(p.Val) - oldWindow); err != nil {
+				return err
+			}
+		case SettingHeaderTableSize:
+			// Our encoder must not use a bigger table than the client's
+			// decoder. The writer applies it before any later header block.
+			size := p.Val
+			sc.submitAsync(0, func(*frame.Framer) error {
+				sc.encoder.SetMaxDynamicTableSizeLimit(size)
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// errHeaderListTooLarge means a request's headers exceed our
+// SETTINGS_MAX_HEADER_LIST_SIZE.
+var errHeaderListTooLarge = errors.New("header list exceeds MAX_HEADER_LIST_SIZE")
+
+// decodeHeaders decodes a complete header block; the framer has already
+// stripped any padding and priority fields.
+func (sc *serverConn) decodeHeaders(payload []byte) ([]hpack.HeaderField, error) {
+	sc.mu.Lock()
+	maxListSize := sc.local.MaxHeaderListSize
+	sc.mu.Unlock()
+
+	// The whole block is decoded even when it is too large, otherwise our
+	// dynamic table would drift from the client's, but the fields past
+	// the limit are dropped as they come.
+	// https://datatracker.ietf.org/doc/html/rfc9113#section-6.5.2-2.12.1
+	sc.decoder.SetMaxHeaderListSize(maxListSize)
+	headers, err := sc.decoder.DecodeFull(payload)
+	if errors.Is(err, hpack.ErrHeaderListTooLarge) {
+		return nil, errHeaderListTooLarge
+	}
+	return headers, err
+}
+
+// writeHeaders encodes headers with the connection's encoder and sends them
+// as a HEADERS frame, followed by CONTINUATION frames if the block is
+// bigger than the client's MAX_FRAME_SIZE. END_HEADERS is set on the last
+// frame. The writer encodes and sends the block in one go, so the client
+// decodes blocks in the order they were encoded and no other frame lands
+// between the pieces of a block.
+func (sc *serverConn) writeHeaders(streamID int, flags frame.Flags, headers []hpack.HeaderField) error {
+	sc.mu.Lock()
+	maxFrameSize := int(sc.peer.MaxFrameSize)
+	sc.mu.Unlock()
+
+	return sc.submit(streamID, func(fr *frame.Framer) error {
+		return sc.encodeAndSendHeaders(fr, streamID, flags, headers, maxFrameSize)
+	})
+}
+
+func (sc *serverConn) encodeAndSendHeaders(fr *frame.Framer, streamID int, flags frame.Flags, headers []hpack.HeaderField, maxFrameSize int) error {
+	return sc.encodeAndSendBlock(fr, streamID, headers, maxFrameSize, func(h frame.FrameHeader, fragment []byte) frame.Frame {
+		h.Flags |= flags
+		return &frame.HeadersFrame{FrameHeader: h, BlockFragment: fragment}
+	})
+}
+
+// encodeAndSendBlock encodes headers and sends the block as the frame
+// first returns (HEADERS or PUSH_PROMISE) and as many CONTINUATION frames
+// as it takes.
+func (sc *serverConn) encodeAndSendBlock(fr *frame.Framer, streamID int, headers []hpack.HeaderField, maxFrameSize int, first func(h frame.FrameHeader, fragment []byte) frame.Frame) error {
+	sc.hbuf.Reset()
+	for _, hf := range headers {
+		if err := sc.encoder.WriteField(hf); err != nil {
+			return err
+		}
+	}
+	block := sc.hbuf.Bytes()
+
+	for i := 0; ; i++ {
+		fragment := block[:min(len(block), maxFrameSize)]
+		block = block[len(fragment):]
+		h := frame.FrameHeader{StreamID: uint32(streamID)}
+		if len(block) == 0 {
+			h.Flags = frame.FlagEndHeaders
+		}
+		// END_STREAM and the other flags only belong on the first frame
+		var f frame.Frame = &frame.ContinuationFrame{FrameHeader: h, BlockFragment: fragment}
+		if i == 0 {
+			f = first(h, fragment)
+		}
+		if err := fr.WriteFrame(f); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+	}
+}
+
+// goAway tells the client why the connection is about to be closed, and
+// which of its streams we may have processed: all streams up to the last
+// one we accepted. Anything above it can safely be retried elsewhere.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-goaway
+//
+//	+-+-------------------------------------------------------------+
+//	|R|                  Last-Stream-ID (31)                        |
+//	+-+-------------------------------------------------------------+
+//	|                      Error Code (32)                          |
+//	+---------------------------------------------------------------+
+//	|                  Additional Debug Data (*)                    |
+//	+---------------------------------------------------------------+
+func (sc *serverConn) goAway(code ErrCode, reason string) {
+	sc.mu.Lock()
+	lastStreamID := sc.lastStreamID
+	sc.goAwaySent = true
+	sc.mu.Unlock()
+
+	log.Printf("Sending GOAWAY %s (last stream %d)", code, lastStreamID)
+	sc.writeFrame(&frame.GoAwayFrame{
+		LastStreamID: uint32(lastStreamID),
+		ErrCode:      code,
+		DebugData:    []byte(reason),
+	})
+}
+
+// startGracefulShutdown sends GOAWAY with NO_ERROR. Streams that are
+// already open are served to the end, new ones are refused, and
+// Server.Shutdown closes the connection once no stream is left.
+func (sc *serverConn) startGracefulShutdown() {
+	sc.mu.Lock()
+	sc.shuttingDown = true
+	send := sc.settingsSent && !sc.goAwaySent
+	sc.mu.Unlock()
+	if send {
+		sc.goAway(ErrCodeNo, "server shutting down")
+	}
+}
+
+// idle reports whether a connection that is shutting down has no streams
+// left to finish.
+func (sc *serverConn) idle() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.shuttingDown && len(sc.streams) == 0 && !sc.http1Busy
+}
+
+// handleGoAway notes that the client is going away. It opens no more
+// streams, but the ones in flight are still answered.
+func (sc *serverConn) handleGoAway(f *frame.GoAwayFrame) error {
+	log.Printf("Received GOAWAY %s (last stream %d): %q", f.ErrCode, f.LastStreamID, f.DebugData)
+	return nil
+}
+
+// writeFrame has the writer send one frame and waits until it is written.
+func (sc *serverConn) writeFrame(f frame.Frame) error {
+	return sc.submit(int(f.Header().StreamID), func(fr *frame.Framer) error {
+		return fr.WriteFrame(f)
+	})
+}
+
+// close stops the writer and wakes every handler still waiting for
+// flow-control window.
+func (sc *serverConn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	close(sc.doneServing)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Denial of service
+// https://datatracker.ietf.org/doc/html/rfc9113#section-10.5
+//
+// Many frames cost the server more than the client: a SETTINGS or PING
+// wants an ACK, a stream reset right after its HEADERS leaves a handler
+// to start and stop, CONTINUATION frames grow a header block that cannot
+// be used until it ends. Limits caps each of them per connection. A
+// client that goes past a cap is taken for an attacker and the connection
+// ends with GOAWAY ENHANCE_YOUR_CALM; Server.Abuses counts what set it
+// off.
+
+// Limits bounds what one client connection may do. Rates are per second,
+// with bursts of up to one second's worth; zero disables a limit.
+type Limits struct {
+	// ResetsPerSecond caps the streams the client resets with RST_STREAM,
+	// the rapid reset attack (CVE-2023-44487).
+	ResetsPerSecond int
+
+	// StreamErrorsPerSecond caps the streams the server resets because of
+	// the client: malformed or refused requests, frames on closed streams.
+	StreamErrorsPerSecond int
+
+	// SettingsPerSecond and PingsPerSecond cap the SETTINGS and PING
+	// frames that must be acknowledged.
+	SettingsPerSecond int
+	PingsPerSecond    int
+
+	// EmptyDataPerSecond caps DATA frames with neither data nor
+	// END_STREAM, which take a read and a wakeup but carry nothing.
+	EmptyDataPerSecond int
+
+	// MaxContinuations caps the CONTINUATION frames of one header block.
+	// The block itself may not grow beyond twice MAX_HEADER_LIST_SIZE.
+	MaxContinuations int
+}
+
+// DefaultLimits returns limits that no well-behaved client comes near.
+func DefaultLimits() Limits {
+	return Limits{
+		ResetsPerSecond:       100,
+		StreamErrorsPerSecond: 100,
+		SettingsPerSecond:     10,
+		PingsPerSecond:        10,
+		EmptyDataPerSecond:    100,
+		// A full 1 MB header list fits in 64 frames of the minimum
+		// MAX_FRAME_SIZE
+		MaxContinuations: 64,
+	}
+}
+
+// defaultMaxHeaderListSize is the MAX_HEADER_LIST_SIZE of the default
+// settings, as large as net/http allows.
+const defaultMaxHeaderListSize = 1 << 20
+
+// An Abuse is a pattern of frames that ends a connection with
+// ENHANCE_YOUR_CALM.
+type Abuse int
+
+const (
+	AbuseRapidReset Abuse = iota
+	AbuseStreamErrors
+	AbuseSettingsFlood
+	AbusePingFlood
+	AbuseEmptyDataFlood
+	AbuseContinuationFlood
+	numAbuses
+)
+
+func (a Abuse) String() string {
+	switch a {
+	case AbuseRapidReset:
+		return "rapid reset"
+	case AbuseStreamErrors:
+		return "too many stream errors"
+	case AbuseSettingsFlood:
+		return "SETTINGS flood"
+	case AbusePingFlood:
+		return "PING flood"
+	case AbuseEmptyDataFlood:
+		return "empty DATA flood"
+	case AbuseContinuationFlood:
+		return "CONTINUATION flood"
+	}
+	return fmt.Sprintf("Abuse(%d)", int(a))
+}
+
+// perSecond is the rate limit for a, 0 if a is not rate limited.
+func (l Limits) perSecond(a Abuse) int {
+	switch a {
+	case AbuseRapidReset:
+		return l.ResetsPerSecond
+	case AbuseStreamErrors:
+		return l.StreamErrorsPerSecond
+	case AbuseSettingsFlood:
+		return l.SettingsPerSecond
+	case AbusePingFlood:
+		return l.PingsPerSecond
+	case AbuseEmptyDataFlood:
+		return l.EmptyDataPerSecond
+	}
+	return 0
+}
+
+// Abuses returns how many connections each abuse has ended since the
+// server started. Abuses that never happened are left out.
+func (s *Server) Abuses() map[Abuse]uint64 {
+	m := make(map[Abuse]uint64)
+	for a := range numAbuses {
+		if n := s.abuses[a].Load(); n > 0 {
+			m[a] = n
+		}
+	}
+	return m
+}
+
+func (s *Server) limits() Limits {
+	if s.Limits == nil {
+		return DefaultLimits()
+	}
+	return *s.Limits
+}
+
+// tokenBucket allows rate events per second on average, and up to rate at
+// once after a quiet second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(rate int, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// count records one more frame of the kind a limits and returns an
+// ENHANCE_YOUR_CALM connection error once the client has sent too many.
+// Only used by the read loop.
+func (sc *serverConn) count(a Abuse) error {
+	rate := sc.limits.perSecond(a)
+	if rate <= 0 || sc.buckets[a].allow(rate, time.Now()) {
+		return nil
+	}
+	return sc.calm(a, fmt.Sprintf("more than %d a second", rate))
+}
+
+// calm returns the error that ends the connection because of a.
+func (sc *serverConn) calm(a Abuse, reason string) error {
+	sc.srv.abuses[a].Add(1)
+	log.Printf("Client %s: %s, sending ENHANCE_YOUR_CALM", sc.conn.RemoteAddr(), a)
+	return ConnectionError{Code: ErrCodeEnhanceYourCalm, Reason: a.String() + ": " + reason}
+}
@@ -0,0 +1,33 @@
+package server
+
+import "github.com/nethish/fromscratch/http2/frame"
+
+// ErrCode is the reason carried by RST_STREAM and GOAWAY frames.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-error-codes
+type ErrCode = frame.ErrCode
+
+const (
+	ErrCodeNo                 = frame.ErrCodeNo
+	ErrCodeProtocol           = frame.ErrCodeProtocol
+	ErrCodeInternal           = frame.ErrCodeInternal
+	ErrCodeFlowControl        = frame.ErrCodeFlowControl
+	ErrCodeSettingsTimeout    = frame.ErrCodeSettingsTimeout
+	ErrCodeStreamClosed       = frame.ErrCodeStreamClosed
+	ErrCodeFrameSize          = frame.ErrCodeFrameSize
+	ErrCodeRefusedStream      = frame.ErrCodeRefusedStream
+	ErrCodeCancel             = frame.ErrCodeCancel
+	ErrCodeCompression        = frame.ErrCodeCompression
+	ErrCodeConnect            = frame.ErrCodeConnect
+	ErrCodeEnhanceYourCalm    = frame.ErrCodeEnhanceYourCalm
+	ErrCodeInadequateSecurity = frame.ErrCodeInadequateSecurity
+	ErrCodeHTTP11Required     = frame.ErrCodeHTTP11Required
+)
+
+// ConnectionError is an error that ends the whole connection with a GOAWAY.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-connection-error-handling
+type ConnectionError = frame.ConnectionError
+
+// StreamError ends a single stream with RST_STREAM; the connection and its
+// other streams carry on.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-stream-error-handling
+type StreamError = frame.StreamError
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// Extensible Priorities
+// https://datatracker.ietf.org/doc/html/rfc9218
+//
+// A client asks for a Priority with the "priority" request header, e.g.
+// "u=1, i", and may change it later with a PRIORITY_UPDATE frame. The
+// stream's Priority goes with every frame the stream queues, so the
+// connection's WriteScheduler can act on it.
+
+// maxPendingPriorities bounds the PRIORITY_UPDATEs kept for streams that
+// the client has not opened yet.
+const maxPendingPriorities = 100
+
+// parsePriorityField reads the urgency (u) and incremental (i) parameters
+// of a priority field value, a Structured Fields Dictionary. Parameters
+// that are missing, unknown or invalid are left at their defaults.
+// https://datatracker.ietf.org/doc/html/rfc9218#name-priority-parameters
+func parsePriorityField(value string) Priority {
+	prio := DefaultPriority
+	for _, member := range strings.Split(value, ",") {
+		// Parameters of the member itself (";...") carry nothing for us
+		key, val, hasVal := strings.Cut(strings.TrimSpace(member), "=")
+		val, _, _ = strings.Cut(val, ";")
+		key, _, _ = strings.Cut(key, ";")
+		switch key {
+		case "u":
+			if u, err := strconv.Atoi(val); err == nil && u >= 0 && u <= 7 {
+				prio.Urgency = uint8(u)
+			}
+		case "i":
+			// A bare key is the boolean true
+			switch {
+			case !hasVal || val == "?1":
+				prio.Incremental = true
+			case val == "?0":
+				prio.Incremental = false
+			}
+		}
+	}
+	return prio
+}
+
+// requestPriority is the priority a request asks for in its header. A
+// field split over several lines is read as one list.
+func requestPriority(headers []hpack.HeaderField) Priority {
+	var values []string
+	for _, hf := range headers {
+		if hf.Name == "priority" {
+			values = append(values, hf.Value)
+		}
+	}
+	return parsePriorityField(strings.Join(values, ","))
+}
+
+// handlePriorityUpdate reprioritizes a stream with a PRIORITY_UPDATE frame
+// (type 0x10). It is sent on stream 0 and names the stream it is about,
+// which may still be idle: a client can send it before the request's
+// HEADERS.
+// https://datatracker.ietf.org/doc/html/rfc9218#name-the-priority_update-frame
+func (sc *serverConn) handlePriorityUpdate(f *frame.PriorityUpdateFrame) error {
+	id := int(f.PrioritizedStreamID)
+	prio := parsePriorityField(f.FieldValue)
+	log.Printf("Stream %d: Received PRIORITY_UPDATE %s", id, prio)
+	if id == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: "PRIORITY_UPDATE for stream 0"}
+	}
+
+	sc.mu.Lock()
+	stream, ok := sc.streams[id]
+	switch {
+	case ok:
+		stream.priority = prio
+	case id%2 == 0:
+		// A push that already finished is fine, there is just nothing
+		// left to reprioritize
+		if sc.isIdle(id) {
+			sc.mu.Unlock()
+			return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("PRIORITY_UPDATE for push stream %d that was never pushed", id)}
+		}
+	case sc.isIdle(id):
+		// Applied when the stream opens
+		if _, known := sc.pendingPriorities[id]; known || len(sc.pendingPriorities) < maxPendingPriorities {
+			sc.pendingPriorities[id] = prio
+		}
+	}
+	sc.mu.Unlock()
+
+	if ok {
+		// Frames already queued keep their place; this empty write hands
+		// the scheduler the new priority for the rest of the stream.
+		sc.submitAsync(id, func(*frame.Framer) error { return nil })
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// Flow control
+// https://datatracker.ietf.org/doc/html/rfc9113#name-flow-control
+//
+// Every DATA frame spends from two windows: the stream's and the
+// connection's. A sender may only send while both are positive, and the
+// receiver hands the bytes back with WINDOW_UPDATE once it has consumed them.
+
+// initialConnWindow is the connection window at the start of every
+// connection. SETTINGS_INITIAL_WINDOW_SIZE only applies to streams.
+const initialConnWindow = 65535
+
+// connRecvWindow is the connection window the server grows to right after
+// its SETTINGS. Request bodies are only given back as handlers read them,
+// so with the initial window one slow reader could hold up the uploads of
+// every other stream.
+const connRecvWindow = 1 << 20
+
+var errConnClosed = errors.New("connection closed")
+
+// takeSendWindow blocks until the stream and the connection both allow
+// sending and then reserves up to want bytes of both windows.
+func (sc *serverConn) takeSendWindow(stream *streamState, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		if sc.closed {
+			return 0, errConnClosed
+		}
+		if !stream.localOpen() {
+			return 0, errStreamClosed
+		}
+		n := min(int64(want), sc.sendWindow, stream.sendWindow)
+		if n > 0 || want == 0 {
+			sc.sendWindow -= n
+			stream.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// handleWindowUpdate grows a send window and wakes writers waiting on it.
+func (sc *serverConn) handleWindowUpdate(f *frame.WindowUpdateFrame) error {
+	streamID := int(f.StreamID)
+	increment := int64(f.Increment)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if streamID == 0 {
+		if increment == 0 {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE with 0 increment"}
+		}
+		if sc.sendWindow+increment > maxWindowSize {
+			return ConnectionError{Code: ErrCodeFlowControl, Reason: "connection window overflow"}
+		}
+		sc.sendWindow += increment
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	stream, ok := sc.streams[streamID]
+	if !ok {
+		if sc.isIdle(streamID) {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("WINDOW_UPDATE on idle stream %d", streamID)}
+		}
+		// The stream may have just closed; updates can still be in flight.
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE with 0 increment"}
+	}
+	if stream.sendWindow+increment > maxWindowSize {
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeFlowControl, Reason: "stream window overflow"}
+	}
+	stream.sendWindow += increment
+	sc.cond.Broadcast()
+	return nil
+}
+
+// adjustSendWindows applies a change of the client's
+// SETTINGS_INITIAL_WINDOW_SIZE to every open stream. The window of a
+// stream may become negative. sc.mu must be held.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-initial-flow-control-window
+func (sc *serverConn) adjustSendWindows(delta int64) error {
+	for _, stream := range sc.streams {
+		if stream.sendWindow+delta > maxWindowSize {
+			return ConnectionError{Code: ErrCodeFlowControl, Reason: fmt.Sprintf("stream %d window overflow", stream.id)}
+		}
+		stream.sendWindow += delta
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// takeRecvWindow accounts for a received DATA frame of n bytes. The whole
+// frame counts, including any padding. A nil stream only takes from the
+// connection window.
+func (sc *serverConn) takeRecvWindow(stream *streamState, n int) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.recvWindow -= int64(n)
+	if sc.recvWindow < 0 {
+		return ConnectionError{Code: ErrCodeFlowControl, Reason: "client overran the connection window"}
+	}
+	if stream == nil {
+		return nil
+	}
+	stream.recvWindow -= int64(n)
+	if stream.recvWindow < 0 {
+		return StreamError{StreamID: uint32(stream.id), Code: ErrCodeFlowControl, Reason: "client overran the stream window"}
+	}
+	return nil
+}
+
+// consumed hands n bytes back to the client once they have been read.
+// WINDOW_UPDATE frames are batched until half a window is pending. A nil
+// stream or one the client has finished sending only credits the
+// connection.
+func (sc *serverConn) consumed(stream *streamState, n int) error {
+	sc.mu.Lock()
+	var connIncrement, streamIncrement int64
+	sc.recvUnacked += int64(n)
+	if sc.recvUnacked >= connRecvWindow/2 {
+		connIncrement, sc.recvUnacked = sc.recvUnacked, 0
+		sc.recvWindow += connIncrement
+	}
+	if stream != nil && stream.remoteOpen() {
+		stream.recvUnacked += int64(n)
+		if stream.recvUnacked >= int64(sc.local.InitialWindowSize)/2 {
+			streamIncrement, stream.recvUnacked = stream.recvUnacked, 0
+			stream.recvWindow += streamIncrement
+		}
+	}
+	sc.mu.Unlock()
+
+	if connIncrement > 0 {
+		if err := sc.sendWindowUpdate(0, connIncrement); err != nil {
+			return err
+		}
+	}
+	if streamIncrement > 0 {
+		return sc.sendWindowUpdate(stream.id, streamIncrement)
+	}
+	return nil
+}
+
+func (sc *serverConn) sendWindowUpdate(streamID int, increment int64) error {
+	return sc.writeFrame(&frame.WindowUpdateFrame{
+		FrameHeader: frame.FrameHeader{StreamID: uint32(streamID)},
+		Increment:   uint32(increment),
+	})
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nethish/fromscratch/http2/grpc"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// gRPC
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+//
+// A gRPC call is an ordinary stream: a POST with content-type
+// application/grpc whose :path names the method, length-prefixed messages
+// in both directions, and the outcome in grpc-status and grpc-message
+// trailers. GRPCServer runs the methods registered with Handle on the
+// streams that carry one, and leaves every other request to Fallback.
+
+// A GRPCMethod serves the calls to one method. It reads the request
+// messages from stream and sends the response messages; the error it
+// returns becomes the status of the call, see grpc.StatusOf.
+type GRPCMethod func(stream *GRPCStream) error
+
+// UnaryMethod adapts a function from one request message to one response
+// message into a GRPCMethod.
+func UnaryMethod(f func(ctx context.Context, req []byte) ([]byte, error)) GRPCMethod {
+	return func(stream *GRPCStream) error {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return grpc.Errorf(grpc.Internal, "no request message")
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+			if err == nil {
+				err = grpc.Errorf(grpc.Internal, "more than one request message for a unary method")
+			}
+			return err
+		}
+		resp, err := f(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		return stream.Send(resp)
+	}
+}
+
+// GRPCServer is a Handler for gRPC calls. Requests whose content-type is
+// not application/grpc go to Fallback.
+//
+//	g := &server.GRPCServer{Fallback: server.HTTPHandler(mux)}
+//	g.Handle("/helloworld.Greeter/SayHello", server.UnaryMethod(sayHello))
+//	srv := &server.Server{Handler: g}
+type GRPCServer struct {
+	// Fallback serves the requests that are not gRPC calls. If nil, they
+	// get 415 Unsupported Media Type.
+	Fallback Handler
+
+	// MaxMessageSize is the largest request message accepted,
+	// grpc.DefaultMaxMessageSize if zero.
+	MaxMessageSize int
+
+	mu      sync.RWMutex
+	methods map[string]GRPCMethod
+}
+
+// Handle registers m for the calls to name, which is the :path of the
+// calls: "/package.Service/Method". It panics if name is malformed or
+// already taken.
+func (g *GRPCServer) Handle(name string, m GRPCMethod) {
+	service, method, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if !strings.HasPrefix(name, "/") || !ok || service == "" || method == "" || strings.Contains(method, "/") {
+		panic(fmt.Sprintf("grpc: malformed method name %q", name))
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, dup := g.methods[name]; dup {
+		panic(fmt.Sprintf("grpc: method %s registered twice", name))
+	}
+	if g.methods == nil {
+		g.methods = make(map[string]GRPCMethod)
+	}
+	g.methods[name] = m
+}
+
+// ServeHTTP2 routes a request by its content-type, then runs the method
+// named by its :path.
+func (g *GRPCServer) ServeHTTP2(w ResponseWriter, r *Request) {
+	if !grpc.IsContentType(r.Header("content-type")) {
+		if g.Fallback != nil {
+			g.Fallback.ServeHTTP2(w, r)
+			return
+		}
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "415"}}, true)
+		return
+	}
+	if method := r.Header(":method"); method != "POST" {
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "405"}, {Name: "allow", Value: "POST"}}, true)
+		return
+	}
+
+	name := r.Header(":path")
+	stream := &GRPCStream{
+		Method:  name,
+		Request: r,
+		w:       w,
+		body:    r.Body,
+		maxSize: g.MaxMessageSize,
+	}
+	g.mu.RLock()
+	m := g.methods[name]
+	g.mu.RUnlock()
+
+	// The deadline holds however long the method takes: the call ends with
+	// DEADLINE_EXCEEDED when it passes, and the method sees its context
+	// end. A method blocked in Recv or Send returns too, since the rest of
+	// the stream is cancelled.
+	ctx := context.Background()
+	if timeout := r.Header("grpc-timeout"); timeout != "" {
+		d, err := grpc.ParseTimeout(timeout)
+		if err != nil {
+			stream.finish(err)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+		expired := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() {
+			defer close(expired)
+			stream.finish(ctx.Err())
+			if c, ok := w.(canceler); ok {
+				c.cancel()
+			}
+		})
+		// w must not be used once the handler has returned
+		defer func() {
+			if !stop() {
+				<-expired
+			}
+		}()
+	}
+	stream.ctx = ctx
+
+	switch enc := r.Header("grpc-encoding"); {
+	case m == nil:
+		stream.finish(grpc.Errorf(grpc.Unimplemented, "unknown method %s", name))
+	case enc != "" && enc != "identity":
+		stream.finish(grpc.Errorf(grpc.Unimplemented, "grpc-encoding %s is not supported", enc))
+	default:
+		stream.finish(m(stream))
+	}
+}
+
+// GRPCStream is one call as the method sees it.
+type GRPCStream struct {
+	// Method is the full name of the method, e.g.
+	// "/helloworld.Greeter/SayHello".
+	Method string
+	// Request is the stream the call came on, with its metadata in the
+	// header fields.
+	Request *Request
+
+	ctx     context.Context
+	w       ResponseWriter
+	body    io.Reader
+	maxSize int
+
+	// sendMu keeps the frames of one message together
+	sendMu sync.Mutex
+
+	// mu guards the state of the response, since the deadline can end it
+	// while the method is sending. It is never held while writing, which
+	// may block on flow control.
+	mu          sync.Mutex
+	header      []hpack.HeaderField
+	trailer     []hpack.HeaderField
+	sentHeaders bool
+	// sending is set while a message is being written
+	sending bool
+	// status is set once the call is over
+	status *grpc.Status
+}
+
+// canceler is implemented by the server's ResponseWriter.
+type canceler interface {
+	// cancel resets what is still open of the stream, waking a handler
+	// blocked writing the response or reading the request body.
+	cancel()
+}
+
+// Context ends at the call's deadline, if it has one.
+func (s *GRPCStream) Context() context.Context {
+	return s.ctx
+}
+
+// Recv returns the next request message, or io.EOF after the last one.
+// Once the deadline has passed it returns the context's error.
+func (s *GRPCStream) Recv() ([]byte, error) {
+	msg, err := grpc.ReadMessage(s.body, s.maxSize)
+	if err != nil && s.ctx.Err() != nil {
+		return nil, s.ctx.Err()
+	}
+	return msg, err
+}
+
+// SetHeader adds response metadata. It has no effect once the first
+// message has been sent.
+func (s *GRPCStream) SetHeader(fields ...hpack.HeaderField) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = append(s.header, fields...)
+}
+
+// SetTrailer adds metadata to the trailers that end the call.
+func (s *GRPCStream) SetTrailer(fields ...hpack.HeaderField) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = append(s.trailer, fields...)
+}
+
+// Send sends one response message, after the response headers if it is
+// the first. It fails with the call's status once the call is over.
+func (s *GRPCStream) Send(msg []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	if s.status != nil {
+		s.mu.Unlock()
+		return s.status
+	}
+	var header []hpack.HeaderField
+	if !s.sentHeaders {
+		header = s.responseHeaders()
+		s.sentHeaders = true
+	}
+	s.sending = true
+	s.mu.Unlock()
+
+	err := s.send(header, msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending = false
+	if err != nil && s.status != nil {
+		// The call ended while the message was going out
+		return s.status
+	}
+	return err
+}
+
+func (s *GRPCStream) send(header []hpack.HeaderField, msg []byte) error {
+	if header != nil {
+		if err := s.w.WriteHeaders(header, false); err != nil {
+			return err
+		}
+	}
+	return s.w.WriteData(grpc.AppendMessage(nil, msg), false)
+}
+
+func (s *GRPCStream) responseHeaders() []hpack.HeaderField {
+	fields := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: grpc.ContentType},
+		// Nothing is ever compressed
+		{Name: "grpc-accept-encoding", Value: "identity"},
+	}
+	return append(fields, s.header...)
+}
+
+// finish ends the call with the status of err: in the trailers after the
+// messages, or all in one HEADERS frame if no message was sent. Only the
+// first call counts. Nothing is sent while a message is only partly
+// written; the stream has to be cancelled instead.
+func (s *GRPCStream) finish(err error) {
+	s.mu.Lock()
+	if s.status != nil {
+		s.mu.Unlock()
+		return
+	}
+	status := grpc.StatusOf(err)
+	s.status = status
+	if status.Code != grpc.OK {
+		log.Printf("Stream %d: %s: %s", s.Request.StreamID, s.Method, status.Code)
+	}
+	if s.sending {
+		s.mu.Unlock()
+		return
+	}
+
+	var fields []hpack.HeaderField
+	if !s.sentHeaders {
+		// Trailers-Only
+		fields = s.responseHeaders()
+	}
+	fields = append(fields, hpack.HeaderField{Name: "grpc-status", Value: strconv.Itoa(int(status.Code))})
+	if status.Message != "" {
+		fields = append(fields, hpack.HeaderField{Name: "grpc-message", Value: grpc.EncodeMessage(status.Message)})
+	}
+	fields = append(fields, s.trailer...)
+	s.mu.Unlock()
+	s.w.WriteHeaders(fields, true)
+}
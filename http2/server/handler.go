@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// Request is a stream whose HEADERS have been received. The handler runs
+// right away and reads the body as it arrives, so it can respond while
+// the client is still sending.
+type Request struct {
+	// StreamID is 0 for a request served by the HTTP/1.x fallback.
+	StreamID int
+	Headers  []hpack.HeaderField
+	// Body fills as DATA frames arrive and returns io.EOF once the client
+	// has ended the stream. Reading it lets the client send more. It is
+	// http.NoBody if the request ended with its HEADERS.
+	Body io.Reader
+	// Trailers are the header fields sent after the body, if any. They
+	// are set once Body has returned io.EOF.
+	Trailers []hpack.HeaderField
+
+	// Proto is "HTTP/2.0", or the version of an HTTP/1.x request.
+	Proto string
+
+	// RemoteAddr is the client's network address.
+	RemoteAddr string
+	// TLS is the state of the connection's TLS handshake, nil for h2c.
+	TLS *tls.ConnectionState
+}
+
+// Header returns the value of the first header field called name.
+func (r *Request) Header(name string) string {
+	for _, hf := range r.Headers {
+		if hf.Name == name {
+			return hf.Value
+		}
+	}
+	return ""
+}
+
+// ResponseWriter sends the response frames of a single stream.
+type ResponseWriter interface {
+	// WriteHeaders sends a HEADERS frame with the given fields.
+	WriteHeaders(headers []hpack.HeaderField, endStream bool) error
+	// WriteData sends a DATA frame.
+	WriteData(data []byte, endStream bool) error
+}
+
+// Handler responds to an HTTP/2 request.
+type Handler interface {
+	ServeHTTP2(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeHTTP2 calls f(w, r).
+func (f HandlerFunc) ServeHTTP2(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// EchoHandler responds with the request body, sending each piece back as
+// soon as it arrives.
+var EchoHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
+	// Step 1: Headers
+	headers := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+	}
+	if err := w.WriteHeaders(headers, false); err != nil {
+		return
+	}
+
+	// Step 2: Send DATA while the request body streams in; the last
+	// frame carries END_STREAM
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			if w.WriteData(buf[:n], false) != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	w.WriteData(nil, true)
+})
+
+// HelloHandler responds with "Hello, world!".
+var HelloHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
+	headers := []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/plain"},
+	}
+	if err := w.WriteHeaders(headers, false); err != nil {
+		return
+	}
+	w.WriteData([]byte("Hello, world!\n"), true)
+})
+
+type responseWriter struct {
+	sc     *serverConn
+	stream *streamState
+
+	// wroteHeaders is set once the response HEADERS have been sent
+	wroteHeaders bool
+}
+
+func (sc *serverConn) responseWriter(stream *streamState) *responseWriter {
+	return &responseWriter{sc: sc, stream: stream}
+}
+
+// WriteHeaders fails with errStreamClosed once the stream has been reset or
+// the response has already ended.
+func (w *responseWriter) WriteHeaders(headers []hpack.HeaderField, endStream bool) error {
+	w.sc.mu.Lock()
+	open := w.stream.localOpen()
+	w.sc.mu.Unlock()
+	if !open {
+		return errStreamClosed
+	}
+
+	// writeHeaders sets END_HEADERS on the last frame of the block
+	var flags frame.Flags
+	if endStream {
+		flags |= frame.FlagEndStream
+	}
+	if err := w.sc.writeHeaders(w.stream.id, flags, headers); err != nil {
+		return err
+	}
+	w.wroteHeaders = true
+	if endStream {
+		w.sc.endLocal(w.stream)
+	}
+	return nil
+}
+
+// WriteData splits data into frames no bigger than the client's
+// SETTINGS_MAX_FRAME_SIZE, blocking whenever the flow-control window is
+// used up. Only the last frame carries END_STREAM. The frames are queued
+// one by one, so the write scheduler can interleave them with the frames of
+// other streams, and WriteData returns once all of them are written.
+func (w *responseWriter) WriteData(data []byte, endStream bool) error {
+	w.sc.mu.Lock()
+	maxFrameSize := int(w.sc.peer.MaxFrameSize)
+	w.sc.mu.Unlock()
+
+	var pending []chan error
+	for {
+		n, err := w.sc.takeSendWindow(w.stream, min(len(data), maxFrameSize))
+		if err != nil {
+			return err
+		}
+		chunk := data[:n]
+		data = data[n:]
+
+		var flags frame.Flags
+		if endStream && len(data) == 0 {
+			flags |= frame.FlagEndStream
+		}
+		done := make(chan error, 1)
+		if err := w.sc.queue(w.stream.id, w.dataWrite(flags, chunk), done); err != nil {
+			return err
+		}
+		pending = append(pending, done)
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	for _, done := range pending {
+		if err := w.sc.wait(done); err != nil {
+			return err
+		}
+	}
+	if endStream {
+		w.sc.endLocal(w.stream)
+	}
+	return nil
+}
+
+// cancel resets the stream if the response is unfinished, and otherwise
+// tells the client to stop sending the request if it still is. Either way
+// the request body is closed.
+func (w *responseWriter) cancel() {
+	w.sc.mu.Lock()
+	localOpen, remoteOpen := w.stream.localOpen(), w.stream.remoteOpen()
+	w.sc.mu.Unlock()
+	switch {
+	case localOpen:
+		w.sc.resetStream(w.stream.id, ErrCodeCancel)
+	case remoteOpen:
+		w.sc.resetStream(w.stream.id, ErrCodeNo)
+	}
+}
+
+// dataWrite writes one DATA frame, unless the stream was reset while the
+// frame sat in the queue.
+func (w *responseWriter) dataWrite(flags frame.Flags, chunk []byte) func(*frame.Framer) error {
+	return func(fr *frame.Framer) error {
+		w.sc.mu.Lock()
+		open := w.stream.localOpen()
+		w.sc.mu.Unlock()
+		if !open {
+			return errStreamClosed
+		}
+		return fr.WriteFrame(&frame.DataFrame{
+			FrameHeader: frame.FrameHeader{Flags: flags, StreamID: uint32(w.stream.id)},
+			Data:        chunk,
+		})
+	}
+}
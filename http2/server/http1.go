@@ -0,0 +1,444 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// HTTP/1.x fallback
+// https://datatracker.ietf.org/doc/html/rfc9112
+//
+// Clients that do not speak HTTP/2 at all still get served on the same
+// port: a cleartext connection that does not start with the preface, or a
+// TLS connection that negotiated "http/1.1" (or nothing) through ALPN, is
+// read as a series of HTTP/1.x requests. Each one goes to the same Handler
+// as an HTTP/2 stream would, and an http1Writer turns its HEADERS and DATA
+// into an HTTP/1.1 response.
+
+// serveHTTP1 serves HTTP/1.x requests on the connection until the client
+// or the server closes it. req is a request that has already been read,
+// if any.
+func (sc *serverConn) serveHTTP1(br *bufio.Reader, req *http.Request) {
+	bw := bufio.NewWriter(sc.conn)
+	for {
+		if req == nil {
+			var err error
+			if req, err = sc.readHTTP1Request(br); err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					log.Println("HTTP/1.x: malformed request:", err)
+					sc.rejectHTTP1(err)
+				}
+				return
+			}
+		}
+		log.Printf("Received %s %s %s", req.Proto, req.Method, req.RequestURI)
+
+		sc.mu.Lock()
+		sc.http1Busy = true
+		sc.mu.Unlock()
+		keepAlive, err := sc.serveHTTP1Request(bw, req)
+		sc.mu.Lock()
+		sc.http1Busy = false
+		shuttingDown := sc.shuttingDown
+		sc.mu.Unlock()
+		if err != nil {
+			log.Println("HTTP/1.x:", err)
+			return
+		}
+		if !keepAlive || shuttingDown {
+			return
+		}
+		req = nil
+	}
+}
+
+// maxHTTP1HeaderBytes bounds the request line and header section of an
+// HTTP/1.x request, as in net/http.
+const maxHTTP1HeaderBytes = http.DefaultMaxHeaderBytes
+
+// errHTTP1HeaderTooLarge means a request's header section goes past
+// maxHTTP1HeaderBytes.
+var errHTTP1HeaderTooLarge = errors.New("request header section too large")
+
+// readHTTP1Request reads the next request line and header section. Only
+// maxHTTP1HeaderBytes more are read off the connection for it; what br
+// has already buffered comes on top.
+func (sc *serverConn) readHTTP1Request(br *bufio.Reader) (*http.Request, error) {
+	sc.limit.N = maxHTTP1HeaderBytes
+	req, err := http.ReadRequest(br)
+	if err != nil && sc.limit.N <= 0 {
+		return nil, errHTTP1HeaderTooLarge
+	}
+	// The body and anything after it are not limited here
+	sc.limit.N = math.MaxInt64
+	return req, err
+}
+
+// rejectHTTP1 answers a request that could not be read before the
+// connection is closed. Closing with the client's bytes unread would
+// reset the connection and could lose the answer, so what the client is
+// still sending is drained for a moment first, as in net/http.
+func (sc *serverConn) rejectHTTP1(err error) {
+	status := "400 Bad Request"
+	if errors.Is(err, errHTTP1HeaderTooLarge) {
+		status = "431 Request Header Fields Too Large"
+	}
+	io.WriteString(sc.conn, "HTTP/1.1 "+status+"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	if cw, ok := sc.conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.CopyN(io.Discard, sc.conn, maxHTTP1Discard)
+}
+
+// serveHTTP1Request runs the handler for one request and reports whether
+// the connection can carry another one.
+func (sc *serverConn) serveHTTP1Request(bw *bufio.Writer, req *http.Request) (bool, error) {
+	sc.mu.Lock()
+	shuttingDown := sc.shuttingDown
+	sc.mu.Unlock()
+
+	w := &http1Writer{
+		w:   bw,
+		req: req,
+		// HTTP/1.0 keep-alive is not worth the trouble
+		close: req.Close || req.ProtoMajor == 1 && req.ProtoMinor == 0 || shuttingDown,
+	}
+	scheme := "http"
+	r := &Request{
+		Proto:      req.Proto,
+		Body:       http.NoBody,
+		RemoteAddr: sc.conn.RemoteAddr().String(),
+	}
+	body := &http1Body{
+		req:            req,
+		r:              r,
+		w:              w,
+		expectContinue: strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.ContentLength != 0,
+	}
+	if req.Body != http.NoBody {
+		r.Body = body
+	}
+	if tc, ok := sc.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		r.TLS = &state
+		scheme = "https"
+	}
+	r.Headers = http1Fields(req, scheme)
+	if sc.runHandler(w, r) {
+		// Only closing the connection tells the client the response is
+		// incomplete
+		return false, nil
+	}
+
+	// The next request starts where this body ends. A client still
+	// waiting for 100 Continue may never send the body at all.
+	if body.expectContinue {
+		w.close = true
+	} else if _, err := io.CopyN(io.Discard, req.Body, maxHTTP1Discard); !errors.Is(err, io.EOF) {
+		w.close = true
+	}
+
+	switch {
+	case w.ended:
+	case w.wroteHeaders:
+		w.WriteData(nil, true)
+	default:
+		// Where HTTP/2 would reset the stream
+		w.close = true
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "500"}}, true)
+	}
+	if w.err != nil {
+		return false, w.err
+	}
+	return !w.close, nil
+}
+
+// maxHTTP1Discard is how much of a body the handler did not read is
+// skipped to keep the connection for the next request.
+const maxHTTP1Discard = 256 << 10
+
+// http1Body is the Body of an HTTP/1.x request, read straight off the
+// connection. A client that sent "Expect: 100-continue" gets the go-ahead
+// when the handler first reads, unless the response has already begun.
+type http1Body struct {
+	req            *http.Request
+	r              *Request
+	w              *http1Writer
+	expectContinue bool
+}
+
+func (b *http1Body) Read(p []byte) (int, error) {
+	if b.expectContinue {
+		b.expectContinue = false
+		if !b.w.wroteHeaders && !b.w.ended {
+			b.w.w.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+			if err := b.w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := b.req.Body.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.r.Trailers = http1Trailers(b.req)
+	}
+	return n, err
+}
+
+// readHTTP1Body reads the whole body of req, which may be no longer than
+// maxSize. A client that sent "Expect: 100-continue" waits for the
+// go-ahead first.
+func readHTTP1Body(conn net.Conn, req *http.Request, maxSize int64) ([]byte, error) {
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.ContentLength != 0 {
+		if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading the request body: %w", err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// http1Fields turns an HTTP/1.x request into the header fields of an
+// HTTP/2 request. The request line and Host become pseudo-header fields;
+// connection-specific fields, and those the Connection header names, are
+// dropped.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-connection-specific-header-
+func http1Fields(req *http.Request, scheme string) []hpack.HeaderField {
+	headers := []hpack.HeaderField{{Name: ":method", Value: req.Method}}
+	if req.Method == http.MethodConnect {
+		headers = append(headers, hpack.HeaderField{Name: ":authority", Value: req.Host})
+	} else {
+		headers = append(headers,
+			hpack.HeaderField{Name: ":scheme", Value: scheme},
+			hpack.HeaderField{Name: ":authority", Value: req.Host},
+			hpack.HeaderField{Name: ":path", Value: req.RequestURI},
+		)
+	}
+	skip := map[string]bool{
+		"connection": true, "keep-alive": true, "proxy-connection": true, "transfer-encoding": true,
+		"upgrade": true, "http2-settings": true, "host": true, "expect": true,
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for t := range strings.SplitSeq(v, ",") {
+			skip[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		lower := strings.ToLower(name)
+		if skip[lower] {
+			continue
+		}
+		for _, v := range req.Header[name] {
+			if lower == "te" && v != "trailers" {
+				continue
+			}
+			headers = append(headers, hpack.HeaderField{Name: lower, Value: v})
+		}
+	}
+	return headers
+}
+
+// http1Trailers returns the trailer section of a chunked request body,
+// which has been read by now.
+func http1Trailers(req *http.Request) []hpack.HeaderField {
+	var fields []hpack.HeaderField
+	for _, name := range slices.Sorted(maps.Keys(req.Trailer)) {
+		for _, v := range req.Trailer[name] {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	return fields
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// http1Writer is the ResponseWriter of a request that came over HTTP/1.x.
+// The first HEADERS become the status line and header section, DATA the
+// body, and HEADERS after DATA the trailer section of a chunked body.
+// https://datatracker.ietf.org/doc/html/rfc9112#name-chunked-transfer-coding
+type http1Writer struct {
+	w   *bufio.Writer
+	req *http.Request
+	// close is set when the connection ends with this response
+	close bool
+
+	wroteHeaders bool
+	chunked      bool
+	// noBody is set for HEAD requests and statuses that have no content
+	noBody bool
+	ended  bool
+	err    error
+}
+
+func (w *http1Writer) WriteHeaders(headers []hpack.HeaderField, endStream bool) error {
+	if w.ended {
+		return errStreamClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.wroteHeaders {
+		return w.writeTrailers(headers, endStream)
+	}
+
+	status := http.StatusOK
+	if len(headers) > 0 && headers[0].Name == ":status" {
+		var err error
+		if status, err = strconv.Atoi(headers[0].Value); err != nil {
+			return fmt.Errorf("invalid :status %q", headers[0].Value)
+		}
+		headers = headers[1:]
+	}
+	fmt.Fprintf(w.w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if status < 200 {
+		// An informational response, the real one follows
+		w.writeFields(headers)
+		w.w.WriteString("\r\n")
+		return w.flush()
+	}
+
+	w.wroteHeaders = true
+	w.noBody = w.req.Method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified
+	hasLength, hasTrailer := false, false
+	for _, hf := range headers {
+		hasLength = hasLength || hf.Name == "content-length"
+		hasTrailer = hasTrailer || hf.Name == "trailer"
+	}
+	switch {
+	case w.noBody:
+	case hasTrailer && w.req.ProtoMinor > 0:
+		// Trailers need a chunked body, whatever the length
+		w.chunked = true
+		headers = slices.DeleteFunc(slices.Clone(headers), func(hf hpack.HeaderField) bool { return hf.Name == "content-length" })
+	case hasLength:
+	case endStream:
+		headers = append(headers, hpack.HeaderField{Name: "content-length", Value: "0"})
+	case w.req.ProtoMinor > 0:
+		w.chunked = true
+	default:
+		// An HTTP/1.0 body of unknown length ends with the connection
+		w.close = true
+	}
+	w.writeFields(headers)
+	if w.chunked {
+		w.w.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	if w.close {
+		w.w.WriteString("Connection: close\r\n")
+	}
+	w.w.WriteString("\r\n")
+	if endStream {
+		w.end()
+	}
+	return w.flush()
+}
+
+func (w *http1Writer) WriteData(data []byte, endStream bool) error {
+	if w.ended {
+		return errStreamClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if !w.wroteHeaders {
+		return errors.New("DATA before HEADERS")
+	}
+	if len(data) > 0 && !w.noBody {
+		if w.chunked {
+			fmt.Fprintf(w.w, "%x\r\n", len(data))
+			w.w.Write(data)
+			w.w.WriteString("\r\n")
+		} else {
+			w.w.Write(data)
+		}
+	}
+	if endStream {
+		w.end()
+	}
+	return w.flush()
+}
+
+// writeTrailers ends a chunked body with the trailer section. Without
+// chunked encoding there is nowhere to put them, so they are dropped.
+func (w *http1Writer) writeTrailers(trailers []hpack.HeaderField, endStream bool) error {
+	if !endStream {
+		return errors.New("trailers without END_STREAM")
+	}
+	if w.chunked {
+		w.w.WriteString("0\r\n")
+		w.writeFields(trailers)
+		w.w.WriteString("\r\n")
+		w.chunked = false
+	} else if len(trailers) > 0 {
+		log.Printf("HTTP/1.x: dropping %d trailers of a response that is not chunked", len(trailers))
+	}
+	w.end()
+	return w.flush()
+}
+
+// writeFields writes header or trailer fields. HTTP/2 carries any bytes
+// in a field, but a CR or LF here would end the field early and let a
+// value split the response, so fields whose name could not be written
+// are dropped and CR, LF and NUL in values become spaces, as in net/http.
+func (w *http1Writer) writeFields(fields []hpack.HeaderField) {
+	for _, hf := range fields {
+		if hf.Name == "" || strings.ContainsAny(hf.Name, ": \t\r\n\x00") {
+			log.Printf("HTTP/1.x: dropping field with invalid name %q", hf.Name)
+			continue
+		}
+		value := hf.Value
+		if strings.ContainsAny(value, "\r\n\x00") {
+			b := []byte(value)
+			for i, c := range b {
+				if c == '\r' || c == '\n' || c == 0 {
+					b[i] = ' '
+				}
+			}
+			value = string(b)
+		}
+		fmt.Fprintf(w.w, "%s: %s\r\n", http.CanonicalHeaderKey(hf.Name), value)
+	}
+}
+
+func (w *http1Writer) end() {
+	if w.chunked {
+		w.w.WriteString("0\r\n\r\n")
+	}
+	w.ended = true
+}
+
+func (w *http1Writer) flush() error {
+	if err := w.w.Flush(); err != nil {
+		w.err = err
+	}
+	return w.err
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// HTTPHandler serves every stream with h, so existing net/http handlers and
+// middleware run on this server. Each request becomes an *http.Request
+// and the response is written as HEADERS, DATA and, if the handler sets
+// trailers, a final HEADERS frame.
+//
+//	srv := &server.Server{Handler: server.HTTPHandler(mux)}
+func HTTPHandler(h http.Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		req, err := newHTTPRequest(r)
+		if err != nil {
+			// A malformed request
+			// https://datatracker.ietf.org/doc/html/rfc9113#name-malformed-messages
+			log.Printf("Stream %d: malformed request: %v", r.StreamID, err)
+			w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "400"}}, true)
+			return
+		}
+		rw := &httpResponseWriter{w: w, header: make(http.Header), head: req.Method == http.MethodHead}
+		h.ServeHTTP(rw, req)
+		rw.finish()
+	})
+}
+
+// newHTTPRequest turns the header fields of a stream into an http.Request.
+// The pseudo-header fields carry what HTTP/1.1 has in its request line.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-request-pseudo-header-field
+func newHTTPRequest(r *Request) (*http.Request, error) {
+	pseudo := make(map[string]string)
+	header := make(http.Header)
+	var cookies []string
+	for _, hf := range r.Headers {
+		if strings.HasPrefix(hf.Name, ":") {
+			if len(header) > 0 || len(cookies) > 0 {
+				return nil, fmt.Errorf("pseudo-header %s after a regular field", hf.Name)
+			}
+			switch hf.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", hf.Name)
+			}
+			if _, dup := pseudo[hf.Name]; dup {
+				return nil, fmt.Errorf("duplicate pseudo-header %s", hf.Name)
+			}
+			pseudo[hf.Name] = hf.Value
+			continue
+		}
+		if hf.Name != strings.ToLower(hf.Name) {
+			return nil, fmt.Errorf("uppercase field name %q", hf.Name)
+		}
+		// Cookies may be split into several fields for better compression
+		// https://datatracker.ietf.org/doc/html/rfc9113#name-compressing-the-cookie-head
+		if hf.Name == "cookie" {
+			cookies = append(cookies, hf.Value)
+			continue
+		}
+		header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	if len(cookies) > 0 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	method, path := pseudo[":method"], pseudo[":path"]
+	if method == "" {
+		return nil, errors.New("missing :method")
+	}
+	authority := pseudo[":authority"]
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+	header.Del("Host")
+
+	var u *url.URL
+	if method == http.MethodConnect {
+		// CONNECT only names the host to tunnel to
+		u = &url.URL{Host: authority}
+	} else {
+		if pseudo[":scheme"] == "" || path == "" {
+			return nil, errors.New("missing :scheme or :path")
+		}
+		var err error
+		if u, err = url.ParseRequestURI(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Announced trailers are there from the start, without a value until
+	// the body has been read
+	var trailer http.Header
+	for _, v := range header.Values("Trailer") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if trailer == nil {
+					trailer = make(http.Header)
+				}
+				trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/2.0"
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("invalid protocol %q", proto)
+	}
+
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Body:       http.NoBody,
+		Trailer:    trailer,
+		Host:       authority,
+		RequestURI: path,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		req.Body = &httpRequestBody{r: r, req: req}
+		req.ContentLength = -1
+		if cl := header.Get("Content-Length"); cl != "" {
+			n, err := strconv.ParseInt(cl, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid content-length %q", cl)
+			}
+			req.ContentLength = n
+		}
+	}
+	return req, nil
+}
+
+// httpRequestBody is the http.Request.Body. Once the body has been read
+// to the end, the trailers are in and go into http.Request.Trailer.
+type httpRequestBody struct {
+	r   *Request
+	req *http.Request
+	eof bool
+}
+
+func (b *httpRequestBody) Read(p []byte) (int, error) {
+	n, err := b.r.Body.Read(p)
+	if errors.Is(err, io.EOF) && !b.eof {
+		b.eof = true
+		for _, hf := range b.r.Trailers {
+			if b.req.Trailer == nil {
+				b.req.Trailer = make(http.Header)
+			}
+			b.req.Trailer.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+		}
+	}
+	return n, err
+}
+
+func (b *httpRequestBody) Close() error {
+	return nil
+}
+
+// bufferSize is how much of the body is collected before a DATA frame is
+// sent. A response that fits is sent with a content-length.
+const bufferSize = 4096
+
+// httpResponseWriter implements http.ResponseWriter, http.Flusher and
+// http.Pusher on top of a stream's ResponseWriter.
+type httpResponseWriter struct {
+	w      ResponseWriter
+	header http.Header
+	status int
+	buf    bytes.Buffer
+	// head is set for a HEAD request, whose response has no body
+	head bool
+	// sentHeaders is set once the response HEADERS are on the wire
+	sentHeaders bool
+	err         error
+}
+
+func (rw *httpResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *httpResponseWriter) WriteHeader(code int) {
+	if rw.status != 0 {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
+	if code == http.StatusSwitchingProtocols {
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-8.6
+		panic("WriteHeader code 101 is not allowed in HTTP/2")
+	}
+	// Informational responses go out on their own HEADERS frame and the
+	// final response follows later
+	if code >= 100 && code < 200 {
+		rw.writeHeaderFields(code, false)
+		return
+	}
+	rw.status = code
+}
+
+// Write buffers p for the response body. As with net/http, a 204 or 304
+// response cannot have one, and the body of a response to HEAD is thrown
+// away.
+func (rw *httpResponseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(rw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if rw.head {
+		return len(p), nil
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.buf.Write(p)
+	if rw.buf.Len() >= bufferSize {
+		rw.Flush()
+	}
+	return len(p), rw.err
+}
+
+// Push implements http.Pusher when the stream's ResponseWriter is a
+// Pusher. Only GET requests can be pushed here.
+func (rw *httpResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := rw.w.(Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	var headers []hpack.HeaderField
+	if opts != nil {
+		if opts.Method != "" && opts.Method != http.MethodGet {
+			return fmt.Errorf("cannot push a %s request", opts.Method)
+		}
+		for _, name := range slices.Sorted(maps.Keys(opts.Header)) {
+			for _, v := range opts.Header[name] {
+				headers = append(headers, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+			}
+		}
+	}
+	err := p.Push(target, headers)
+	if errors.Is(err, ErrPushNotSupported) {
+		return http.ErrNotSupported
+	}
+	return err
+}
+
+// EnableFullDuplex lets http.ResponseController switch a handler to
+// reading the request while writing the response. The body streams in
+// while the handler runs, so there is nothing to switch.
+func (rw *httpResponseWriter) EnableFullDuplex() error {
+	return nil
+}
+
+// Flush sends the headers and whatever body has been written so far.
+func (rw *httpResponseWriter) Flush() {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return
+	}
+	rw.sendHeaders(false)
+	if rw.buf.Len() > 0 && rw.err == nil {
+		rw.err = rw.w.WriteData(rw.buf.Bytes(), false)
+		rw.buf.Reset()
+	}
+}
+
+// finish ends the stream once the handler has returned: with the last
+// DATA frame, or with the trailers if there are any.
+func (rw *httpResponseWriter) finish() {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return
+	}
+	trailers := rw.trailers()
+	if !rw.sentHeaders && rw.header.Get("Content-Length") == "" && bodyAllowed(rw.status) && !rw.head {
+		rw.header.Set("Content-Length", strconv.Itoa(rw.buf.Len()))
+	}
+	if rw.buf.Len() == 0 && len(trailers) == 0 {
+		if rw.sentHeaders {
+			rw.w.WriteData(nil, true)
+		} else {
+			rw.sendHeaders(true)
+		}
+		return
+	}
+	rw.sendHeaders(false)
+	if rw.buf.Len() > 0 && rw.err == nil {
+		rw.err = rw.w.WriteData(rw.buf.Bytes(), len(trailers) == 0)
+	}
+	if len(trailers) > 0 && rw.err == nil {
+		rw.w.WriteHeaders(trailers, true)
+	}
+}
+
+func (rw *httpResponseWriter) sendHeaders(endStream bool) {
+	if rw.sentHeaders || rw.err != nil {
+		return
+	}
+	rw.sentHeaders = true
+	if rw.status == http.StatusNoContent {
+		// https://datatracker.ietf.org/doc/html/rfc9110#section-8.6-8
+		rw.header.Del("Content-Length")
+	}
+	if rw.header.Get("Content-Type") == "" && rw.buf.Len() > 0 {
+		rw.header.Set("Content-Type", http.DetectContentType(rw.buf.Bytes()))
+	}
+	rw.writeHeaderFields(rw.status, endStream)
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+// A 304 or the response to a HEAD may still carry the Content-Length of
+// the body they leave out, but only if the handler set it.
+// https://datatracker.ietf.org/doc/html/rfc9110#section-6.4.1
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// connectionHeaders are HTTP/1.1 fields that make no sense on an HTTP/2
+// stream and must not be sent.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-connection-specific-header-
+var connectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func (rw *httpResponseWriter) writeHeaderFields(status int, endStream bool) {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(status)}}
+	declared := rw.declaredTrailers()
+	// Sorted, so that equal responses compress the same way
+	for _, name := range slices.Sorted(maps.Keys(rw.header)) {
+		if connectionHeaders[name] || declared[name] || strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range rw.header[name] {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	if err := rw.w.WriteHeaders(fields, endStream); err != nil {
+		rw.err = err
+	}
+}
+
+// trailers collects the trailer fields the handler set, the net/http way:
+// either announced in the "Trailer" header before the body was written, or
+// set with the http.TrailerPrefix afterwards.
+func (rw *httpResponseWriter) trailers() []hpack.HeaderField {
+	values := make(map[string][]string)
+	add := func(name string, v []string) {
+		name = strings.ToLower(name)
+		values[name] = append(values[name], v...)
+	}
+	for name := range rw.declaredTrailers() {
+		add(name, rw.header[name])
+	}
+	for name, v := range rw.header {
+		if name, ok := strings.CutPrefix(name, http.TrailerPrefix); ok {
+			add(name, v)
+		}
+	}
+	var fields []hpack.HeaderField
+	// Sorted like the headers
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		for _, v := range values[name] {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: v})
+		}
+	}
+	return fields
+}
+
+// declaredTrailers returns the names listed in the "Trailer" header. They
+// are left out of the header block and sent as trailers.
+func (rw *httpResponseWriter) declaredTrailers() map[string]bool {
+	declared := make(map[string]bool)
+	for _, v := range rw.header.Values("Trailer") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				declared[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return declared
+}
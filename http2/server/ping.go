@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/rand"
+	"log"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// PING
+// https://datatracker.ietf.org/doc/html/rfc9113#name-ping
+//
+// A PING carries 8 bytes of opaque data that the receiver sends straight
+// back in a PING with the ACK flag. We answer every PING, and send our own
+// when a connection has been quiet for Server.ReadIdleTimeout, to find out
+// whether the client is still there.
+
+// defaultPingTimeout is used when Server.PingTimeout is zero.
+const defaultPingTimeout = 15 * time.Second
+
+// minKeepaliveTick keeps the keepalive ticker from spinning, or panicking
+// on a zero interval, when the timeouts are tiny.
+const minKeepaliveTick = time.Millisecond
+
+// handlePing answers a PING or matches an ACK to the PING we sent.
+func (sc *serverConn) handlePing(f *frame.PingFrame) error {
+	if !f.Flags.Has(frame.FlagAck) {
+		if err := sc.count(AbusePingFlood); err != nil {
+			return err
+		}
+		log.Printf("Received PING %x, sending ACK", f.Data)
+		return sc.writeFrame(&frame.PingFrame{FrameHeader: frame.FrameHeader{Flags: frame.FlagAck}, Data: f.Data})
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.pingPending && f.Data == sc.pingData {
+		log.Printf("Received PING ACK after %v", time.Since(sc.pingSent))
+		sc.pingPending = false
+	}
+	return nil
+}
+
+// keepalive sends a PING whenever nothing has been read for idleTimeout
+// and closes the connection if the ACK does not arrive within pingTimeout.
+// It returns once the connection is closed.
+func (sc *serverConn) keepalive(idleTimeout, pingTimeout time.Duration) {
+	ticker := time.NewTicker(max(min(idleTimeout, pingTimeout)/4, minKeepaliveTick))
+	defer ticker.Stop()
+	for range ticker.C {
+		sc.mu.Lock()
+		if sc.closed {
+			sc.mu.Unlock()
+			return
+		}
+		if sc.pingPending {
+			late := time.Since(sc.pingSent) > pingTimeout
+			sc.mu.Unlock()
+			if late {
+				log.Printf("No PING ACK within %v, closing connection", pingTimeout)
+				sc.conn.Close()
+				return
+			}
+			continue
+		}
+		if time.Since(time.Unix(0, sc.lastRead.Load())) < idleTimeout {
+			sc.mu.Unlock()
+			continue
+		}
+		rand.Read(sc.pingData[:])
+		data := sc.pingData
+		sc.pingSent = time.Now()
+		sc.pingPending = true
+		sc.mu.Unlock()
+
+		log.Printf("Connection idle, sending PING %x", data)
+		if err := sc.writeFrame(&frame.PingFrame{Data: data}); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"log"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// The stream prioritization signal of RFC 7540 is deprecated by RFC 9113,
+// but HEADERS and PRIORITY frames may still carry it. The server only
+// records it; scheduling follows RFC 9218, see extpriority.go.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-priority
+
+// defaultPriorityParam is what every stream gets without an RFC 7540
+// priority: a non-exclusive dependency on stream 0 with weight 16.
+// https://datatracker.ietf.org/doc/html/rfc7540#section-5.3.5
+var defaultPriorityParam = frame.PriorityParam{Weight: 15}
+
+// checkPriority rejects a stream that depends on itself.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-5.3.1-3
+func checkPriority(streamID int, p frame.PriorityParam) error {
+	if int(p.StreamDep) == streamID {
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeProtocol, Reason: "stream depends on itself"}
+	}
+	return nil
+}
+
+// handlePriority records the priority a PRIORITY frame (type 0x2) gives a
+// stream. It may arrive in any stream state, even for idle streams, which
+// cannot be reset and so are left alone when the frame is invalid.
+func (sc *serverConn) handlePriority(f *frame.PriorityFrame) error {
+	streamID := int(f.StreamID)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	idle := sc.isIdle(streamID)
+
+	prio := f.PriorityParam
+	log.Printf("Stream %d: Received PRIORITY %s", streamID, prio)
+	if err := checkPriority(streamID, prio); err != nil {
+		if idle {
+			return nil
+		}
+		return err
+	}
+	if stream, ok := sc.streams[streamID]; ok {
+		stream.legacyPriority = prio
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+// Server push
+// https://datatracker.ietf.org/doc/html/rfc9113#name-server-push
+//
+// While answering a request the server may promise the response to another
+// one, e.g. the stylesheet of a page, so the client does not have to ask.
+// The PUSH_PROMISE goes out on the client's stream and carries the promised
+// request's header fields and a new even stream ID. That stream is reserved
+// (local) until the server sends its response HEADERS on it. A client that
+// sets SETTINGS_ENABLE_PUSH to 0 must never get a PUSH_PROMISE, and one
+// that does not want a pushed response resets the promised stream.
+//
+//	+---------------------------------------------------------------+
+//	|R|                  Promised Stream ID (31)                    |
+//	+-+-----------------------------+-------------------------------+
+//	|                   Field Block Fragment (*)                    |
+//	+---------------------------------------------------------------+
+
+// ErrPushNotSupported is returned by Push when the client disabled push,
+// or the stream cannot push (it is itself pushed).
+var ErrPushNotSupported = errors.New("server push not supported")
+
+// Pusher is implemented by the ResponseWriter of HTTP/2 streams. It is the
+// counterpart of http.Pusher.
+type Pusher interface {
+	// Push promises the response to a GET request for path, with headers
+	// as its regular header fields, and serves that request with the
+	// server's Handler on a new stream. Push it before the response
+	// refers to the resource, so the client does not ask for it itself.
+	Push(path string, headers []hpack.HeaderField) error
+}
+
+// maxStreamID is the largest stream ID; push stops there.
+const maxStreamID = 1<<31 - 1
+
+// Push sends a PUSH_PROMISE on the stream and starts serving the promised
+// request.
+func (w *responseWriter) Push(path string, headers []hpack.HeaderField) error {
+	if w.stream.id%2 == 0 {
+		// Only a client's request can be the parent of a push
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-6.6-4
+		return ErrPushNotSupported
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("push path %q is not absolute", path)
+	}
+	parent := &Request{Headers: w.stream.headers}
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: parent.Header(":scheme")},
+		{Name: ":authority", Value: parent.Header(":authority")},
+		{Name: ":path", Value: path},
+	}
+	for _, hf := range headers {
+		if strings.HasPrefix(hf.Name, ":") || hf.Name != strings.ToLower(hf.Name) {
+			return fmt.Errorf("invalid push header %q", hf.Name)
+		}
+		fields = append(fields, hf)
+	}
+	return w.sc.push(w.stream, path, fields)
+}
+
+// push promises the request in fields on the parent stream and serves it.
+// The promised ID is picked by the writer right before the PUSH_PROMISE is
+// written, so promised IDs reach the client in increasing order whatever
+// order the scheduler sends the parents' frames in.
+func (sc *serverConn) push(parent *streamState, path string, fields []hpack.HeaderField) error {
+	sc.mu.Lock()
+	enabled := sc.peer.EnablePush
+	full := sc.activeStreams(true) >= sc.peer.MaxConcurrentStreams
+	shuttingDown := sc.shuttingDown
+	maxFrameSize := int(sc.peer.MaxFrameSize)
+	sc.mu.Unlock()
+	switch {
+	case !enabled:
+		return ErrPushNotSupported
+	case full:
+		return errors.New("push: the client's MAX_CONCURRENT_STREAMS reached")
+	case shuttingDown:
+		return errors.New("push: server is shutting down")
+	}
+
+	var stream *streamState
+	err := sc.submit(parent.id, func(fr *frame.Framer) error {
+		sc.mu.Lock()
+		if !parent.localOpen() {
+			sc.mu.Unlock()
+			return errStreamClosed
+		}
+		if sc.maxPushStreamID+2 > maxStreamID {
+			sc.mu.Unlock()
+			return errors.New("push: stream IDs used up")
+		}
+		sc.maxPushStreamID += 2
+		stream = &streamState{
+			id:             sc.maxPushStreamID,
+			headers:        fields,
+			state:          stateReservedLocal,
+			legacyPriority: defaultPriorityParam,
+			priority:       DefaultPriority,
+			sendWindow:     int64(sc.peer.InitialWindowSize),
+			recvWindow:     int64(sc.local.InitialWindowSize),
+		}
+		sc.streams[stream.id] = stream
+		sc.mu.Unlock()
+
+		log.Printf("Stream %d: PUSH_PROMISE stream %d for %s", parent.id, stream.id, path)
+		// The promised stream ID takes 4 bytes of the first frame
+		return sc.encodeAndSendBlock(fr, parent.id, fields, maxFrameSize-4, func(h frame.FrameHeader, fragment []byte) frame.Frame {
+			return &frame.PushPromiseFrame{FrameHeader: h, PromisedStreamID: uint32(stream.id), BlockFragment: fragment}
+		})
+	})
+	if err != nil {
+		if stream != nil {
+			sc.mu.Lock()
+			sc.closeStreamLocked(stream)
+			sc.mu.Unlock()
+		}
+		return err
+	}
+	go sc.servePush(stream)
+	return nil
+}
+
+// servePush answers a promised request. Its response HEADERS move the
+// stream from reserved (local) to half-closed (remote); the client never
+// sends on it.
+func (sc *serverConn) servePush(stream *streamState) {
+	sc.mu.Lock()
+	if stream.state == stateReservedLocal {
+		stream.state = stateHalfClosedRemote
+	}
+	sc.mu.Unlock()
+	sc.serveStream(stream)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// Priority is the RFC 9218 priority of a stream: an urgency from 0 (most
+// urgent) to 7, and whether the response is useful piece by piece, so that
+// it may share the connection with other incremental responses.
+// https://datatracker.ietf.org/doc/html/rfc9218#name-priority-parameters
+type Priority struct {
+	Urgency     uint8
+	Incremental bool
+}
+
+// DefaultPriority is the priority of a stream that did not ask for one.
+var DefaultPriority = Priority{Urgency: 3}
+
+func (p Priority) String() string {
+	if p.Incremental {
+		return fmt.Sprintf("u=%d, i", p.Urgency)
+	}
+	return fmt.Sprintf("u=%d", p.Urgency)
+}
+
+// FrameWrite is one or more frames queued for the connection's writer: a
+// DATA frame, a whole header block or a control frame.
+type FrameWrite struct {
+	streamID int
+	priority Priority
+	// write runs on the writer goroutine. It may use the HPACK encoder.
+	write func(fr *frame.Framer) error
+	// done receives the result of write, unless it is nil.
+	done chan error
+}
+
+// StreamID returns the stream the frames belong to, 0 for the connection.
+func (fw FrameWrite) StreamID() int {
+	return fw.streamID
+}
+
+// Priority returns the priority the stream had when the write was queued.
+func (fw FrameWrite) Priority() Priority {
+	return fw.priority
+}
+
+// WriteScheduler decides the order in which queued frames are written.
+// Frames of one stream must be written in the order they were pushed.
+// A scheduler is only used by the writer goroutine of one connection.
+type WriteScheduler interface {
+	// Push queues a write.
+	Push(fw FrameWrite)
+	// Pop removes and returns the write to send next. It returns false if
+	// nothing is queued.
+	Pop() (FrameWrite, bool)
+}
+
+// writeQueue is the FIFO of one stream.
+type writeQueue struct {
+	streamID int
+	priority Priority
+	writes   []FrameWrite
+}
+
+func (q *writeQueue) push(fw FrameWrite) {
+	q.writes = append(q.writes, fw)
+	// The latest priority wins, e.g. after a PRIORITY_UPDATE
+	q.priority = fw.priority
+}
+
+func (q *writeQueue) pop() FrameWrite {
+	fw := q.writes[0]
+	q.writes = q.writes[1:]
+	return fw
+}
+
+// NewRoundRobinScheduler returns a scheduler that takes turns between the
+// streams with something to write, one frame each. Connection frames such
+// as SETTINGS and PING go first.
+func NewRoundRobinScheduler() WriteScheduler {
+	return &roundRobinScheduler{queues: make(map[int]*writeQueue)}
+}
+
+type roundRobinScheduler struct {
+	control writeQueue
+	queues  map[int]*writeQueue
+	// ring holds the streams with queued writes in the order they are served
+	ring []*writeQueue
+}
+
+func (s *roundRobinScheduler) Push(fw FrameWrite) {
+	if fw.streamID == 0 {
+		s.control.push(fw)
+		return
+	}
+	q, ok := s.queues[fw.streamID]
+	if !ok {
+		q = &writeQueue{streamID: fw.streamID}
+		s.queues[fw.streamID] = q
+		s.ring = append(s.ring, q)
+	}
+	q.push(fw)
+}
+
+func (s *roundRobinScheduler) Pop() (FrameWrite, bool) {
+	if len(s.control.writes) > 0 {
+		return s.control.pop(), true
+	}
+	if len(s.ring) == 0 {
+		return FrameWrite{}, false
+	}
+	q := s.ring[0]
+	fw := q.pop()
+	s.ring = s.ring[1:]
+	if len(q.writes) > 0 {
+		// Back of the line
+		s.ring = append(s.ring, q)
+	} else {
+		delete(s.queues, q.streamID)
+	}
+	return fw, true
+}
+
+// NewPriorityScheduler returns a scheduler that follows the RFC 9218
+// priorities of the streams. The most urgent streams are served first.
+// Within one urgency, non-incremental responses are sent one after the
+// other in stream order, and incremental ones then share the connection
+// round-robin.
+// https://datatracker.ietf.org/doc/html/rfc9218#name-server-scheduling
+func NewPriorityScheduler() WriteScheduler {
+	return &priorityScheduler{queues: make(map[int]*writeQueue)}
+}
+
+type priorityScheduler struct {
+	control writeQueue
+	queues  map[int]*writeQueue
+	// lastIncremental is the incremental stream served last, so the next
+	// one in ID order gets its turn.
+	lastIncremental int
+}
+
+func (s *priorityScheduler) Push(fw FrameWrite) {
+	if fw.streamID == 0 {
+		s.control.push(fw)
+		return
+	}
+	q, ok := s.queues[fw.streamID]
+	if !ok {
+		q = &writeQueue{streamID: fw.streamID}
+		s.queues[fw.streamID] = q
+	}
+	q.push(fw)
+}
+
+func (s *priorityScheduler) Pop() (FrameWrite, bool) {
+	if len(s.control.writes) > 0 {
+		return s.control.pop(), true
+	}
+	q := s.next()
+	if q == nil {
+		return FrameWrite{}, false
+	}
+	fw := q.pop()
+	if q.priority.Incremental {
+		s.lastIncremental = q.streamID
+	}
+	if len(q.writes) == 0 {
+		delete(s.queues, q.streamID)
+	}
+	return fw, true
+}
+
+// next picks the queue to serve.
+func (s *priorityScheduler) next() *writeQueue {
+	var urgent []*writeQueue
+	for _, q := range s.queues {
+		switch {
+		case len(urgent) == 0 || q.priority.Urgency < urgent[0].priority.Urgency:
+			urgent = append(urgent[:0], q)
+		case q.priority.Urgency == urgent[0].priority.Urgency:
+			urgent = append(urgent, q)
+		}
+	}
+	if len(urgent) == 0 {
+		return nil
+	}
+	slices.SortFunc(urgent, func(a, b *writeQueue) int { return a.streamID - b.streamID })
+
+	// Non-incremental responses are only useful whole, so finish the
+	// oldest one before starting another
+	for _, q := range urgent {
+		if !q.priority.Incremental {
+			return q
+		}
+	}
+	// Incremental responses take turns
+	for _, q := range urgent {
+		if q.streamID > s.lastIncremental {
+			return q
+		}
+	}
+	return urgent[0]
+}
@@ -0,0 +1,232 @@
+// Package server is a mini HTTP/2 server built directly on top of TCP.
+//
+// It speaks h2c (HTTP/2 over cleartext) with prior knowledge or after an
+// HTTP/1.1 Upgrade, e.g.
+//
+//	curl --http2-prior-knowledge http://localhost:8080
+//	curl --http2 http://localhost:8080
+//
+// and HTTP/2 over TLS, negotiated with ALPN, through ServeTLS. Clients that
+// only speak HTTP/1.x are served on the same port.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// Server accepts h2c connections and passes every new stream to Handler.
+type Server struct {
+	// Addr is the TCP address to listen on, ":8080" if empty.
+	Addr string
+
+	// Handler responds to requests. EchoHandler is used if nil.
+	Handler Handler
+
+	// TLSConfig is used by ServeTLS and ListenAndServeTLS. "h2" is added to
+	// its NextProtos and TLS 1.2 is the minimum version.
+	TLSConfig *tls.Config
+
+	// Settings are advertised to every client in the server's first
+	// SETTINGS frame. If nil, DefaultSettings is used with push disabled,
+	// at most defaultMaxConcurrentStreams streams per connection, header
+	// lists of at most defaultMaxHeaderListSize bytes and
+	// NoRFC7540Priorities set.
+	Settings *Settings
+
+	// NewWriteScheduler returns the scheduler that orders the frames of
+	// a new connection. NewRoundRobinScheduler is used if nil; pick
+	// NewPriorityScheduler to act on the clients' RFC 9218 priorities.
+	NewWriteScheduler func() WriteScheduler
+
+	// ReadIdleTimeout is how long a connection may stay silent before the
+	// server checks on the client with a PING. Zero disables keepalive.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout is how long to wait for the ACK of that PING before the
+	// connection is closed, 15 seconds if zero.
+	PingTimeout time.Duration
+
+	// Limits protects the server from clients that flood it with frames,
+	// see dos.go. DefaultLimits is used if nil.
+	Limits *Limits
+
+	inShutdown atomic.Bool
+	abuses     [numAbuses]atomic.Uint64
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+}
+
+// ListenAndServe listens on s.Addr and then calls Serve.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each one in its own goroutine.
+// It always returns a non-nil error and closes ln. After Shutdown the error
+// is ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+
+	if err := s.settings().Validate(); err != nil {
+		return err
+	}
+	if !s.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("Accept error:", err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Shutdown stops the server gracefully. It closes every listener, sends
+// GOAWAY to every connection so that clients open no new streams, and
+// waits for the streams in flight to finish before closing each
+// connection. If ctx ends first, the remaining connections are closed
+// right away and ctx's error is returned.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-6.8-7
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for sc := range s.conns {
+		sc.startGracefulShutdown()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for sc := range s.conns {
+				sc.conn.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections that have no streams left and
+// reports whether every connection is gone.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		if sc.idle() {
+			sc.conn.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a connection from the set Shutdown waits for.
+func (s *Server) trackConn(sc *serverConn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	if add {
+		s.conns[sc] = struct{}{}
+	} else {
+		delete(s.conns, sc)
+	}
+}
+
+// defaultMaxConcurrentStreams bounds the handler goroutines one client can
+// start at once. RFC 9113 recommends no fewer than 100.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-6.5.2-2.8.1
+const defaultMaxConcurrentStreams = 100
+
+func (s *Server) settings() Settings {
+	if s.Settings == nil {
+		settings := DefaultSettings()
+		// Push is a client setting; a server must never advertise 1.
+		settings.EnablePush = false
+		settings.MaxConcurrentStreams = defaultMaxConcurrentStreams
+		settings.MaxHeaderListSize = defaultMaxHeaderListSize
+		// Scheduling follows RFC 9218, the RFC 7540 tree is only recorded
+		settings.NoRFC7540Priorities = true
+		return settings
+	}
+	return *s.Settings
+}
+
+func (s *Server) pingTimeout() time.Duration {
+	if s.PingTimeout == 0 {
+		return defaultPingTimeout
+	}
+	return s.PingTimeout
+}
+
+func (s *Server) newWriteScheduler() WriteScheduler {
+	if s.NewWriteScheduler == nil {
+		return NewRoundRobinScheduler()
+	}
+	return s.NewWriteScheduler()
+}
+
+func (s *Server) handler() Handler {
+	if s.Handler == nil {
+		return EchoHandler
+	}
+	return s.Handler
+}
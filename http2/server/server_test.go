@@ -0,0 +1,1881 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/grpc"
+	"github.com/nethish/fromscratch/http2/h2tls"
+	"github.com/nethish/fromscratch/http2/hpack"
+)
+
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func sendFrameTo(w io.Writer, frameType, flags byte, streamID int, payload []byte) error {
+	length := len(payload)
+	frame := append([]byte{
+		byte(length >> 16), byte(length >> 8), byte(length),
+		frameType,
+		flags,
+		byte(streamID >> 24 & 0x7F), byte(streamID >> 16), byte(streamID >> 8), byte(streamID),
+	}, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readTestFrame(r io.Reader) (frameType, flags byte, streamID int, payload []byte, err error) {
+	header := make([]byte, 9)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	frameType, flags = header[3], header[4]
+	streamID = int(header[5]&0x7F)<<24 | int(header[6])<<16 | int(header[7])<<8 | int(header[8])
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// echo opens a connection, POSTs body on stream 1 and returns the echoed body.
+func echo(addr string, body []byte) ([]byte, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x4, 1, block.Bytes())
+	sendFrameTo(&out, 0x0, 0x1, 1, body)
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var got []byte
+	for {
+		frameType, flags, streamID, payload, err := readTestFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		if frameType != 0x0 || streamID != 1 {
+			continue
+		}
+		got = append(got, payload...)
+		if flags&0x1 == 0x1 {
+			return got, nil
+		}
+	}
+}
+
+// Every client uses stream 1, so streams must not leak between connections.
+func TestConcurrentClientsAreIsolated(t *testing.T) {
+	addr := startServer(t, &Server{Handler: EchoHandler})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			want := []byte(fmt.Sprintf("hello from client %d", i))
+			got, err := echo(addr, want)
+			if err != nil {
+				t.Errorf("client %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("client %d: got %q, want %q", i, got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func encodeBlock(fields ...hpack.HeaderField) []byte {
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	return block.Bytes()
+}
+
+var getRequest = []hpack.HeaderField{
+	{Name: ":method", Value: "GET"},
+	{Name: ":path", Value: "/"},
+	{Name: ":scheme", Value: "http"},
+}
+
+// waitFor reads frames until one of type want arrives on streamID.
+func waitFor(t *testing.T, conn net.Conn, want byte, streamID int) []byte {
+	t.Helper()
+	for {
+		frameType, _, id, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatalf("waiting for frame type 0x%x: %v", want, err)
+		}
+		if frameType == want && id == streamID {
+			return payload
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HelloHandler})
+	setting := func(id SettingID, val uint32) []byte {
+		return frame.AppendSettings(nil, []frame.Setting{{ID: id, Val: val}})
+	}
+
+	t.Run("ACK", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(clientPreface))
+		sendFrameTo(conn, 0x4, 0x0, 0, setting(SettingMaxFrameSize, 1<<20))
+
+		var gotSettings, gotAck bool
+		for !gotSettings || !gotAck {
+			frameType, flags, id, payload, err := readTestFrame(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType != 0x4 || id != 0 {
+				continue
+			}
+			if flags&0x1 == 0 {
+				gotSettings = true
+				if len(payload)%6 != 0 {
+					t.Errorf("server SETTINGS has %d bytes", len(payload))
+				}
+				continue
+			}
+			gotAck = true
+			if len(payload) != 0 {
+				t.Errorf("SETTINGS ACK carries %d bytes", len(payload))
+			}
+		}
+	})
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		wantCode ErrCode
+	}{
+		{"ENABLE_PUSH above 1", setting(SettingEnablePush, 2), ErrCodeProtocol},
+		{"INITIAL_WINDOW_SIZE above 2^31-1", setting(SettingInitialWindowSize, 1<<31), ErrCodeFlowControl},
+		{"MAX_FRAME_SIZE below 2^14", setting(SettingMaxFrameSize, 1<<14-1), ErrCodeProtocol},
+		{"MAX_FRAME_SIZE above 2^24-1", setting(SettingMaxFrameSize, 1<<24), ErrCodeProtocol},
+		{"length not a multiple of 6", []byte{0, 4, 0, 0, 0}, ErrCodeFrameSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(clientPreface))
+			sendFrameTo(conn, 0x4, 0x0, 0, tt.payload)
+
+			payload := waitFor(t, conn, 0x7, 0)
+			if got := ErrCode(binary.BigEndian.Uint32(payload[4:])); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestStreamStateErrors(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HelloHandler})
+	type frame struct {
+		frameType, flags byte
+		streamID         int
+		payload          []byte
+	}
+	get := func(id int) frame { return frame{0x1, 0x5, id, encodeBlock(getRequest...)} }
+	post := func(id int) frame { return frame{0x1, 0x4, id, encodeBlock(getRequest...)} }
+
+	tests := []struct {
+		name   string
+		frames []frame
+		// wantType is RST_STREAM (0x3) or GOAWAY (0x7)
+		wantType byte
+		wantID   int
+		wantCode ErrCode
+	}{
+		{"DATA on idle stream", []frame{{0x0, 0x1, 1, []byte("hi")}}, 0x7, 0, ErrCodeProtocol},
+		{"client opens even stream", []frame{get(2)}, 0x7, 0, ErrCodeProtocol},
+		{"stream ID goes backwards", []frame{get(5), get(3)}, 0x7, 0, ErrCodeStreamClosed},
+		{"DATA after END_STREAM", []frame{post(1), {0x0, 0x1, 1, nil}, {0x0, 0x1, 1, nil}}, 0x3, 1, ErrCodeStreamClosed},
+		{"trailers without END_STREAM", []frame{post(1), {0x1, 0x4, 1, encodeBlock()}}, 0x3, 1, ErrCodeProtocol},
+		{"RST_STREAM on idle stream", []frame{{0x3, 0x0, 7, []byte{0, 0, 0, 8}}}, 0x7, 0, ErrCodeProtocol},
+		{"RST_STREAM of wrong size", []frame{post(1), {0x3, 0x0, 1, []byte{0, 8}}}, 0x7, 0, ErrCodeFrameSize},
+		{"HEADERS on stream 0", []frame{get(0)}, 0x7, 0, ErrCodeProtocol},
+		{"padding longer than the frame", []frame{post(1), {0x0, 0x9, 1, []byte{3, 'h', 'i'}}}, 0x7, 0, ErrCodeProtocol},
+		{"stream depends on itself", []frame{{0x1, 0x25, 3, append([]byte{0, 0, 0, 3, 15}, encodeBlock(getRequest...)...)}}, 0x3, 3, ErrCodeProtocol},
+		{"PRIORITY of wrong size", []frame{post(1), {0x2, 0x0, 1, []byte{0, 0, 0, 0}}}, 0x3, 1, ErrCodeFrameSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var out bytes.Buffer
+			out.WriteString(clientPreface)
+			sendFrameTo(&out, 0x4, 0x0, 0, nil)
+			for _, f := range tt.frames {
+				sendFrameTo(&out, f.frameType, f.flags, f.streamID, f.payload)
+			}
+			conn.Write(out.Bytes())
+
+			payload := waitFor(t, conn, tt.wantType, tt.wantID)
+			codeAt := 0
+			if tt.wantType == 0x7 {
+				codeAt = 4 // GOAWAY starts with the last stream ID
+			}
+			if got := ErrCode(binary.BigEndian.Uint32(payload[codeAt:])); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	body := bytes.Repeat([]byte("f"), 100000)
+	addr := startServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, false)
+		w.WriteData(body, true)
+	})})
+	windowUpdate := func(increment uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, increment)
+	}
+
+	t.Run("writer waits for the window", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, nil)
+		sendFrameTo(&out, 0x1, 0x5, 1, encodeBlock(getRequest...))
+		conn.Write(out.Bytes())
+
+		// The initial windows let 65535 bytes through and no more
+		var got int
+		for got < initialConnWindow {
+			frameType, _, id, payload, err := readTestFrame(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType == 0x0 && id == 1 {
+				got += len(payload)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		for {
+			frameType, _, _, _, err := readTestFrame(conn)
+			if err != nil {
+				break
+			}
+			if frameType == 0x0 {
+				t.Fatal("DATA sent beyond the window")
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		sendFrameTo(conn, 0x8, 0x0, 0, windowUpdate(uint32(len(body))))
+		sendFrameTo(conn, 0x8, 0x0, 1, windowUpdate(uint32(len(body))))
+		for {
+			frameType, flags, id, payload, err := readTestFrame(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType != 0x0 || id != 1 {
+				continue
+			}
+			got += len(payload)
+			if flags&0x1 != 0 {
+				break
+			}
+		}
+		if got != len(body) {
+			t.Errorf("got %d bytes, want %d", got, len(body))
+		}
+	})
+
+	tests := []struct {
+		name     string
+		streamID int
+		update   []byte
+		// wantType is RST_STREAM (0x3) or GOAWAY (0x7)
+		wantType byte
+		wantCode ErrCode
+	}{
+		{"zero increment on the connection", 0, windowUpdate(0), 0x7, ErrCodeProtocol},
+		{"zero increment on a stream", 1, windowUpdate(0), 0x3, ErrCodeProtocol},
+		{"connection window overflow", 0, windowUpdate(maxWindowSize), 0x7, ErrCodeFlowControl},
+		{"stream window overflow", 1, windowUpdate(maxWindowSize), 0x3, ErrCodeFlowControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var out bytes.Buffer
+			out.WriteString(clientPreface)
+			sendFrameTo(&out, 0x4, 0x0, 0, nil)
+			// Stream 1 stays open, waiting for window to send its body
+			sendFrameTo(&out, 0x1, 0x5, 1, encodeBlock(getRequest...))
+			sendFrameTo(&out, 0x8, 0x0, tt.streamID, tt.update)
+			conn.Write(out.Bytes())
+
+			payload := waitFor(t, conn, tt.wantType, tt.streamID)
+			codeAt := 0
+			if tt.wantType == 0x7 {
+				codeAt = 4
+			}
+			if got := ErrCode(binary.BigEndian.Uint32(payload[codeAt:])); got != tt.wantCode {
+				t.Errorf("got %s, want %s", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestContinuation(t *testing.T) {
+	big := strings.Repeat("c", 40000)
+	addr := startServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteHeaders([]hpack.HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "x-cookie", Value: r.Header("cookie")},
+		}, true)
+	})})
+
+	dial := func(t *testing.T) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	request := encodeBlock(append(getRequest, hpack.HeaderField{Name: "cookie", Value: big})...)
+
+	t.Run("reassembled both ways", func(t *testing.T) {
+		conn := dial(t)
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, nil)
+		sendFrameTo(&out, 0x1, 0x1, 1, request[:10000])
+		sendFrameTo(&out, 0x9, 0x0, 1, request[10000:20000])
+		sendFrameTo(&out, 0x9, 0x4, 1, request[20000:])
+		conn.Write(out.Bytes())
+
+		var block []byte
+		for {
+			frameType, flags, streamID, payload, err := readTestFrame(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if streamID != 1 {
+				continue
+			}
+			if frameType != 0x1 && frameType != 0x9 {
+				t.Fatalf("frame type 0x%x inside the response header block", frameType)
+			}
+			if len(payload) > 16384 {
+				t.Fatalf("%d byte frame exceeds the default MAX_FRAME_SIZE", len(payload))
+			}
+			block = append(block, payload...)
+			if flags&0x4 != 0 {
+				break
+			}
+		}
+		headers, err := hpack.NewDecoder(4096).DecodeFull(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) != 2 || headers[1].Value != big {
+			t.Errorf("cookie did not survive the round trip: %d headers", len(headers))
+		}
+	})
+
+	t.Run("interleaved frame", func(t *testing.T) {
+		conn := dial(t)
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, nil)
+		sendFrameTo(&out, 0x1, 0x1, 1, request[:10000])
+		sendFrameTo(&out, 0x6, 0x0, 0, make([]byte, 8))
+		conn.Write(out.Bytes())
+
+		payload := waitFor(t, conn, 0x7, 0)
+		if got := ErrCode(binary.BigEndian.Uint32(payload[4:])); got != ErrCodeProtocol {
+			t.Errorf("got %s, want %s", got, ErrCodeProtocol)
+		}
+	})
+}
+
+// The HPACK tables live as long as the connection, so later header blocks
+// may refer to fields indexed by earlier ones.
+// https://datatracker.ietf.org/doc/html/rfc7541#section-2.3.2
+func TestConnectionHPACK(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.WriteHeaders([]hpack.HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "x-token", Value: r.Header("x-token")},
+		}, true)
+	})})
+	request := append(slices.Clone(getRequest), hpack.HeaderField{Name: "x-token", Value: "secret"})
+	dial := func(t *testing.T, settings []byte) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte(clientPreface))
+		sendFrameTo(conn, 0x4, 0x0, 0, settings)
+		return conn
+	}
+	checkToken := func(t *testing.T, blocks [][]hpack.HeaderField) {
+		t.Helper()
+		if len(blocks) != 1 || !slices.Contains(blocks[0], hpack.HeaderField{Name: "x-token", Value: "secret"}) {
+			t.Errorf("got headers %v", blocks)
+		}
+	}
+
+	t.Run("indexed fields from an earlier request", func(t *testing.T) {
+		conn := dial(t, nil)
+		var block bytes.Buffer
+		enc := hpack.NewEncoder(&block)
+		dec := hpack.NewDecoder(4096)
+		for id := 1; id <= 3; id += 2 {
+			block.Reset()
+			for _, f := range request {
+				enc.WriteField(f)
+			}
+			if id == 3 && block.Len() >= len(encodeBlock(request...)) {
+				t.Fatal("second request does not use the dynamic table")
+			}
+			sendFrameTo(conn, 0x1, 0x5, id, block.Bytes())
+			blocks, _ := readResponse(t, conn, dec, id)
+			checkToken(t, blocks)
+		}
+	})
+
+	t.Run("dynamic table size update", func(t *testing.T) {
+		conn := dial(t, nil)
+		var block bytes.Buffer
+		enc := hpack.NewEncoder(&block)
+		dec := hpack.NewDecoder(4096)
+		for id := 1; id <= 5; id += 2 {
+			block.Reset()
+			if id == 3 {
+				enc.SetMaxDynamicTableSize(0)
+			}
+			for _, f := range request {
+				enc.WriteField(f)
+			}
+			sendFrameTo(conn, 0x1, 0x5, id, block.Bytes())
+			blocks, _ := readResponse(t, conn, dec, id)
+			checkToken(t, blocks)
+		}
+	})
+
+	t.Run("responses follow the client HEADER_TABLE_SIZE", func(t *testing.T) {
+		conn := dial(t, frame.AppendSettings(nil, []frame.Setting{{ID: SettingHeaderTableSize, Val: 0}}))
+		// A decoder without a dynamic table fails on any indexed entry
+		dec := hpack.NewDecoder(0)
+		for id := 1; id <= 3; id += 2 {
+			sendFrameTo(conn, 0x1, 0x5, id, encodeBlock(request...))
+			blocks, _ := readResponse(t, conn, dec, id)
+			checkToken(t, blocks)
+		}
+	})
+
+	t.Run("size update above HEADER_TABLE_SIZE", func(t *testing.T) {
+		conn := dial(t, nil)
+		// Dynamic table size update to 8192, more than the 4096 allowed
+		block := append([]byte{0x3f, 0xe1, 0x3f}, encodeBlock(getRequest...)...)
+		sendFrameTo(conn, 0x1, 0x5, 1, block)
+		payload := waitFor(t, conn, 0x7, 0)
+		if got := ErrCode(binary.BigEndian.Uint32(payload[4:])); got != ErrCodeCompression {
+			t.Errorf("got %s, want %s", got, ErrCodeCompression)
+		}
+	})
+}
+
+func TestPaddingAndPriority(t *testing.T) {
+	addr := startServer(t, &Server{Handler: EchoHandler})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// HEADERS: Pad Length, priority fields, block, padding
+	headers := []byte{4, 0x80, 0, 0, 0, 255}
+	headers = append(headers, encodeBlock(append(getRequest[:0:0], hpack.HeaderField{Name: ":method", Value: "POST"}, getRequest[1], getRequest[2])...)...)
+	headers = append(headers, 0, 0, 0, 0)
+	// DATA: Pad Length, body, padding
+	data := append([]byte{10}, "padded"...)
+	data = append(data, make([]byte, 10)...)
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x2c, 1, headers) // PRIORITY | PADDED | END_HEADERS
+	sendFrameTo(&out, 0x2, 0x0, 1, []byte{0, 0, 0, 0, 31})
+	sendFrameTo(&out, 0x0, 0x9, 1, data) // PADDED | END_STREAM
+	conn.Write(out.Bytes())
+
+	if got := waitFor(t, conn, 0x0, 1); string(got) != "padded" {
+		t.Errorf("got body %q, want %q", got, "padded")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, false)
+		w.WriteData([]byte("done"), true)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x5, 1, encodeBlock(getRequest...))
+	conn.Write(out.Bytes())
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	payload := waitFor(t, conn, 0x7, 0)
+	lastStreamID := binary.BigEndian.Uint32(payload)
+	if code := ErrCode(binary.BigEndian.Uint32(payload[4:])); lastStreamID != 1 || code != ErrCodeNo {
+		t.Fatalf("got GOAWAY %s with last stream %d, want NO_ERROR and 1", code, lastStreamID)
+	}
+
+	// Streams opened after GOAWAY are refused
+	sendFrameTo(conn, 0x1, 0x5, 3, encodeBlock(getRequest...))
+	payload = waitFor(t, conn, 0x3, 3)
+	if code := ErrCode(binary.BigEndian.Uint32(payload)); code != ErrCodeRefusedStream {
+		t.Errorf("stream 3 got %s, want REFUSED_STREAM", code)
+	}
+
+	// The stream in flight still completes
+	close(release)
+	if body := waitFor(t, conn, 0x0, 1); string(body) != "done" {
+		t.Errorf("got body %q", body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("connection not closed cleanly: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	addr := startServer(t, &Server{ReadIdleTimeout: 50 * time.Millisecond, PingTimeout: 50 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x6, 0x0, 0, []byte("pingpong"))
+	conn.Write(out.Bytes())
+
+	for {
+		frameType, flags, _, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType == 0x6 && flags&0x1 != 0 {
+			if string(payload) != "pingpong" {
+				t.Errorf("PING ACK carries %q", payload)
+			}
+			break
+		}
+	}
+
+	// Once idle the server pings us, and gives up when we do not answer
+	payload := waitFor(t, conn, 0x6, 0)
+	if len(payload) != 8 {
+		t.Errorf("server PING has %d bytes", len(payload))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("connection not closed after the PING timeout: %v", err)
+	}
+
+	// Timeouts too short for a ticker still work
+	addr = startServer(t, &Server{ReadIdleTimeout: 3, PingTimeout: 1})
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte(clientPreface))
+	sendFrameTo(conn2, 0x4, 0x0, 0, nil)
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadAll(conn2); err != nil {
+		t.Errorf("connection not closed after a 1ns PING timeout: %v", err)
+	}
+}
+
+// readResponse collects the header blocks and body of the response on
+// streamID until END_STREAM. dec must be used for the whole connection,
+// and no other stream may be answering at the same time.
+func readResponse(t *testing.T, conn io.Reader, dec *hpack.Decoder, streamID int) (blocks [][]hpack.HeaderField, body []byte) {
+	t.Helper()
+	for {
+		frameType, flags, id, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != streamID {
+			continue
+		}
+		switch frameType {
+		case 0x0:
+			body = append(body, payload...)
+		case 0x1:
+			fields, err := dec.DecodeFull(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, fields)
+		case 0x3:
+			t.Fatalf("stream %d reset", streamID)
+		}
+		if flags&0x1 != 0 {
+			return blocks, body
+		}
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum,, X-Alpha,")
+		w.Header().Set("Connection", "close") // must not be sent
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s %s cookie=%q", r.Proto, r.Host, r.PathValue("id"), body, r.Header.Get("Cookie"))
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set("X-Alpha", "a")
+		w.Header().Set(http.TrailerPrefix+"X-Beta", "b")
+	})
+	addr := startServer(t, &Server{Handler: HTTPHandler(mux)})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x4, 1, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "POST"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":authority", Value: "example.com"},
+		hpack.HeaderField{Name: ":path", Value: "/items/42"},
+		hpack.HeaderField{Name: "cookie", Value: "a=1"},
+		hpack.HeaderField{Name: "cookie", Value: "b=2"},
+	))
+	sendFrameTo(&out, 0x0, 0x1, 1, []byte("hello"))
+	conn.Write(out.Bytes())
+
+	dec := hpack.NewDecoder(4096)
+	blocks, body := readResponse(t, conn, dec, 1)
+	if len(blocks) != 2 {
+		t.Fatalf("got %d header blocks, want headers and trailers", len(blocks))
+	}
+	headers := make(map[string]string)
+	for _, hf := range blocks[0] {
+		headers[hf.Name] = hf.Value
+	}
+	if headers[":status"] != "201" || headers["content-type"] == "" || headers["connection"] != "" || headers["x-checksum"] != "" {
+		t.Errorf("unexpected response headers %v", blocks[0])
+	}
+	if want := `HTTP/2.0 example.com 42 hello cookie="a=1; b=2"`; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+	// Sorted, whichever way they were set
+	wantTrailers := []hpack.HeaderField{{Name: "x-alpha", Value: "a"}, {Name: "x-beta", Value: "b"}, {Name: "x-checksum", Value: "abc"}}
+	if !slices.Equal(blocks[1], wantTrailers) {
+		t.Errorf("got trailers %v, want %v", blocks[1], wantTrailers)
+	}
+
+	// A regular field before a pseudo-header is malformed
+	sendFrameTo(conn, 0x1, 0x5, 3, encodeBlock(
+		hpack.HeaderField{Name: "accept", Value: "*/*"},
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+	))
+	blocks, _ = readResponse(t, conn, dec, 3)
+	if status := blocks[0][0].Value; status != "400" {
+		t.Errorf("malformed request got status %s, want 400", status)
+	}
+}
+
+// Responses that cannot have a body: 1xx, 204 and 304, and the response
+// to a HEAD.
+// https://datatracker.ietf.org/doc/html/rfc9110#section-6.4.1
+func TestHTTPHandlerNoBody(t *testing.T) {
+	writeErrs := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.PathValue("code"))
+		w.WriteHeader(code)
+		_, err := w.Write([]byte("hello"))
+		writeErrs <- err
+	})
+	mux.HandleFunc("/length", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		_, err := w.Write([]byte("hello"))
+		writeErrs <- err
+	})
+	addr := startServer(t, &Server{Handler: HTTPHandler(mux)})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(clientPreface))
+	sendFrameTo(conn, 0x4, 0x0, 0, nil)
+
+	tests := []struct {
+		method, path string
+		// wantLength is the content-length header, "" if there is none
+		wantLength string
+		wantBody   string
+		wantErr    error
+	}{
+		{"GET", "/status/200", "5", "hello", nil},
+		{"GET", "/status/204", "", "", http.ErrBodyNotAllowed},
+		{"GET", "/status/304", "", "", http.ErrBodyNotAllowed},
+		{"HEAD", "/status/200", "", "", nil},
+		{"HEAD", "/length", "5", "", nil},
+	}
+	dec := hpack.NewDecoder(4096)
+	for i, tt := range tests {
+		id := 2*i + 1
+		sendFrameTo(conn, 0x1, 0x5, id, encodeBlock(
+			hpack.HeaderField{Name: ":method", Value: tt.method},
+			hpack.HeaderField{Name: ":path", Value: tt.path},
+			hpack.HeaderField{Name: ":scheme", Value: "http"},
+		))
+		blocks, body := readResponse(t, conn, dec, id)
+		var length string
+		for _, hf := range blocks[0] {
+			if hf.Name == "content-length" {
+				length = hf.Value
+			}
+		}
+		if length != tt.wantLength || string(body) != tt.wantBody {
+			t.Errorf("%s %s: got content-length %q and body %q, want %q and %q", tt.method, tt.path, length, body, tt.wantLength, tt.wantBody)
+		}
+		if err := <-writeErrs; err != tt.wantErr {
+			t.Errorf("%s %s: Write returned %v, want %v", tt.method, tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	settings := DefaultSettings()
+	settings.EnablePush = false
+	settings.MaxConcurrentStreams = 2
+	addr := startServer(t, &Server{Settings: &settings, Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Header(":path") == "/slow" {
+			<-release
+		}
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, true)
+	})})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := func(path string) []byte {
+		return encodeBlock(
+			hpack.HeaderField{Name: ":method", Value: "GET"},
+			hpack.HeaderField{Name: ":scheme", Value: "http"},
+			hpack.HeaderField{Name: ":path", Value: path},
+		)
+	}
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x5, 1, request("/slow"))
+	sendFrameTo(&out, 0x1, 0x5, 3, request("/fast"))
+	conn.Write(out.Bytes())
+
+	// Stream 3 is answered while stream 1's handler is still running
+	readResponse(t, conn, hpack.NewDecoder(4096), 3)
+
+	// Streams 1 and 5 use up both slots, so 7 is refused
+	out.Reset()
+	sendFrameTo(&out, 0x1, 0x5, 5, request("/slow"))
+	sendFrameTo(&out, 0x1, 0x5, 7, request("/fast"))
+	conn.Write(out.Bytes())
+	payload := waitFor(t, conn, 0x3, 7)
+	if code := ErrCode(binary.BigEndian.Uint32(payload)); code != ErrCodeRefusedStream {
+		t.Errorf("stream 7 got %s, want REFUSED_STREAM", code)
+	}
+
+	close(release)
+	ended := map[int]bool{}
+	for !ended[1] || !ended[5] {
+		_, flags, streamID, _, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&0x1 != 0 {
+			ended[streamID] = true
+		}
+	}
+}
+
+func TestWriteSchedulers(t *testing.T) {
+	type push struct {
+		streamID int
+		name     string
+		priority Priority
+	}
+	incremental := Priority{Urgency: 3, Incremental: true}
+	tests := []struct {
+		name   string
+		sched  WriteScheduler
+		pushes []push
+		want   string
+	}{
+		{"round robin", NewRoundRobinScheduler(), []push{
+			{1, "a", DefaultPriority}, {1, "b", DefaultPriority}, {1, "c", DefaultPriority},
+			{3, "x", DefaultPriority}, {3, "y", DefaultPriority},
+			{0, "P", DefaultPriority},
+		}, "Paxbyc"},
+		{"RFC 9218 priorities", NewPriorityScheduler(), []push{
+			{1, "a", DefaultPriority}, {1, "b", DefaultPriority},
+			{5, "m", incremental}, {5, "n", incremental},
+			{7, "q", incremental}, {7, "r", incremental},
+			{3, "x", Priority{Urgency: 1}},
+			{0, "P", DefaultPriority},
+		}, "Pxabmqnr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			for _, p := range tt.pushes {
+				tt.sched.Push(FrameWrite{streamID: p.streamID, priority: p.priority, write: func(*frame.Framer) error {
+					got.WriteString(p.name)
+					return nil
+				}})
+			}
+			for {
+				fw, ok := tt.sched.Pop()
+				if !ok {
+					break
+				}
+				fw.write(nil)
+			}
+			if got.String() != tt.want {
+				t.Errorf("wrote %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensiblePriorities(t *testing.T) {
+	for value, want := range map[string]Priority{
+		"":               DefaultPriority,
+		"u=0":            {Urgency: 0},
+		"u=5, i":         {Urgency: 5, Incremental: true},
+		"i=?1,u=1":       {Urgency: 1, Incremental: true},
+		"u=9, i=?0, x=1": DefaultPriority,
+	} {
+		if got := parsePriorityField(value); got != want {
+			t.Errorf("parsePriorityField(%q) = %s, want %s", value, got, want)
+		}
+	}
+
+	// Every handler waits for the others, so all responses compete
+	const streams = 6
+	var started sync.WaitGroup
+	started.Add(streams)
+	body := bytes.Repeat([]byte("x"), 256<<10)
+	srv := &Server{NewWriteScheduler: NewPriorityScheduler, Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		started.Done()
+		started.Wait()
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, false)
+		w.WriteData(body, true)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go srv.Serve(smallBufferListener{ln})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	// Enough window for every body at once
+	sendFrameTo(&out, 0x4, 0x0, 0, binary.BigEndian.AppendUint32([]byte{0x0, 0x4}, 1<<30))
+	sendFrameTo(&out, 0x8, 0x0, 0, binary.BigEndian.AppendUint32(nil, 1<<30))
+	incremental := append(getRequest, hpack.HeaderField{Name: "priority", Value: "i"})
+	for _, id := range []int{1, 3, 5, 7} {
+		sendFrameTo(&out, 0x1, 0x5, id, encodeBlock(incremental...))
+	}
+	sendFrameTo(&out, 0x1, 0x5, 9, encodeBlock(append(getRequest, hpack.HeaderField{Name: "priority", Value: "u=0"})...))
+	// A PRIORITY_UPDATE may come before the stream opens
+	sendFrameTo(&out, 0x10, 0x0, 0, append(binary.BigEndian.AppendUint32(nil, 11), "u=1"...))
+	sendFrameTo(&out, 0x1, 0x5, 11, encodeBlock(getRequest...))
+	conn.Write(out.Bytes())
+
+	// Fall behind, so that frames pile up in the scheduler and it has to
+	// choose
+	time.Sleep(100 * time.Millisecond)
+	var order []int
+	for len(order) < streams {
+		_, flags, streamID, _, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&0x1 != 0 && streamID != 0 {
+			order = append(order, streamID)
+		}
+	}
+	if !(order[0] == 9 && order[1] == 11 || order[0] == 11 && order[1] == 9) {
+		t.Errorf("streams ended in order %v, want the urgent 9 and 11 first", order)
+	}
+
+	// PRIORITY_UPDATE belongs to the connection
+	sendFrameTo(conn, 0x10, 0x0, 1, append(binary.BigEndian.AppendUint32(nil, 1), "u=0"...))
+	payload := waitFor(t, conn, 0x7, 0)
+	if code := ErrCode(binary.BigEndian.Uint32(payload[4:])); code != ErrCodeProtocol {
+		t.Errorf("PRIORITY_UPDATE on stream 1 got %s, want PROTOCOL_ERROR", code)
+	}
+}
+
+// smallBufferListener shrinks the send buffer of accepted connections, so
+// a slow reader soon blocks the server's writer.
+type smallBufferListener struct {
+	net.Listener
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		conn.(*net.TCPConn).SetWriteBuffer(16 << 10)
+	}
+	return conn, err
+}
+
+func TestTLS(t *testing.T) {
+	cert, err := h2tls.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s tls=%v", r.Proto, r.TLS != nil)
+	})
+	srv := &Server{
+		Handler: HTTPHandler(mux),
+		// CBC is allowed by the server only so that the check after the
+		// handshake has something to reject
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { ln.Close() })
+	addr := ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := c.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0 tls=true" {
+		t.Errorf("got %s %q", resp.Proto, body)
+	}
+
+	t.Run("HTTP/1.1", func(t *testing.T) {
+		// Without "h2" in ALPN the client gets HTTP/1.1
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		resp, err := c.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 1 || string(body) != "HTTP/1.1 tls=true" {
+			t.Errorf("got %s %q", resp.Proto, body)
+		}
+	})
+
+	t.Run("blocked cipher suite", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      roots,
+			NextProtos:   []string{h2tls.NextProto},
+			MaxVersion:   tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, err := frame.NewFramer(nil, conn).ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ga, ok := f.(*frame.GoAwayFrame); !ok || ga.ErrCode != frame.ErrCodeInadequateSecurity {
+			t.Errorf("got %v, want GOAWAY INADEQUATE_SECURITY", f)
+		}
+	})
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %q upgrade=%q", r.Proto, r.Method, r.URL.Path, body, r.Header.Get("Upgrade"))
+	}))})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// INITIAL_WINDOW_SIZE = 8 only comes in HTTP2-Settings, so the
+	// response needs WINDOW_UPDATEs if the server applied it
+	fmt.Fprint(conn, "POST /up HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAQAAAAI\r\nContent-Length: 5\r\n\r\nhello")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("got %s, Upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	conn.Write(out.Bytes())
+	frameType, flags, _, _, err := readTestFrame(br)
+	if err != nil || frameType != 0x4 || flags != 0 {
+		t.Fatalf("first frame after 101 is type %d flags %d (%v), want SETTINGS", frameType, flags, err)
+	}
+
+	// The request is answered on stream 1
+	dec := hpack.NewDecoder(4096)
+	var body []byte
+	for ended := false; !ended; {
+		frameType, flags, id, payload, err := readTestFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case frameType == 0x1:
+			if _, err := dec.DecodeFull(payload); err != nil {
+				t.Fatal(err)
+			}
+		case frameType == 0x0 && id == 1:
+			if len(payload) > 8 {
+				t.Fatalf("DATA of %d bytes exceeds the upgraded window of 8", len(payload))
+			}
+			body = append(body, payload...)
+			ended = flags&0x1 != 0
+			if len(payload) > 0 {
+				sendFrameTo(conn, 0x8, 0x0, 0, binary.BigEndian.AppendUint32(nil, uint32(len(payload))))
+				sendFrameTo(conn, 0x8, 0x0, 1, binary.BigEndian.AppendUint32(nil, uint32(len(payload))))
+			}
+		}
+	}
+	if want := `HTTP/2.0 POST /up "hello" upgrade=""`; string(body) != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	// Stream 1 is used up, the next request opens stream 3
+	sendFrameTo(conn, 0x1, 0x5, 3, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":authority", Value: "example.com"},
+		hpack.HeaderField{Name: ":path", Value: "/next"},
+	))
+	sendFrameTo(conn, 0x4, 0x0, 0, binary.BigEndian.AppendUint32([]byte{0x0, 0x4}, 65535))
+	if _, body := readResponse(t, br, dec, 3); string(body) != `HTTP/2.0 GET /next "" upgrade=""` {
+		t.Errorf("stream 3 got %q", body)
+	}
+
+	// A body too large to buffer keeps the request on HTTP/1.1, or gets
+	// 413 once it turns out too large
+	big := strings.Repeat("b", 65536)
+	for _, tt := range []struct {
+		framing string
+		status  int
+	}{
+		{"Content-Length: 65536\r\n\r\n" + big, http.StatusOK},
+		{"Transfer-Encoding: chunked\r\n\r\n10000\r\n" + big + "\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprint(c, "POST /big HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\nHTTP2-Settings: AAQAAAAI\r\n"+tt.framing)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("got %s, want %d", resp.Status, tt.status)
+		}
+	}
+
+	// A broken HTTP2-Settings keeps the request on HTTP/1.1
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	fmt.Fprint(conn2, "GET /stay HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAQ\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != `HTTP/1.1 GET /stay "" upgrade=""` {
+		t.Errorf("got %s %q", resp.Status, body)
+	}
+}
+
+func TestHTTP1Fallback(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %q", r.Proto, r.Method, body)
+	})
+	mux.HandleFunc("/inject", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["X-Note"] = []string{"a\r\nX-Injected: yes"}
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		for i := range 3 {
+			fmt.Fprintf(w, "part %d;", i)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc")
+	})
+	addr := startServer(t, &Server{Handler: HTTPHandler(mux)})
+
+	// Keep-alive, chunked responses with trailers, both through net/http
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	c := &http.Client{Transport: tr}
+	var conns atomic.Int32
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		ConnectStart: func(string, string) { conns.Add(1) },
+	})
+	for _, tt := range []struct{ path, body, want string }{
+		{"/", "hello", `HTTP/1.1 POST "hello"`},
+		{"/stream", "", "part 0;part 1;part 2;"},
+		{"/", "again", `HTTP/1.1 POST "again"`},
+	} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+tt.path, strings.NewReader(tt.body))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 1 || string(body) != tt.want {
+			t.Errorf("%s: got %s %q, want %q", tt.path, resp.Proto, body, tt.want)
+		}
+		if tt.path == "/stream" && (resp.Trailer.Get("X-Checksum") != "abc" || len(resp.TransferEncoding) == 0) {
+			t.Errorf("%s: trailers %v, transfer encoding %v", tt.path, resp.Trailer, resp.TransferEncoding)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+
+	// HTTP/1.0 gets its answer and the connection is closed
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET / HTTP/1.0\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.HasPrefix(got, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.Contains(got, []byte("Connection: close\r\n")) || !bytes.HasSuffix(got, []byte(`HTTP/1.0 GET ""`)) {
+		t.Errorf("HTTP/1.0 got %q, %v", got, err)
+	}
+
+	// A CR or LF from the handler cannot split the response
+	resp, err := c.Get("http://" + addr + "/inject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Injected") != "" || resp.Header.Get("X-Note") != "a  X-Injected: yes" {
+		t.Errorf("injected header: %v", resp.Header)
+	}
+
+	// A header section over 1 MB gets 431
+	conn3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+	go fmt.Fprintf(conn3, "GET / HTTP/1.1\r\nHost: example.com\r\nX-Big: %s\r\n\r\n", strings.Repeat("b", 1<<20+8192))
+	conn3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := io.ReadAll(conn3); !bytes.HasPrefix(got, []byte("HTTP/1.1 431 ")) {
+		t.Errorf("big header section got %q", got)
+	}
+
+	// Something that is neither HTTP/2 nor HTTP/1.x
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	fmt.Fprint(conn2, "garbage\r\n\r\n")
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, _ := io.ReadAll(conn2); !bytes.HasPrefix(got, []byte("HTTP/1.1 400 ")) {
+		t.Errorf("garbage got %q", got)
+	}
+}
+
+func TestPush(t *testing.T) {
+	pushErr := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		err := w.(http.Pusher).Push("/style.css", &http.PushOptions{Header: http.Header{"Accept": {"text/css"}}})
+		pushErr <- err
+		fmt.Fprint(w, "page")
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
+		// A push cannot push in turn
+		if err := w.(http.Pusher).Push("/other", nil); err != http.ErrNotSupported {
+			t.Errorf("push from a pushed stream: %v", err)
+		}
+		fmt.Fprintf(w, "css for %s %s accept=%s", r.Method, r.Host, r.Header.Get("Accept"))
+	})
+	addr := startServer(t, &Server{Handler: HTTPHandler(mux)})
+
+	request := func(settings []byte) (net.Conn, *hpack.Decoder) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, settings)
+		sendFrameTo(&out, 0x1, 0x5, 1, encodeBlock(
+			hpack.HeaderField{Name: ":method", Value: "GET"},
+			hpack.HeaderField{Name: ":scheme", Value: "http"},
+			hpack.HeaderField{Name: ":authority", Value: "example.com"},
+			hpack.HeaderField{Name: ":path", Value: "/page"},
+		))
+		conn.Write(out.Bytes())
+		return conn, hpack.NewDecoder(4096)
+	}
+
+	// Push is on by default
+	conn, dec := request(nil)
+	bodies := make(map[int]string)
+	var promised []hpack.HeaderField
+	for ended := 0; ended < 2; {
+		frameType, flags, id, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frameType {
+		case 0x5:
+			if id != 1 || flags&0x4 == 0 {
+				t.Fatalf("PUSH_PROMISE on stream %d flags %d", id, flags)
+			}
+			if got := binary.BigEndian.Uint32(payload); got != 2 {
+				t.Errorf("promised stream %d, want 2", got)
+			}
+			if promised, err = dec.DecodeFull(payload[4:]); err != nil {
+				t.Fatal(err)
+			}
+			if bodies[1] != "" {
+				t.Error("PUSH_PROMISE after the parent's DATA")
+			}
+		case 0x1:
+			if _, err := dec.DecodeFull(payload); err != nil {
+				t.Fatal(err)
+			}
+			if id == 2 && promised == nil {
+				t.Error("pushed HEADERS before the PUSH_PROMISE")
+			}
+		case 0x0:
+			bodies[id] += string(payload)
+		case 0x3:
+			t.Fatalf("stream %d reset", id)
+		}
+		if flags&0x1 != 0 && (frameType == 0x0 || frameType == 0x1) {
+			ended++
+		}
+	}
+	if err := <-pushErr; err != nil {
+		t.Fatal(err)
+	}
+	want := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/style.css"}, {Name: "accept", Value: "text/css"},
+	}
+	if !slices.Equal(promised, want) {
+		t.Errorf("promised %v, want %v", promised, want)
+	}
+	if bodies[1] != "page" || bodies[2] != "css for GET example.com accept=text/css" {
+		t.Errorf("got bodies %q", bodies)
+	}
+
+	// The pushed stream took no handler slot from the client's streams,
+	// so once its handler has returned new requests are still served. A
+	// late PRIORITY_UPDATE for the finished push is no error either.
+	time.Sleep(50 * time.Millisecond)
+	sendFrameTo(conn, 0x10, 0x0, 0, append(binary.BigEndian.AppendUint32(nil, 2), "u=1"...))
+	sendFrameTo(conn, 0x1, 0x5, 3, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":authority", Value: "example.com"},
+		hpack.HeaderField{Name: ":path", Value: "/missing"},
+	))
+	if blocks, _ := readResponse(t, conn, dec, 3); blocks[0][0].Value != "404" {
+		t.Errorf("got %v after a push", blocks[0])
+	}
+	// But a push stream that was never promised is
+	sendFrameTo(conn, 0x10, 0x0, 0, append(binary.BigEndian.AppendUint32(nil, 4), "u=1"...))
+	if code := ErrCode(binary.BigEndian.Uint32(waitFor(t, conn, 0x7, 0)[4:])); code != ErrCodeProtocol {
+		t.Errorf("PRIORITY_UPDATE for idle push stream 4 got %s, want PROTOCOL_ERROR", code)
+	}
+
+	// SETTINGS_ENABLE_PUSH = 0
+	conn, dec = request([]byte{0x0, 0x2, 0, 0, 0, 0})
+	if err := <-pushErr; err != http.ErrNotSupported {
+		t.Errorf("push with ENABLE_PUSH=0: %v", err)
+	}
+	if blocks, body := readResponse(t, conn, dec, 1); string(body) != "page" || len(blocks) != 1 {
+		t.Errorf("got %d blocks, body %q", len(blocks), body)
+	}
+}
+
+func TestRequestTrailers(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", body, r.Trailer)
+	}))})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := func(streamID int, trailers ...hpack.HeaderField) {
+		var out bytes.Buffer
+		sendFrameTo(&out, 0x1, 0x4, streamID, encodeBlock(
+			hpack.HeaderField{Name: ":method", Value: "POST"},
+			hpack.HeaderField{Name: ":scheme", Value: "http"},
+			hpack.HeaderField{Name: ":authority", Value: "example.com"},
+			hpack.HeaderField{Name: ":path", Value: "/"},
+			hpack.HeaderField{Name: "trailer", Value: "X-Sum, X-Missing"},
+		))
+		sendFrameTo(&out, 0x0, 0x0, streamID, []byte("body"))
+		sendFrameTo(&out, 0x1, 0x5, streamID, encodeBlock(trailers...))
+		conn.Write(out.Bytes())
+	}
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	conn.Write(out.Bytes())
+
+	dec := hpack.NewDecoder(4096)
+	request(1, hpack.HeaderField{Name: "x-sum", Value: "4"})
+	if _, body := readResponse(t, conn, dec, 1); string(body) != "body map[X-Missing:[] X-Sum:[4]]" {
+		t.Errorf("got %q", body)
+	}
+
+	// Pseudo-headers have no place in trailers
+	request(3, hpack.HeaderField{Name: ":path", Value: "/"})
+	for {
+		frameType, _, id, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType == 0x3 && id == 3 {
+			if code := ErrCode(binary.BigEndian.Uint32(payload)); code != ErrCodeProtocol {
+				t.Errorf("got RST_STREAM %s, want PROTOCOL_ERROR", code)
+			}
+			break
+		}
+	}
+
+	// HTTP/1.1 trailers come at the end of a chunked body
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	fmt.Fprint(conn2, "POST / HTTP/1.1\r\nHost: example.com\r\nTrailer: X-Sum\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"4\r\nbody\r\n0\r\nX-Sum: 4\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "body map[X-Sum:[4]]" {
+		t.Errorf("HTTP/1.1 got %q", body)
+	}
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	addr := startServer(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Header(":path") == "/ignore" {
+			// Answer without reading the body at all
+			w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "200"}}, true)
+			return
+		}
+		EchoHandler.ServeHTTP2(w, r)
+	})})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x4, 1, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "POST"},
+		hpack.HeaderField{Name: ":path", Value: "/"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+	))
+	sendFrameTo(&out, 0x0, 0x0, 1, []byte("ping"))
+	conn.Write(out.Bytes())
+
+	// The echo comes back while the request is still open
+	if got := waitFor(t, conn, 0x0, 1); string(got) != "ping" {
+		t.Fatalf("got %q before END_STREAM, want ping", got)
+	}
+	sendFrameTo(conn, 0x0, 0x1, 1, []byte("pong"))
+	var body []byte
+	for {
+		frameType, flags, id, payload, err := readTestFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType == 0x0 && id == 1 {
+			body = append(body, payload...)
+			if flags&0x1 != 0 {
+				break
+			}
+		}
+	}
+	if string(body) != "pong" {
+		t.Errorf("got %q after END_STREAM, want pong", body)
+	}
+
+	// A complete response to a request that is still being sent tells the
+	// client to stop with RST_STREAM NO_ERROR
+	sendFrameTo(conn, 0x1, 0x4, 3, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "POST"},
+		hpack.HeaderField{Name: ":path", Value: "/ignore"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+	))
+	if code := ErrCode(binary.BigEndian.Uint32(waitFor(t, conn, 0x3, 3))); code != ErrCodeNo {
+		t.Errorf("got RST_STREAM %s, want NO_ERROR", code)
+	}
+}
+
+func TestFloods(t *testing.T) {
+	request := encodeBlock(getRequest...)
+	smallHeaders := DefaultSettings()
+	smallHeaders.MaxHeaderListSize = 100
+	tests := []struct {
+		name     string
+		limits   Limits
+		settings *Settings
+		send     func(w io.Writer)
+		want     Abuse
+	}{
+		{"rapid reset", Limits{ResetsPerSecond: 5}, nil, func(w io.Writer) {
+			for id := 1; id <= 11; id += 2 {
+				sendFrameTo(w, 0x1, 0x5, id, request)
+				sendFrameTo(w, 0x3, 0x0, id, []byte{0, 0, 0, 0x8})
+			}
+		}, AbuseRapidReset},
+		{"stream errors", Limits{StreamErrorsPerSecond: 5}, nil, func(w io.Writer) {
+			for id := 1; id <= 11; id += 2 {
+				sendFrameTo(w, 0x1, 0x5, id, request)
+				sendFrameTo(w, 0x0, 0x0, id, []byte("after END_STREAM"))
+			}
+		}, AbuseStreamErrors},
+		{"SETTINGS", Limits{SettingsPerSecond: 5}, nil, func(w io.Writer) {
+			for range 5 {
+				sendFrameTo(w, 0x4, 0x0, 0, nil)
+			}
+		}, AbuseSettingsFlood},
+		{"PING", Limits{PingsPerSecond: 5}, nil, func(w io.Writer) {
+			for range 6 {
+				sendFrameTo(w, 0x6, 0x0, 0, make([]byte, 8))
+			}
+		}, AbusePingFlood},
+		{"empty DATA", Limits{EmptyDataPerSecond: 5}, nil, func(w io.Writer) {
+			sendFrameTo(w, 0x1, 0x4, 1, request)
+			for range 6 {
+				sendFrameTo(w, 0x0, 0x0, 1, nil)
+			}
+		}, AbuseEmptyDataFlood},
+		{"empty CONTINUATION", Limits{MaxContinuations: 5}, nil, func(w io.Writer) {
+			sendFrameTo(w, 0x1, 0x1, 1, request)
+			for range 6 {
+				sendFrameTo(w, 0x9, 0x0, 1, nil)
+			}
+		}, AbuseContinuationFlood},
+		{"endless header block", Limits{}, &smallHeaders, func(w io.Writer) {
+			sendFrameTo(w, 0x1, 0x1, 1, request)
+			sendFrameTo(w, 0x9, 0x0, 1, make([]byte, 200))
+		}, AbuseContinuationFlood},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{Handler: HelloHandler, Limits: &tt.limits, Settings: tt.settings}
+			conn, err := net.Dial("tcp", startServer(t, srv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var out bytes.Buffer
+			out.WriteString(clientPreface)
+			sendFrameTo(&out, 0x4, 0x0, 0, nil)
+			tt.send(&out)
+			conn.Write(out.Bytes())
+
+			payload := waitFor(t, conn, 0x7, 0)
+			if code := ErrCode(binary.BigEndian.Uint32(payload[4:])); code != ErrCodeEnhanceYourCalm {
+				t.Fatalf("got GOAWAY %s, want ENHANCE_YOUR_CALM", code)
+			}
+			if got := srv.Abuses(); len(got) != 1 || got[tt.want] != 1 {
+				t.Errorf("got abuses %v, want one %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A block of a few bytes that refers to a big table entry over and over
+// is turned down with 431 before it decodes.
+func TestHPACKBomb(t *testing.T) {
+	settings := DefaultSettings()
+	settings.MaxHeaderListSize = 64 << 10
+	addr := startServer(t, &Server{Handler: HelloHandler, Settings: &settings})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	big := hpack.HeaderField{Name: "x-big", Value: strings.Repeat("v", 1000)}
+	for _, hf := range append(getRequest, big) {
+		enc.WriteField(hf)
+	}
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x5, 1, block.Bytes())
+	conn.Write(out.Bytes())
+	dec := hpack.NewDecoder(4096)
+	if blocks, _ := readResponse(t, conn, dec, 1); blocks[0][0].Value != "200" {
+		t.Fatalf("got %v for the first request", blocks[0])
+	}
+
+	block.Reset()
+	for _, hf := range getRequest {
+		enc.WriteField(hf)
+	}
+	for range 1000 {
+		enc.WriteField(big)
+	}
+	if block.Len() > 2000 {
+		t.Fatalf("%d byte block is no bomb", block.Len())
+	}
+	sendFrameTo(conn, 0x1, 0x5, 3, block.Bytes())
+	if blocks, _ := readResponse(t, conn, dec, 3); blocks[0][0].Value != "431" {
+		t.Errorf("got %v for a 1 MB header list", blocks[0])
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(1000)
+	})
+	mux.HandleFunc("/switch", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fine")
+	})
+	addr := startServer(t, &Server{Handler: HTTPHandler(mux)})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var out bytes.Buffer
+	out.WriteString(clientPreface)
+	sendFrameTo(&out, 0x4, 0x0, 0, nil)
+	sendFrameTo(&out, 0x1, 0x5, 1, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":path", Value: "/panic"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+	))
+	conn.Write(out.Bytes())
+	if code := ErrCode(binary.BigEndian.Uint32(waitFor(t, conn, 0x3, 1))); code != ErrCodeInternal {
+		t.Errorf("got RST_STREAM %s, want INTERNAL_ERROR", code)
+	}
+
+	// The connection and the server live on
+	sendFrameTo(conn, 0x1, 0x5, 3, encodeBlock(getRequest...))
+	if _, body := readResponse(t, conn, hpack.NewDecoder(4096), 3); string(body) != "fine" {
+		t.Errorf("got %q after the panic", body)
+	}
+
+	// HTTP/2 has no 101 Switching Protocols
+	sendFrameTo(conn, 0x1, 0x5, 5, encodeBlock(
+		hpack.HeaderField{Name: ":method", Value: "GET"},
+		hpack.HeaderField{Name: ":path", Value: "/switch"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+	))
+	if code := ErrCode(binary.BigEndian.Uint32(waitFor(t, conn, 0x3, 5))); code != ErrCodeInternal {
+		t.Errorf("101 got RST_STREAM %s, want INTERNAL_ERROR", code)
+	}
+
+	// HTTP/1.x gets the connection closed
+	resp, err := http.Get("http://" + addr + "/panic")
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("got %s from a panicking handler", resp.Status)
+	}
+}
+
+// A long-lived connection does not remember every stream it ever reset.
+func TestResetStreamsBounded(t *testing.T) {
+	srv := &Server{Handler: HelloHandler, Limits: &Limits{}}
+	conn, err := net.Dial("tcp", startServer(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Each request is answered before its body, so its stream is reset
+	const last = 2*(maxResetStreams+100) - 1
+	go func() {
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, nil)
+		for id := 1; id <= last; id += 2 {
+			sendFrameTo(&out, 0x1, 0x4, id, encodeBlock(getRequest...))
+		}
+		conn.Write(out.Bytes())
+	}()
+	waitFor(t, conn, 0x3, last)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for sc := range srv.conns {
+		sc.mu.Lock()
+		n, remembered := len(sc.resetStreams), sc.resetStreams[last]
+		sc.mu.Unlock()
+		if n > maxResetStreams || !remembered {
+			t.Errorf("%d reset streams remembered, the last one %v", n, remembered)
+		}
+	}
+}
+
+// The grpc-timeout deadline ends a call even while its method is stuck
+// sending to a client that gives no window, or waiting for a request
+// message that never comes.
+func TestGRPCDeadline(t *testing.T) {
+	errs := make(chan error, 1)
+	g := &GRPCServer{}
+	g.Handle("/test.Stuck/Send", func(stream *GRPCStream) error {
+		err := stream.Send(make([]byte, 100000))
+		errs <- err
+		return err
+	})
+	g.Handle("/test.Stuck/Recv", func(stream *GRPCStream) error {
+		_, err := stream.Recv()
+		errs <- err
+		return err
+	})
+	addr := startServer(t, &Server{Handler: g})
+	call := func(t *testing.T, method string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		var out bytes.Buffer
+		out.WriteString(clientPreface)
+		sendFrameTo(&out, 0x4, 0x0, 0, nil)
+		// The request stays open
+		sendFrameTo(&out, 0x1, 0x4, 1, encodeBlock(
+			hpack.HeaderField{Name: ":method", Value: "POST"},
+			hpack.HeaderField{Name: ":path", Value: method},
+			hpack.HeaderField{Name: ":scheme", Value: "http"},
+			hpack.HeaderField{Name: "content-type", Value: "application/grpc"},
+			hpack.HeaderField{Name: "grpc-timeout", Value: "50m"},
+		))
+		conn.Write(out.Bytes())
+		return conn
+	}
+	methodErr := func(t *testing.T) error {
+		t.Helper()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("method still blocked after the deadline")
+			return nil
+		}
+	}
+
+	t.Run("blocked Send", func(t *testing.T) {
+		conn := call(t, "/test.Stuck/Send")
+		// The message is cut off, so no trailers can follow it
+		payload := waitFor(t, conn, 0x3, 1)
+		if got := ErrCode(binary.BigEndian.Uint32(payload)); got != ErrCodeCancel {
+			t.Errorf("got %s, want %s", got, ErrCodeCancel)
+		}
+		if err := methodErr(t); grpc.StatusOf(err).Code != grpc.DeadlineExceeded {
+			t.Errorf("Send got %v, want DEADLINE_EXCEEDED", err)
+		}
+	})
+
+	t.Run("blocked Recv", func(t *testing.T) {
+		conn := call(t, "/test.Stuck/Recv")
+		dec := hpack.NewDecoder(4096)
+		for {
+			frameType, flags, id, payload, err := readTestFrame(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType != 0x1 || id != 1 {
+				continue
+			}
+			fields, err := dec.DecodeFull(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(fields, hpack.HeaderField{Name: "grpc-status", Value: "4"}) || flags&0x1 == 0 {
+				t.Errorf("got %v, want DEADLINE_EXCEEDED trailers", fields)
+			}
+			break
+		}
+		// The client is told to stop sending the request
+		payload := waitFor(t, conn, 0x3, 1)
+		if got := ErrCode(binary.BigEndian.Uint32(payload)); got != ErrCodeNo {
+			t.Errorf("got %s, want %s", got, ErrCodeNo)
+		}
+		if err := methodErr(t); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Recv got %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package server
+
+import "github.com/nethish/fromscratch/http2/frame"
+
+// SettingID identifies a SETTINGS parameter.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-defined-settings
+type SettingID = frame.SettingID
+
+const (
+	SettingHeaderTableSize      = frame.SettingHeaderTableSize
+	SettingEnablePush           = frame.SettingEnablePush
+	SettingMaxConcurrentStreams = frame.SettingMaxConcurrentStreams
+	SettingInitialWindowSize    = frame.SettingInitialWindowSize
+	SettingMaxFrameSize         = frame.SettingMaxFrameSize
+	SettingMaxHeaderListSize    = frame.SettingMaxHeaderListSize
+	// SettingNoRFC7540Priorities is defined by RFC 9218.
+	SettingNoRFC7540Priorities = frame.SettingNoRFC7540Priorities
+)
+
+const maxWindowSize = frame.MaxWindowSize
+
+// Settings holds the value of every SETTINGS parameter for one side of a
+// connection.
+type Settings = frame.Settings
+
+// DefaultSettings returns the initial values every endpoint assumes until
+// its peer's SETTINGS frame says otherwise.
+func DefaultSettings() Settings {
+	return frame.DefaultSettings()
+}
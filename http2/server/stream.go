@@ -0,0 +1,429 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/hpack"
+	"github.com/nethish/fromscratch/http2/internal/pipe"
+)
+
+// Stream states
+// https://datatracker.ietf.org/doc/html/rfc9113#name-stream-states
+//
+//	                     +--------+
+//	             send PP |        | recv PP
+//	            ,--------+  idle  +--------.
+//	           /         |        |         \
+//	          v          +--------+          v
+//	   +----------+          |           +----------+
+//	   |          |          | send H /  |          |
+//	   | reserved |          | recv H    | reserved |
+//	   | (local)  |          |           | (remote) |
+//	   +---+------+          v           +------+---+
+//	       |             +--------+             |
+//	       |     recv ES |        | send ES     |
+//	send H |     ,-------+  open  +-------.     | recv H
+//	       |    /        |        |        \    |
+//	       v   v         +---+----+         v   v
+//	   +----------+          |           +----------+
+//	   |   half-  |          |           |   half-  |
+//	   |  closed  |          | send R /  |  closed  |
+//	   | (remote) |          | recv R    | (local)  |
+//	   +----+-----+          |           +-----+----+
+//	        |                |                 |
+//	        | send ES /      |       recv ES / |
+//	        | send R /       v        send R / |
+//	        | recv R     +--------+   recv R   |
+//	        `----------->|        |<-----------'
+//	                     | closed |
+//	                     |        |
+//	                     +--------+
+type streamPhase int
+
+const (
+	stateIdle streamPhase = iota
+	stateReservedLocal
+	stateOpen
+	stateHalfClosedLocal
+	stateHalfClosedRemote
+	stateClosed
+)
+
+func (p streamPhase) String() string {
+	switch p {
+	case stateIdle:
+		return "idle"
+	case stateReservedLocal:
+		return "reserved (local)"
+	case stateOpen:
+		return "open"
+	case stateHalfClosedLocal:
+		return "half-closed (local)"
+	case stateHalfClosedRemote:
+		return "half-closed (remote)"
+	}
+	return "closed"
+}
+
+type streamState struct {
+	id      int
+	headers []hpack.HeaderField
+	// body is filled by the read loop and drained by the handler; it is
+	// nil when the HEADERS frame ended the request. The bytes of an h2c
+	// upgrade request arrived before flow control began, so reading them
+	// gives no window back.
+	body     *pipe.Pipe
+	upgraded bool
+	// trailers are the fields of a HEADERS frame that ended the request
+	// after its body, guarded by serverConn.mu
+	trailers []hpack.HeaderField
+
+	// state and the priorities are guarded by serverConn.mu
+	state          streamPhase
+	legacyPriority frame.PriorityParam
+	priority       Priority
+
+	// Stream-level flow control, guarded by serverConn.mu
+	sendWindow  int64
+	recvWindow  int64
+	recvUnacked int64
+}
+
+var (
+	errStreamClosed = errors.New("stream closed")
+	// errBodyClosed is what Request.Body returns after the handler is done
+	errBodyClosed = errors.New("request body read after the handler returned")
+)
+
+// remoteOpen reports whether the client may still send DATA on the stream.
+func (s *streamState) remoteOpen() bool {
+	return s.state == stateOpen || s.state == stateHalfClosedLocal
+}
+
+// localOpen reports whether we may still send on the stream.
+func (s *streamState) localOpen() bool {
+	return s.state == stateOpen || s.state == stateHalfClosedRemote
+}
+
+// isIdle reports whether a stream the connection no longer tracks was never
+// opened. Client streams are odd and opened in increasing order; server
+// streams are even. sc.mu must be held.
+func (sc *serverConn) isIdle(id int) bool {
+	if id%2 == 1 {
+		return id > sc.maxClientStreamID
+	}
+	return id > sc.maxPushStreamID
+}
+
+// activeStreams counts the streams that use up a MAX_CONCURRENT_STREAMS
+// slot: open and half-closed ones. The client's streams count against our
+// limit, pushed ones against the client's. sc.mu must be held.
+// https://datatracker.ietf.org/doc/html/rfc9113#name-stream-concurrency
+func (sc *serverConn) activeStreams(pushed bool) uint32 {
+	var n uint32
+	for _, s := range sc.streams {
+		if (s.id%2 == 0) != pushed {
+			continue
+		}
+		if s.state == stateOpen || s.state == stateHalfClosedLocal || s.state == stateHalfClosedRemote {
+			n++
+		}
+	}
+	return n
+}
+
+// endRemote moves a stream on after the client sent END_STREAM.
+// sc.mu must be held.
+func (sc *serverConn) endRemote(s *streamState) {
+	switch s.state {
+	case stateOpen:
+		s.state = stateHalfClosedRemote
+	case stateHalfClosedLocal:
+		sc.closeStreamLocked(s)
+	}
+}
+
+// endLocal moves a stream on after we sent END_STREAM.
+func (sc *serverConn) endLocal(s *streamState) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	switch s.state {
+	case stateOpen:
+		s.state = stateHalfClosedLocal
+	case stateHalfClosedRemote, stateReservedLocal:
+		sc.closeStreamLocked(s)
+	}
+}
+
+// closeStreamLocked forgets a stream and wakes any writer blocked on it,
+// or reader of its body. sc.mu must be held.
+func (sc *serverConn) closeStreamLocked(s *streamState) {
+	if s.state == stateClosed {
+		return
+	}
+	s.state = stateClosed
+	delete(sc.streams, s.id)
+	sc.cond.Broadcast()
+	if s.body != nil {
+		// Nobody is going to read what is left, so the client gets the
+		// connection window back. Not from here, sc.mu is held.
+		if n := s.body.CloseWithError(errStreamClosed); n > 0 && !s.upgraded {
+			go sc.consumed(nil, n)
+		}
+	}
+}
+
+// maxResetStreams bounds the reset streams a connection remembers.
+const maxResetStreams = 1024
+
+// resetStream sends RST_STREAM and closes the stream. Frames the client
+// already had in flight for it are ignored from now on.
+func (sc *serverConn) resetStream(id int, code ErrCode) error {
+	log.Printf("Stream %d: sending RST_STREAM %s", id, code)
+	sc.mu.Lock()
+	if s, ok := sc.streams[id]; ok {
+		sc.closeStreamLocked(s)
+	}
+	sc.resetStreams[id] = true
+	if len(sc.resetStreams) > maxResetStreams {
+		// Streams are opened in order, so the lowest IDs were reset
+		// longest ago and the client has seen their RST_STREAM by now
+		ids := slices.Sorted(maps.Keys(sc.resetStreams))
+		for _, old := range ids[:len(ids)/2] {
+			delete(sc.resetStreams, old)
+		}
+	}
+	sc.mu.Unlock()
+
+	return sc.writeFrame(&frame.RSTStreamFrame{
+		FrameHeader: frame.FrameHeader{StreamID: uint32(id)},
+		ErrCode:     code,
+	})
+}
+
+// handleHeaders opens a new stream for a request. HEADERS on a stream that
+// is already open can only be trailers, which must end the stream. payload
+// is the whole header block, without padding and priority fields.
+func (sc *serverConn) handleHeaders(flags frame.Flags, streamID int, payload []byte, prio *frame.PriorityParam) error {
+	if streamID%2 == 0 {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("client opened even stream %d", streamID)}
+	}
+	endStream := flags.Has(frame.FlagEndStream)
+
+	log.Printf("Received HEADERS frame (len=%d)", len(payload))
+	headers, err := sc.decodeHeaders(payload)
+	tooLarge := errors.Is(err, errHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		// The dynamic table can no longer be trusted
+		log.Println("Failed to decode HPACK headers:", err)
+		return ConnectionError{Code: ErrCodeCompression, Reason: err.Error()}
+	}
+
+	sc.mu.Lock()
+	if stream, ok := sc.streams[streamID]; ok {
+		defer sc.mu.Unlock()
+		if !stream.remoteOpen() {
+			return StreamError{StreamID: uint32(streamID), Code: ErrCodeStreamClosed, Reason: "HEADERS after END_STREAM"}
+		}
+		if !endStream {
+			return StreamError{StreamID: uint32(streamID), Code: ErrCodeProtocol, Reason: "trailers without END_STREAM"}
+		}
+		if tooLarge {
+			return StreamError{StreamID: uint32(streamID), Code: ErrCodeProtocol, Reason: "trailers exceed MAX_HEADER_LIST_SIZE"}
+		}
+		// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-14
+		for _, hf := range headers {
+			if strings.HasPrefix(hf.Name, ":") {
+				return StreamError{StreamID: uint32(streamID), Code: ErrCodeProtocol, Reason: "pseudo-header " + hf.Name + " in trailers"}
+			}
+		}
+		if prio != nil {
+			if err := checkPriority(streamID, *prio); err != nil {
+				return err
+			}
+			stream.legacyPriority = *prio
+		}
+		log.Printf("Stream %d: Received trailers:", streamID)
+		for _, hf := range headers {
+			log.Printf("  %s: %s", hf.Name, hf.Value)
+		}
+		// The handler gets the trailers once the body reaches EOF
+		stream.trailers = headers
+		sc.endRemote(stream)
+		stream.body.CloseWithError(io.EOF)
+		return nil
+	}
+	if !sc.isIdle(streamID) {
+		reset := sc.resetStreams[streamID]
+		sc.mu.Unlock()
+		if reset {
+			return nil
+		}
+		return ConnectionError{Code: ErrCodeStreamClosed, Reason: fmt.Sprintf("HEADERS on closed stream %d", streamID)}
+	}
+
+	// The stream leaves idle even if we turn it down below
+	sc.maxClientStreamID = streamID
+	if sc.shuttingDown {
+		sc.mu.Unlock()
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeRefusedStream, Reason: "server is shutting down"}
+	}
+	// A stream the client reset still counts while its handler runs,
+	// or resetting streams would start handlers without limit.
+	if sc.activeStreams(false) >= sc.local.MaxConcurrentStreams || sc.handlers >= sc.local.MaxConcurrentStreams {
+		sc.mu.Unlock()
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeRefusedStream, Reason: "MAX_CONCURRENT_STREAMS reached"}
+	}
+	stream := &streamState{
+		id:             streamID,
+		headers:        headers,
+		state:          stateOpen,
+		legacyPriority: defaultPriorityParam,
+		priority:       requestPriority(headers),
+		sendWindow:     int64(sc.peer.InitialWindowSize),
+		recvWindow:     int64(sc.local.InitialWindowSize),
+	}
+	if prio != nil {
+		if err := checkPriority(streamID, *prio); err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		log.Printf("Stream %d: priority %s", streamID, *prio)
+		stream.legacyPriority = *prio
+	}
+	// A PRIORITY_UPDATE that raced ahead of the HEADERS is the client's
+	// latest word, so it wins over the header
+	if prio, ok := sc.pendingPriorities[streamID]; ok {
+		stream.priority = prio
+	}
+	for id := range sc.pendingPriorities {
+		if id <= streamID {
+			delete(sc.pendingPriorities, id)
+		}
+	}
+	if stream.priority != DefaultPriority {
+		log.Printf("Stream %d: RFC 9218 priority %s", streamID, stream.priority)
+	}
+	sc.streams[streamID] = stream
+	sc.lastStreamID = streamID
+	if !tooLarge {
+		sc.handlers++
+	}
+	if endStream {
+		// A request without a body (e.g. curl GET) ends with the HEADERS frame
+		sc.endRemote(stream)
+	} else {
+		stream.body = pipe.New()
+	}
+	sc.mu.Unlock()
+
+	if tooLarge {
+		log.Printf("Stream %d: %v", streamID, errHeaderListTooLarge)
+		w := sc.responseWriter(stream)
+		w.WriteHeaders([]hpack.HeaderField{{Name: ":status", Value: "431"}}, true)
+		if !endStream {
+			// We answered before the request ended, so tell the client to
+			// stop sending it.
+			// https://datatracker.ietf.org/doc/html/rfc9113#section-8.1-7
+			return sc.resetStream(streamID, ErrCodeNo)
+		}
+		return nil
+	}
+
+	log.Printf("Stream %d: Received HEADERS:\n", streamID)
+	for _, hf := range headers {
+		log.Printf("  %s: %s", hf.Name, hf.Value)
+	}
+	// The handler runs while the body is still arriving
+	go sc.serveStream(stream)
+	return nil
+}
+
+// handleData passes the body bytes of a DATA frame to the handler. DATA is
+// only allowed while the client has not ended the stream.
+func (sc *serverConn) handleData(f *frame.DataFrame) error {
+	streamID := int(f.StreamID)
+	// Padding counts against flow control even though it is thrown away
+	length := int(f.Length)
+	log.Printf("Stream %d: Received DATA (len=%d)", streamID, len(f.Data))
+	if len(f.Data) == 0 && !f.Flags.Has(frame.FlagEndStream) {
+		if err := sc.count(AbuseEmptyDataFlood); err != nil {
+			return err
+		}
+	}
+
+	sc.mu.Lock()
+	stream, ok := sc.streams[streamID]
+	open := ok && stream.remoteOpen()
+	idle := !ok && sc.isIdle(streamID)
+	reset := sc.resetStreams[streamID]
+	sc.mu.Unlock()
+	if idle {
+		return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("DATA on idle stream %d", streamID)}
+	}
+
+	if !open {
+		// The bytes still count against the connection window
+		if err := sc.takeRecvWindow(nil, length); err != nil {
+			return err
+		}
+		if err := sc.consumed(nil, length); err != nil {
+			return err
+		}
+		if reset {
+			return nil
+		}
+		return StreamError{StreamID: uint32(streamID), Code: ErrCodeStreamClosed, Reason: "DATA after END_STREAM"}
+	}
+	if err := sc.takeRecvWindow(stream, length); err != nil {
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			sc.consumed(nil, length)
+		}
+		return err
+	}
+	// Padding is given back right away, the data once the handler has
+	// read it. A handler that is done reads nothing more.
+	credit := length - len(f.Data)
+	if !stream.body.Write(f.Data) {
+		credit = length
+	}
+
+	if f.Flags.Has(frame.FlagEndStream) {
+		sc.mu.Lock()
+		sc.endRemote(stream)
+		sc.mu.Unlock()
+		stream.body.CloseWithError(io.EOF)
+		log.Printf("Stream %d: END_STREAM received", streamID)
+	}
+	return sc.consumed(stream, credit)
+}
+
+// handleRSTStream closes a stream the client has given up on. Writers
+// blocked on it return errStreamClosed.
+func (sc *serverConn) handleRSTStream(f *frame.RSTStreamFrame) error {
+	streamID := int(f.StreamID)
+	log.Printf("Stream %d: Received RST_STREAM %s", streamID, f.ErrCode)
+	if err := sc.count(AbuseRapidReset); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	stream, ok := sc.streams[streamID]
+	if !ok {
+		if sc.isIdle(streamID) {
+			return ConnectionError{Code: ErrCodeProtocol, Reason: fmt.Sprintf("RST_STREAM on idle stream %d", streamID)}
+		}
+		return nil
+	}
+	sc.closeStreamLocked(stream)
+	return nil
+}
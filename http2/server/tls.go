@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/h2tls"
+)
+
+// TLS
+// https://datatracker.ietf.org/doc/html/rfc9113#name-starting-http-2-for-https-u
+//
+// Over TLS the client offers "h2" with ALPN and the handshake settles on
+// it before a single HTTP/2 byte is sent; the connection preface follows
+// as with h2c. The handshake must also meet RFC 9113 §9.2, see h2tls.
+
+// handshakeTimeout bounds how long a client may take for the TLS handshake.
+const handshakeTimeout = 10 * time.Second
+
+// ListenAndServeTLS listens on s.Addr, ":8443" if empty, and then calls
+// ServeTLS.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8443"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeTLS is Serve over TLS. The certificate comes from certFile and
+// keyFile, or from s.TLSConfig if both are empty. Clients that negotiate
+// "h2" through ALPN get HTTP/2, the others HTTP/1.1.
+func (s *Server) ServeTLS(ln net.Listener, certFile, keyFile string) error {
+	config := h2tls.Config(s.TLSConfig)
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		ln.Close()
+		return errors.New("ServeTLS needs a certificate")
+	}
+	return s.Serve(tls.NewListener(ln, config))
+}
+
+// handshake runs the TLS handshake and, if the client negotiated h2, checks
+// that the security is adequate. An HTTP/2 connection that falls short of
+// RFC 9113 §9.2 gets GOAWAY INADEQUATE_SECURITY; anything else is served
+// HTTP/1.1.
+// https://datatracker.ietf.org/doc/html/rfc9113#section-9.2-2
+func (s *Server) handshake(tc *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+	state := tc.ConnectionState()
+	log.Printf("TLS %s with %s, ALPN %q", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	if state.NegotiatedProtocol != h2tls.NextProto {
+		return nil
+	}
+	if err := h2tls.Check(state); err != nil {
+		var connErr frame.ConnectionError
+		if errors.As(err, &connErr) {
+			frame.NewFramer(tc, nil).WriteFrame(&frame.GoAwayFrame{ErrCode: connErr.Code, DebugData: []byte(connErr.Reason)})
+		}
+		return err
+	}
+	return nil
+}
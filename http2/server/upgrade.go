@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nethish/fromscratch/http2/frame"
+	"github.com/nethish/fromscratch/http2/internal/pipe"
+)
+
+// h2c upgrade
+// https://datatracker.ietf.org/doc/html/rfc7540#section-3.2
+//
+// A client that does not know whether the server speaks HTTP/2 sends an
+// ordinary HTTP/1.1 request with
+//
+//	Connection: Upgrade, HTTP2-Settings
+//	Upgrade: h2c
+//	HTTP2-Settings: <base64url SETTINGS payload>
+//
+// and the server answers 101 Switching Protocols. From then on both sides
+// speak HTTP/2: the client sends the connection preface, the server its
+// SETTINGS, and the response to the HTTP/1.1 request comes on stream 1,
+// which the request has already half-closed. RFC 9113 deprecated the
+// mechanism, but clients such as curl --http2 still use it.
+
+// errNoUpgrade means an HTTP/1.x request does not ask for h2c.
+var errNoUpgrade = errors.New("no Upgrade: h2c")
+
+// errBodyTooLarge means the body of an Upgrade request is more than the
+// server buffers before switching, the initial window of stream 1.
+var errBodyTooLarge = errors.New("request body too large for an h2c upgrade")
+
+// hasPreface reports whether the connection starts with the HTTP/2 client
+// preface. It only reads as far as the first byte that differs, so an
+// HTTP/1.1 request shorter than the preface does not block it.
+func hasPreface(br *bufio.Reader) bool {
+	for n := 1; n <= len(clientPreface); n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			// Let the preface read report it
+			return true
+		}
+		if b[n-1] != clientPreface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// upgrade applies the HTTP2-Settings of an HTTP/1.1 request that asked
+// for h2c and switches protocols. The request, body included, becomes
+// stream 1. A body known to be too large to buffer returns
+// errBodyTooLarge before anything is read, so that the request can be
+// served over HTTP/1.1 instead.
+func (sc *serverConn) upgrade(req *http.Request, settings []frame.Setting) (*streamState, error) {
+	log.Printf("Received %s %s %s with Upgrade: h2c", req.Proto, req.Method, req.RequestURI)
+	// The whole request has to arrive before the client speaks HTTP/2,
+	// and the server has to hold it until the handler reads it
+	maxBody := int64(sc.local.InitialWindowSize)
+	if req.ContentLength > maxBody {
+		return nil, errBodyTooLarge
+	}
+	body, err := readHTTP1Body(sc.conn, req, maxBody)
+	if errors.Is(err, errBodyTooLarge) {
+		// A chunked body is partly read by now, too late for HTTP/1.1
+		io.WriteString(sc.conn, "HTTP/1.1 413 Request Entity Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, fmt.Errorf("h2c upgrade: chunked body of more than %d bytes", maxBody)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("h2c upgrade: %w", err)
+	}
+	// The 101 acknowledges these SETTINGS, no ACK frame is sent
+	if err := sc.applySettings(settings); err != nil {
+		io.WriteString(sc.conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, fmt.Errorf("h2c upgrade: %w", err)
+	}
+	if _, err := io.WriteString(sc.conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return nil, err
+	}
+	log.Println("Switched to h2c, the request is stream 1")
+
+	headers := http1Fields(req, "http")
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	stream := &streamState{
+		id:             1,
+		headers:        headers,
+		upgraded:       true,
+		trailers:       http1Trailers(req),
+		state:          stateHalfClosedRemote,
+		legacyPriority: defaultPriorityParam,
+		priority:       requestPriority(headers),
+		sendWindow:     int64(sc.peer.InitialWindowSize),
+		recvWindow:     int64(sc.local.InitialWindowSize),
+	}
+	if len(body) > 0 {
+		stream.body = pipe.New()
+		stream.body.Write(body)
+		stream.body.CloseWithError(io.EOF)
+	}
+	sc.streams[1] = stream
+	sc.maxClientStreamID = 1
+	sc.lastStreamID = 1
+	// Its handler starts once our SETTINGS are out
+	sc.handlers++
+	return stream, nil
+}
+
+// upgradeSettings checks that req asks for h2c and decodes the SETTINGS
+// payload of its only HTTP2-Settings header.
+// https://datatracker.ietf.org/doc/html/rfc7540#section-3.2.1
+func upgradeSettings(req *http.Request) ([]frame.Setting, error) {
+	if !headerHasToken(req.Header, "Upgrade", "h2c") {
+		return nil, errNoUpgrade
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Connection", "http2-settings") {
+		return nil, errors.New("Connection must list Upgrade and HTTP2-Settings")
+	}
+	values := req.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, fmt.Errorf("got %d HTTP2-Settings headers, want 1", len(values))
+	}
+	// base64url, with or without padding
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP2-Settings: %w", err)
+	}
+	return frame.ParseSettings(payload)
+}
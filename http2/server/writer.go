@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/nethish/fromscratch/http2/frame"
+)
+
+// Every stream runs its handler in its own goroutine, but only one
+// goroutine writes to the connection: writeLoop. Handlers and the read loop
+// queue FrameWrites and, when they care about the outcome, wait for the
+// result. Frames therefore never interleave, and header blocks are encoded
+// in the order they are sent, which HPACK requires. The order between
+// streams is up to the connection's WriteScheduler.
+
+// writeBufferSize is how much the writer collects before it writes to the
+// connection. It flushes whenever it runs out of queued frames.
+const writeBufferSize = 16 << 10
+
+// writeLoop writes the queued frames in the order the scheduler picks until
+// the connection is done serving. Waiting submitters learn the result once
+// their frames have reached the connection: when the buffer fills up and is
+// written out, or when the queue runs dry and it is flushed. A backlog of
+// other streams' frames therefore does not hold up a submitter whose frame
+// is already on its way.
+func (sc *serverConn) writeLoop() {
+	cw := &countingWriter{w: sc.conn}
+	bw := bufio.NewWriterSize(cw, writeBufferSize)
+	fr := frame.NewFramer(bw, nil)
+	var flushing []flushWaiter
+	notify := func(err error) {
+		n := 0
+		for _, f := range flushing {
+			if err == nil && f.offset > cw.n {
+				flushing[n] = f
+				n++
+				continue
+			}
+			f.done <- err
+		}
+		flushing = flushing[:n]
+	}
+	for {
+		// Let the scheduler see everything that is queued so far
+		for queued := true; queued; {
+			select {
+			case fw := <-sc.writeCh:
+				sc.sched.Push(fw)
+			default:
+				queued = false
+			}
+		}
+
+		fw, ok := sc.sched.Pop()
+		if !ok {
+			err := bw.Flush()
+			if err == nil {
+				err = cw.err
+			}
+			notify(err)
+
+			select {
+			case fw := <-sc.writeCh:
+				sc.sched.Push(fw)
+			case <-sc.doneServing:
+				return
+			}
+			continue
+		}
+
+		err := fw.write(fr)
+		switch {
+		case err != nil:
+			log.Printf("Stream %d: write failed: %v", fw.streamID, err)
+			if fw.done != nil {
+				fw.done <- err
+			}
+		case fw.done != nil:
+			flushing = append(flushing, flushWaiter{cw.n + int64(bw.Buffered()), fw.done})
+		}
+		notify(nil)
+	}
+}
+
+// flushWaiter is a submitter waiting until the connection has been written
+// up to offset.
+type flushWaiter struct {
+	offset int64
+	done   chan error
+}
+
+// countingWriter counts the bytes written to the connection.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// queue hands a write to the writer. The frames are written in the
+// stream's current priority.
+func (sc *serverConn) queue(streamID int, write func(fr *frame.Framer) error, done chan error) error {
+	fw := FrameWrite{streamID: streamID, priority: DefaultPriority, write: write, done: done}
+	if streamID != 0 {
+		sc.mu.Lock()
+		if stream, ok := sc.streams[streamID]; ok {
+			fw.priority = stream.priority
+		}
+		sc.mu.Unlock()
+	}
+	select {
+	case sc.writeCh <- fw:
+		return nil
+	case <-sc.doneServing:
+		return errConnClosed
+	}
+}
+
+// submit queues a write and waits until it has been written.
+func (sc *serverConn) submit(streamID int, write func(fr *frame.Framer) error) error {
+	done := make(chan error, 1)
+	if err := sc.queue(streamID, write, done); err != nil {
+		return err
+	}
+	return sc.wait(done)
+}
+
+// submitAsync queues a write without waiting for it.
+func (sc *serverConn) submitAsync(streamID int, write func(fr *frame.Framer) error) {
+	sc.queue(streamID, write, nil)
+}
+
+// wait returns the result of a queued write.
+func (sc *serverConn) wait(done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-sc.doneServing:
+		return errConnClosed
+	}
+}